@@ -0,0 +1,282 @@
+package mqueue
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// queueSnapshot is what Backup captures of a queue while it holds its lock,
+// the records of the captured segments are copied once the lock is released.
+type queueSnapshot struct {
+	name     string            // file name of the back file, e.g. k1.mq
+	queue    string            // name of the queue
+	segments []segmentSnapshot // segments with unread records, oldest first
+	cache    []byte            // records of the memory queue
+	cacheLen uint64            // how many records are in cache
+	ready    [][]byte          // released messages, delivered before the others
+	inflight []byte            // in-flight log, nil if nothing is in flight
+	delayed  []byte            // delayed messages log, nil if there is none
+	groups   []byte            // consumer groups log, nil unless in log mode
+}
+
+// segmentSnapshot is the unread part of a segment when it was captured.
+type segmentSnapshot struct {
+	file  *os.File // kept open, the segment may be consumed and removed meanwhile
+	from  uint64   // read position
+	to    uint64   // write position
+	count uint64   // records between from and to
+}
+
+// Backup writes a copy of queues to the directory dir, which must not exist.
+// The queues are captured at a single instant: they are all locked only to
+// freeze their segments and copy their memory state, the segments are copied
+// once the locks are released. The copy is written to dir.partial first and
+// renamed to dir once complete, Restore brings it back.
+func Backup(dir string, queues ...*CompositeQueue) error {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		if err == nil {
+			err = fmt.Errorf("Backup directory %s already exists", dir)
+		}
+		return err
+	}
+	tmpDir := dir + ".partial"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+	snaps, err := snapshotAll(queues, nil)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	for _, s := range snaps {
+		if err == nil {
+			err = s.write(tmpDir)
+		}
+		s.close()
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
+
+// snapshotAll captures queues while holding all of their locks, taken in the
+// order of lockPair, and calls locked, if not nil, before releasing them.
+// Deleted queues are skipped.
+func snapshotAll(queues []*CompositeQueue, locked func()) ([]*queueSnapshot, error) {
+	sorted := append([]*CompositeQueue{}, queues...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].option.BackFile < sorted[j].option.BackFile
+	})
+	for _, m := range sorted {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+	}
+	snaps := make([]*queueSnapshot, 0, len(sorted))
+	for _, m := range sorted {
+		if m.deleted {
+			continue
+		}
+		s, err := m.snapshot()
+		if err != nil {
+			for _, s := range snaps {
+				s.close()
+			}
+			return nil, err
+		}
+		snaps = append(snaps, s)
+	}
+	if locked != nil {
+		locked()
+	}
+	return snaps, nil
+}
+
+// snapshot captures the queue, the caller holds the lock. The writes go
+// past the captured records of the last segment, which tail replaces by a
+// new file if the segment is drained and reset meanwhile, so the unread
+// records of the captured segments stay in place until they are copied.
+func (m *CompositeQueue) snapshot() (*queueSnapshot, error) {
+	s := &queueSnapshot{name: filepath.Base(m.option.BackFile), queue: m.option.Name}
+	if m.readFromFile {
+		last := m.segments[len(m.segments)-1]
+		last.capture = last.queue.WritePosition()
+		for _, seg := range m.segments {
+			if seg.queue.Len() == 0 {
+				continue
+			}
+			file, err := os.Open(seg.path)
+			if err != nil {
+				s.close()
+				return nil, err
+			}
+			s.segments = append(s.segments, segmentSnapshot{
+				file:  file,
+				from:  seg.queue.ReadPosition(),
+				to:    seg.queue.WritePosition(),
+				count: seg.queue.Len(),
+			})
+		}
+	}
+	s.cache = append([]byte{}, m.cacheQueue[m.cacheQueue.ReadPosition():m.cacheQueue.WritePosition()]...)
+	s.cacheLen = m.cacheQueue.Len()
+	for _, p := range m.inflight.ready {
+		s.ready = append(s.ready, p.data)
+	}
+	var err error
+	if !m.inflight.empty() {
+		s.inflight, err = m.inflight.snapshot()
+	}
+	if err == nil && !m.delayed.empty() {
+		s.delayed, err = m.delayed.snapshot()
+	}
+	if err == nil && m.groups != nil && !m.groups.empty() {
+		s.groups, err = m.groups.snapshot()
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// write puts the snapshot in dir. The captured segments, then the memory
+// queue, become the segments of the copy, which only hold unread records.
+func (s *queueSnapshot) write(dir string) error {
+	backFile := filepath.Join(dir, s.name)
+	var seq uint64
+	for _, seg := range s.segments {
+		seq++
+		r := io.NewSectionReader(seg.file, int64(seg.from), int64(seg.to-seg.from))
+		if err := writeSegment(SegmentPath(backFile, seq), r, seg.to-seg.from, seg.count); err != nil {
+			return err
+		}
+	}
+	if s.cacheLen > 0 {
+		seq++
+		r := bytes.NewReader(s.cache)
+		if err := writeSegment(SegmentPath(backFile, seq), r, uint64(len(s.cache)), s.cacheLen); err != nil {
+			return err
+		}
+	}
+	logs := []struct {
+		path string
+		data []byte
+	}{
+		{InflightPath(backFile), s.inflight},
+		{DelayedPath(backFile), s.delayed},
+		{GroupsPath(backFile), s.groups},
+	}
+	for _, l := range logs {
+		if len(l.data) == 0 {
+			continue
+		}
+		if _, err := writeFile(l.path, bytes.NewReader(l.data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *queueSnapshot) close() {
+	for _, seg := range s.segments {
+		seg.file.Close()
+	}
+	s.segments = nil
+}
+
+// writeSegment writes a segment file holding the count records of size bytes
+// read from r. The segment is just large enough for them.
+func writeSegment(path string, r io.Reader, size, count uint64) error {
+	header := make(MQueue, headerSize)
+	if err := InitMQueue(header); err != nil {
+		return err
+	}
+	header.setCapacity(headerSize + size)
+	header.setWritePosition(headerSize + size)
+	header.setWriteCount(count)
+	n, err := writeFile(path, io.MultiReader(bytes.NewReader(header), io.LimitReader(r, int64(size))))
+	if err == nil && uint64(n) != headerSize+size {
+		os.Remove(path)
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writeFile creates the file path with the content of r and syncs it, and
+// returns how many bytes were written. It fails if the file exists.
+func writeFile(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return n, err
+}
+
+// Restore copies the queues of a backup written by Backup to dataDir, it is
+// meant to run before they are opened. It refuses to overwrite any file,
+// nothing is copied if one of the files of the backup exists in dataDir.
+// Every file is copied aside and renamed, so a crash does not leave a torn
+// file behind.
+func Restore(dir, dataDir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, err = os.Stat(filepath.Join(dataDir, f.Name())); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("Can not restore %s over an existing file", f.Name())
+			}
+			return err
+		}
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if err = restoreFile(filepath.Join(dir, f.Name()), filepath.Join(dataDir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := dst + ".restore"
+	os.Remove(tmpPath)
+	if _, err = writeFile(tmpPath, in); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
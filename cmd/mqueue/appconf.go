@@ -1,13 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 
+	"github.com/secmask/mqueue"
 	"gopkg.in/yaml.v2"
 )
 
+var FileNameNotValid = errors.New("file name must not be empty, absolute, .. or hold a path separator")
+
 const (
 	kilobyte = 1 << 10
 	megabyte = 1 << 20
@@ -15,12 +23,228 @@ const (
 )
 
 type Config struct {
-	HostAndPort   string    `yaml:"host_port"`
-	FileBlockUnit HumanSize `yaml:"file_block_unit"`
-	Cache         HumanSize `yaml:"cache_size"`
-	DataDir       string    `yaml:"data_dir"`
-	LogTo         string    `yaml:"log_to"`
-	Chroot        string    `yaml:"chroot"`
+	HostAndPort   string        `yaml:"host_port"`
+	FileBlockUnit HumanSize     `yaml:"file_block_unit"`
+	Cache         HumanSize     `yaml:"cache_size"`
+	DataDir       string        `yaml:"data_dir"`
+	LogTo         string        `yaml:"log_to"`
+	Chroot        string        `yaml:"chroot"`
+	Journal       bool          `yaml:"journal"`           // journal cached messages so they survive a crash
+	Fsync         string        `yaml:"fsync"`             // always, everysec or no, default no
+	Recovery      string        `yaml:"recovery_policy"`   // truncate, skip or refuse corrupted records, default truncate
+	MaxMessage    HumanSize     `yaml:"max_message_size"`  // largest accepted message, default 8m
+	BackupDir     string        `yaml:"backup_dir"`        // where BACKUP and BGSAVE write, default data_dir/backup
+	ExportDir     string        `yaml:"export_dir"`        // where EXPORT writes and IMPORT reads, both are refused if not set
+	ReplicaOf     string        `yaml:"replicaof"`         // host:port of the primary to replicate, none if not set
+	ReplBacklog   HumanSize     `yaml:"repl_backlog_size"` // ops kept for replicas to catch up after a disconnection, default 1m
+	PeerSecret    string        `yaml:"peer_secret"`       // sent by PEERAUTH between raft or cluster nodes, required by both
+	Raft          RaftConfig    `yaml:"raft"`              // nodes sharing the queues through a raft log, off if raft.id is not set
+	Cluster       ClusterConfig `yaml:"cluster"`           // nodes sharing the hash slots of the queues, off if cluster.id is not set
+
+	QueueDefaults QueueConfig            `yaml:"queue_defaults"` // settings of queues not listed in queues
+	Queues        map[string]QueueConfig `yaml:"queues"`         // settings of individual queues
+}
+
+// RaftConfig holds the settings of raft mode.
+type RaftConfig struct {
+	ID              string            `yaml:"id"`               // name of this node in peers
+	Peers           map[string]string `yaml:"peers"`            // host:port of the client port of every node by name, this one included
+	ElectionTimeout int               `yaml:"election_timeout"` // milliseconds without a leader before an election, default 1000
+}
+
+// ClusterConfig holds the settings of cluster mode.
+type ClusterConfig struct {
+	ID    string                 `yaml:"id"`    // name of this node in nodes
+	Nodes map[string]ClusterNode `yaml:"nodes"` // every node by name, this one included
+}
+
+// ClusterNode is a node of the cluster.
+type ClusterNode struct {
+	Addr  string `yaml:"addr"`  // host:port of the client port
+	Slots string `yaml:"slots"` // slots owned until data_dir/cluster.state tells otherwise, e.g. 0-5460,6000
+}
+
+// QueueConfig holds the settings of one queue.
+type QueueConfig struct {
+	MaxLength    uint64    `yaml:"max_length"`    // most messages, 0 means unbounded
+	MaxBytes     HumanSize `yaml:"max_bytes"`     // most bytes, unbounded if not set
+	Overflow     string    `yaml:"overflow"`      // reject, drop-oldest or block, default reject
+	BlockTimeout int       `yaml:"block_timeout"` // seconds a blocked producer waits, 0 means forever
+
+	VisibilityTimeout int    `yaml:"visibility_timeout"` // seconds a reserved message waits for ACK, default 30
+	TTL               int    `yaml:"ttl"`                // seconds messages live unless pushed with a TTL, 0 means forever
+	ExpiredQueue      string `yaml:"expired_queue"`      // queue receiving the expired messages, they are dropped if not set
+	MaxDeliveries     int    `yaml:"max_deliveries"`     // deliveries of a reserved message before it is dead, 0 means no limit
+	DeadLetterQueue   string `yaml:"dead_letter_queue"`  // queue receiving the dead messages, they are dropped if not set
+	Mode              string `yaml:"mode"`               // queue, log to keep messages for consumer groups, or stream, a log only XADD adds to, default queue
+	PublishOnPush     bool   `yaml:"publish_on_push"`    // if true, pushed messages are also published on the channel named after the queue
+}
+
+// QueueConfig returns the settings of the queue qName, those listed in
+// queues replace the defaults as a whole.
+func (c *Config) QueueConfig(qName string) QueueConfig {
+	if qc, ok := c.Queues[qName]; ok {
+		return qc
+	}
+	return c.QueueDefaults
+}
+
+// Retain tells whether the queue is a log read by consumer groups.
+func (qc QueueConfig) Retain() bool {
+	return qc.Mode == "log" || qc.Mode == "stream"
+}
+
+// Stream tells whether the queue is a log of XADD entries only.
+func (qc QueueConfig) Stream() bool {
+	return qc.Mode == "stream"
+}
+
+// OverflowPolicy returns the configured overflow policy, reject if it is not set.
+func (qc QueueConfig) OverflowPolicy() mqueue.OverflowPolicy {
+	p, _ := mqueue.ParseOverflowPolicy(qc.Overflow)
+	return p
+}
+
+func (qc QueueConfig) validate() error {
+	if qc.Overflow != "" {
+		if _, err := mqueue.ParseOverflowPolicy(qc.Overflow); err != nil {
+			return err
+		}
+	}
+	if qc.VisibilityTimeout < 0 {
+		return fmt.Errorf("visibility_timeout must not be negative")
+	}
+	if qc.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	if qc.ExpiredQueue != "" && !queueNamePattern.MatchString(qc.ExpiredQueue) {
+		return fmt.Errorf("expired_queue: %v", QueueNameNotValid)
+	}
+	if qc.Mode != "" && qc.Mode != "queue" && qc.Mode != "log" && qc.Mode != "stream" {
+		return fmt.Errorf("unknown mode %q", qc.Mode)
+	}
+	if qc.MaxDeliveries < 0 {
+		return fmt.Errorf("max_deliveries must not be negative")
+	}
+	if qc.DeadLetterQueue != "" && !queueNamePattern.MatchString(qc.DeadLetterQueue) {
+		return fmt.Errorf("dead_letter_queue: %v", QueueNameNotValid)
+	}
+	return nil
+}
+
+// FsyncPolicy returns the configured fsync policy, no if it is not set.
+func (c *Config) FsyncPolicy() mqueue.FsyncPolicy {
+	p, err := mqueue.ParseFsyncPolicy(c.Fsync)
+	if err != nil {
+		return mqueue.FsyncNo
+	}
+	return p
+}
+
+// BackupDirectory returns the directory of the backups taken by BACKUP and
+// BGSAVE.
+func (c *Config) BackupDirectory() string {
+	if c.BackupDir != "" {
+		return c.BackupDir
+	}
+	return path.Join(c.DataDir, "backup")
+}
+
+// namedPath returns name in dir. Clients give name, so it must be a plain
+// file name which can not point out of dir.
+func namedPath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.IsAbs(name) || strings.ContainsAny(name, `/\`) {
+		return "", FileNameNotValid
+	}
+	return path.Join(dir, name), nil
+}
+
+// RecoveryPolicy returns the configured recovery policy, truncate if it is not set.
+func (c *Config) RecoveryPolicy() mqueue.RecoveryPolicy {
+	p, _ := mqueue.ParseRecoveryPolicy(c.Recovery)
+	return p
+}
+
+func (c *Config) validate() error {
+	if c.Fsync != "" {
+		if _, err := mqueue.ParseFsyncPolicy(c.Fsync); err != nil {
+			return err
+		}
+	}
+	if c.Recovery != "" {
+		if _, err := mqueue.ParseRecoveryPolicy(c.Recovery); err != nil {
+			return err
+		}
+	}
+	if c.ReplicaOf != "" {
+		if _, _, err := net.SplitHostPort(c.ReplicaOf); err != nil {
+			return fmt.Errorf("replicaof: %v", err)
+		}
+	}
+	if c.Raft.ID != "" {
+		if _, ok := c.Raft.Peers[c.Raft.ID]; !ok {
+			return fmt.Errorf("raft: id %s is not in peers", c.Raft.ID)
+		}
+		for id, addr := range c.Raft.Peers {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("raft: peer %s: %v", id, err)
+			}
+		}
+		if c.Raft.ElectionTimeout < 0 {
+			return fmt.Errorf("raft: negative election_timeout %d", c.Raft.ElectionTimeout)
+		}
+		if c.ReplicaOf != "" {
+			return fmt.Errorf("raft and replicaof can not be both set")
+		}
+		if c.PeerSecret == "" {
+			return fmt.Errorf("raft: peer_secret is not set")
+		}
+	}
+	if c.Cluster.ID != "" {
+		if err := c.Cluster.validate(); err != nil {
+			return fmt.Errorf("cluster: %v", err)
+		}
+		if c.Raft.ID != "" {
+			return fmt.Errorf("raft and cluster can not be both set")
+		}
+		if c.PeerSecret == "" {
+			return fmt.Errorf("cluster: peer_secret is not set")
+		}
+	}
+	if err := c.QueueDefaults.validate(); err != nil {
+		return err
+	}
+	for name, qc := range c.Queues {
+		if err := qc.validate(); err != nil {
+			return fmt.Errorf("queue %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c ClusterConfig) validate() error {
+	if _, ok := c.Nodes[c.ID]; !ok {
+		return fmt.Errorf("id %s is not in nodes", c.ID)
+	}
+	owners := make(map[int]string)
+	for id, node := range c.Nodes {
+		if _, _, err := net.SplitHostPort(node.Addr); err != nil {
+			return fmt.Errorf("node %s: %v", id, err)
+		}
+		ranges, err := parseSlotRanges(node.Slots)
+		if err != nil {
+			return fmt.Errorf("node %s: %v", id, err)
+		}
+		for _, r := range ranges {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				if other, ok := owners[slot]; ok {
+					return fmt.Errorf("slot %d is owned by %s and %s", slot, other, id)
+				}
+				owners[slot] = id
+			}
+		}
+	}
+	return nil
 }
 
 type HumanSize string
@@ -48,6 +272,9 @@ func ConfigFromFile(f string) (*Config, error) {
 func ParseConfig(data []byte) (*Config, error) {
 	c := &Config{}
 	err := yaml.Unmarshal(data, c)
+	if err == nil {
+		err = c.validate()
+	}
 	return c, err
 }
 
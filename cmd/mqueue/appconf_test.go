@@ -2,6 +2,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/secmask/mqueue"
 )
 
 var (
@@ -28,3 +30,82 @@ func TestParseConfig(t *testing.T) {
 		t.Errorf("Unexpected host_port %s", c.HostAndPort)
 	}
 }
+
+func TestParseConfigFsync(t *testing.T) {
+	c, err := ParseConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FsyncPolicy() != mqueue.FsyncNo {
+		t.Errorf("Unexpected default fsync policy %s", c.FsyncPolicy())
+	}
+	if c, err = ParseConfig([]byte("fsync: always")); err != nil || c.FsyncPolicy() != mqueue.FsyncAlways {
+		t.Errorf("Unexpected fsync policy %v, %v", c.FsyncPolicy(), err)
+	}
+	if _, err = ParseConfig([]byte("fsync: sometimes")); err == nil {
+		t.Error("Expect error on unknown fsync policy")
+	}
+}
+
+func TestParseConfigQueues(t *testing.T) {
+	c, err := ParseConfig([]byte(`
+queue_defaults:
+  max_length: 1000
+queues:
+  jobs:
+    max_bytes: 1g
+    overflow: block
+    block_timeout: 3
+    visibility_timeout: 60
+    ttl: 3600
+    expired_queue: jobs-expired
+    max_deliveries: 5
+    dead_letter_queue: jobs-dead
+  events:
+    mode: log
+    publish_on_push: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qc := c.QueueConfig("other"); qc.MaxLength != 1000 || qc.OverflowPolicy() != mqueue.OverflowReject {
+		t.Errorf("Unexpected default queue config %+v", qc)
+	}
+	qc := c.QueueConfig("jobs")
+	if v, err := qc.MaxBytes.Value(); err != nil || v != gigabyte || qc.MaxLength != 0 {
+		t.Errorf("Unexpected jobs limits %+v", qc)
+	}
+	if qc.OverflowPolicy() != mqueue.OverflowBlock || qc.BlockTimeout != 3 {
+		t.Errorf("Unexpected jobs overflow %+v", qc)
+	}
+	if qc.VisibilityTimeout != 60 {
+		t.Errorf("Unexpected jobs visibility timeout %d", qc.VisibilityTimeout)
+	}
+	if qc.TTL != 3600 || qc.ExpiredQueue != "jobs-expired" {
+		t.Errorf("Unexpected jobs expiry %+v", qc)
+	}
+	if qc.MaxDeliveries != 5 || qc.DeadLetterQueue != "jobs-dead" {
+		t.Errorf("Unexpected jobs dead letters %+v", qc)
+	}
+	if !c.QueueConfig("events").Retain() || qc.Retain() {
+		t.Error("Expect only events to be a log")
+	}
+	if !c.QueueConfig("events").PublishOnPush || qc.PublishOnPush {
+		t.Error("Expect only events to publish on push")
+	}
+	if _, err = ParseConfig([]byte("queues: {jobs: {overflow: explode}}")); err == nil {
+		t.Error("Expect error on unknown overflow policy")
+	}
+	if _, err = ParseConfig([]byte("queues: {jobs: {visibility_timeout: -1}}")); err == nil {
+		t.Error("Expect error on negative visibility timeout")
+	}
+	if _, err = ParseConfig([]byte("queue_defaults: {expired_queue: a.b}")); err == nil {
+		t.Error("Expect error on invalid expired queue name")
+	}
+	if _, err = ParseConfig([]byte("queue_defaults: {max_deliveries: -1}")); err == nil {
+		t.Error("Expect error on negative max deliveries")
+	}
+	if _, err = ParseConfig([]byte("queue_defaults: {mode: fifo}")); err == nil {
+		t.Error("Expect error on unknown mode")
+	}
+}
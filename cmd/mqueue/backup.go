@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/secmask/mqueue"
+)
+
+var BackupInProgress = errors.New("Background backup already in progress")
+
+// backupState is the backup running, if any, and the outcome of the last one.
+type backupState struct {
+	lock    sync.Mutex
+	running bool
+	last    time.Time // when the last backup completed
+	lastErr error     // why the last backup failed, nil if it succeeded
+}
+
+// start marks a backup as running, it fails if one is running already.
+func (b *backupState) start() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.running {
+		return BackupInProgress
+	}
+	b.running = true
+	return nil
+}
+
+func (b *backupState) done(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.running = false
+	b.last = time.Now()
+	b.lastErr = err
+}
+
+// BackupStats tells whether a backup is running, when the last one completed
+// and why it failed, if it did.
+func (q *QueueMan) BackupStats() (running bool, last time.Time, err error) {
+	q.backup.lock.Lock()
+	defer q.backup.lock.Unlock()
+	return q.backup.running, q.backup.last, q.backup.lastErr
+}
+
+// backupPath returns the directory of the backup name in backup_dir.
+func (q *QueueMan) backupPath(name string) (string, error) {
+	if strings.HasSuffix(name, ".partial") {
+		// the name of the directories of the backups being written
+		return "", FileNameNotValid
+	}
+	return namedPath(q.conf.BackupDirectory(), name)
+}
+
+// Backup writes a consistent copy of every queue and lane to the directory
+// name of backup_dir, which must not exist. The producers are only held while
+// the queues are captured, not while they are copied.
+func (q *QueueMan) Backup(name string) error {
+	dir, err := q.backupPath(name)
+	if err != nil {
+		return err
+	}
+	if err := q.backup.start(); err != nil {
+		return err
+	}
+	err = mqueue.Backup(dir, q.all()...)
+	q.backup.done(err)
+	return err
+}
+
+// BackgroundBackup starts Backup to name, or to a directory named after the
+// current time if name is empty, and returns the directory.
+func (q *QueueMan) BackgroundBackup(name string) (string, error) {
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+	dir, err := q.backupPath(name)
+	if err != nil {
+		return "", err
+	}
+	if err := q.backup.start(); err != nil {
+		return "", err
+	}
+	q.jobs.Add(1)
+	go func() {
+		defer q.jobs.Done()
+		lf := log.Fields{
+			"func": "QueueMan#BackgroundBackup",
+			"dir":  dir,
+		}
+		err := mqueue.Backup(dir, q.all()...)
+		q.backup.done(err)
+		if err != nil {
+			log.WithFields(lf).WithError(err).Error("failed to back up queues")
+		} else {
+			log.WithFields(lf).Info("backed up queues")
+		}
+	}()
+	return dir, nil
+}
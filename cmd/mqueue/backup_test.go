@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/secmask/mqueue"
+)
+
+func TestQueueManBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k"}
+	qMan := NewQueueMan(conf)
+	q, err := qMan.GetOrCreate("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Put([]byte("job")); err != nil {
+		t.Fatal(err)
+	}
+	lane, err := qMan.Lane("jobs", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lane.Put([]byte("urgent")); err != nil {
+		t.Fatal(err)
+	}
+	backupDir, err := qMan.BackgroundBackup("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for running := true; running; {
+		time.Sleep(10 * time.Millisecond)
+		running, _, err = qMan.BackupStats()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Dir(backupDir) != conf.BackupDirectory() {
+		t.Fatalf("Unexpected backup directory %s", backupDir)
+	}
+	// clients only name a directory of backup_dir
+	for _, name := range []string{"../out", "/tmp/out", "a/b", "..", "old.partial"} {
+		if err = qMan.Backup(name); err != FileNameNotValid {
+			t.Errorf("Expect FileNameNotValid for %s, got %v", name, err)
+		}
+	}
+	qMan.CloseAll()
+
+	restored := &Config{DataDir: path.Join(dir, "restored"), FileBlockUnit: "64k", Cache: "1k"}
+	if err = mqueue.Restore(backupDir, restored.DataDir); err != nil {
+		t.Fatal(err)
+	}
+	qMan = NewQueueMan(restored)
+	qMan.Load()
+	defer qMan.CloseAll()
+	lanes, _, err := qMan.Lanes("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"urgent", "job"} {
+		data, err := lanes[i].q.Pop(nil)
+		if err != nil || string(data) != want {
+			t.Fatalf("Unexpected message %q, %v in lane %d", data, err, i)
+		}
+	}
+}
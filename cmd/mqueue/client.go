@@ -3,7 +3,11 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
+	"errors"
+	"math"
 	"net"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,8 +27,27 @@ type Client struct {
 	qMan        *QueueMan
 	context     context.Context
 	buffer      []byte
+	reserved    map[reservation]struct{} // messages reserved by this client and not acknowledged
+	sub         *subscriber              // subscriptions, nil until the client subscribes
+	replica     *replicaLink             // set once the client is a replica fed by PSYNC
+	peer        bool                     // set by PEERAUTH, the commands between nodes are refused otherwise
+	installing  bool                     // set between RAFTINSTALL and RAFTINSTALLED from the raft leader
+	asking      bool                     // set by ASKING for the next command
+	loading     string                   // queue sent by a migrating node, dropped unless SLOTLOADED comes
+	writeLock   sync.Mutex               // held while a command runs or a published message is written
 }
 
+// reservation is a message delivered by RESERVE or BRESERVE, it is released
+// when the client goes away without ACK.
+type reservation struct {
+	q  *mqueue.CompositeQueue
+	id uint64
+}
+
+// initialBufferSize is the size of the pop buffer of a new client, it grows
+// to fit larger messages.
+const initialBufferSize = 64 * kilobyte
+
 var (
 	opCounter         uint64 = 0
 	opCounterSnapshot uint64 = 0
@@ -42,10 +65,11 @@ func init() {
 
 func NewClient(conn net.Conn, ctx context.Context, qMan *QueueMan) *Client {
 	return &Client{
-		conn:    conn,
-		context: ctx,
-		qMan:    qMan,
-		buffer:  make([]byte, mqueue.MaxElementLength),
+		conn:     conn,
+		context:  ctx,
+		qMan:     qMan,
+		buffer:   make([]byte, initialBufferSize),
+		reserved: make(map[reservation]struct{}),
 	}
 }
 
@@ -66,19 +90,627 @@ func (c *Client) Run(wg *sync.WaitGroup) {
 
 	for {
 		if cmd, err := parser.ReadCommand(); err == nil {
+			c.writeLock.Lock()
 			c.processCommand(cmd)
+			c.writeLock.Unlock()
 		} else {
 			break
 		}
 	}
 	close(done)
+	c.releaseReserved()
+	if c.sub != nil {
+		c.qMan.pubsub.close(c.sub)
+	}
+	if c.replica != nil {
+		c.qMan.repl.detach(c.replica)
+	}
+	if c.installing {
+		c.qMan.raft.abortInstall()
+	}
+	if c.loading != "" {
+		c.qMan.Delete(c.loading)
+	}
+}
+
+// deliver writes the messages published to the client until it goes away.
+func (c *Client) deliver(out <-chan []interface{}) {
+	for msg := range out {
+		c.writeLock.Lock()
+		c.redisWriter.WriteObjectsSlice(msg)
+		c.redisWriter.Flush()
+		c.writeLock.Unlock()
+	}
+}
+
+// feed writes the replication stream to the replica until it is detached.
+func (c *Client) feed(link *replicaLink) {
+	lf := log.Fields{
+		"func":    "Client#feed",
+		"replica": link.addr,
+	}
+	for {
+		ops, err := c.qMan.repl.next(link)
+		if err == nil {
+			c.writeLock.Lock()
+			for _, op := range ops {
+				op.write(c.redisWriter)
+			}
+			err = c.redisWriter.Flush()
+			c.writeLock.Unlock()
+		}
+		if err != nil {
+			if err != ReplicaDetached {
+				log.WithFields(lf).WithError(err).Warn("dropped replica")
+			}
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// releaseReserved delivers again the messages this client did not acknowledge.
+func (c *Client) releaseReserved() {
+	lf := log.Fields{
+		"func": "Client#releaseReserved",
+	}
+	for r := range c.reserved {
+		if _, err := r.q.Release(r.id); err != nil {
+			log.WithFields(lf).WithError(err).Error("failed to release message")
+		}
+	}
+	c.reserved = nil
 }
 
 func (c *Client) handleINFO(cmd *rp.Command) error {
-	c.redisWriter.WriteBulkString(fmt.Sprintf("Version: %s\nOperation Rate: %d\n", version, opCounterSnapshot))
+	var lastSyncUnix int64
+	lastSync, syncLatency := c.qMan.SyncStats()
+	if !lastSync.IsZero() {
+		lastSyncUnix = lastSync.Unix()
+	}
+	var lastBackupUnix int64
+	backupRunning, lastBackup, backupErr := c.qMan.BackupStats()
+	if !lastBackup.IsZero() {
+		lastBackupUnix = lastBackup.Unix()
+	}
+	backupStatus := "ok"
+	if backupErr != nil {
+		backupStatus = "err"
+	}
+	if strings.EqualFold(string(cmd.Get(1)), "replication") {
+		c.redisWriter.WriteBulkString(c.qMan.repl.info())
+		return c.redisWriter.Flush()
+	}
+	var raftInfo string
+	if c.qMan.raft != nil {
+		raftInfo = "\n" + c.qMan.raft.info()
+	}
+	if strings.EqualFold(string(cmd.Get(1)), "raft") {
+		c.redisWriter.WriteBulkString(strings.TrimPrefix(raftInfo, "\n"))
+		return c.redisWriter.Flush()
+	}
+	clusterInfo := "\n# Cluster\ncluster_enabled:0\n"
+	if c.qMan.cluster != nil {
+		clusterInfo = "\n# Cluster\ncluster_enabled:1\n"
+	}
+	if strings.EqualFold(string(cmd.Get(1)), "cluster") {
+		c.redisWriter.WriteBulkString(strings.TrimPrefix(clusterInfo, "\n"))
+		return c.redisWriter.Flush()
+	}
+	c.redisWriter.WriteBulkString(fmt.Sprintf("Version: %s\nOperation Rate: %d\nFsync: %s\nLast Sync: %d\nSync Latency: %s\nEvicted: %d\nIn Flight: %d\nDelayed: %d\nExpired: %d\nDead Lettered: %d\nBackup In Progress: %t\nLast Backup: %d\nLast Backup Status: %s\n",
+		version, opCounterSnapshot, c.qMan.conf.FsyncPolicy(), lastSyncUnix, syncLatency, c.qMan.Evicted(), c.qMan.InFlight(), c.qMan.Delayed(), c.qMan.Expired(), c.qMan.Dead(),
+		backupRunning, lastBackupUnix, backupStatus) + "\n" + c.qMan.repl.info() + raftInfo + clusterInfo)
 	return c.redisWriter.Flush()
 }
 
+// handleBACKUP handles "BACKUP name", it replies once every queue is copied
+// to the directory name of backup_dir.
+func (c *Client) handleBACKUP(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleBACKUP",
+	}
+	if cmd.ArgCount() != 2 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'backup' command")
+	}
+	if err := c.qMan.Backup(string(cmd.Get(1))); err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to back up queues")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteSimpleString("OK")
+}
+
+// handleBGSAVE handles "BGSAVE [name]", it replies as soon as the backup to
+// the directory name of backup_dir is started, INFO tells how it went.
+func (c *Client) handleBGSAVE(cmd *rp.Command) error {
+	if cmd.ArgCount() > 2 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'bgsave' command")
+	}
+	if _, err := c.qMan.BackgroundBackup(string(cmd.Get(1))); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteSimpleString("Background saving started")
+}
+
+// handleEXPORT handles "EXPORT key name [JSONL|BINARY]", it writes the
+// messages of the queue to a new file name of export_dir and replies with
+// how many there were.
+func (c *Client) handleEXPORT(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleEXPORT",
+	}
+	format, err := c.exportArgs(cmd, "export")
+	if err != nil {
+		return err
+	}
+	lanes, _, err := c.lanes(string(cmd.Get(1)), lf)
+	if err != nil {
+		return err
+	}
+	file, err := c.exportPath(string(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	n, err := exportFile(lanes, file, format)
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to export queue")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// handleIMPORT handles "IMPORT key name [JSONL|BINARY]", it puts the
+// messages of the file name of export_dir in the queue and replies with how
+// many were put.
+func (c *Client) handleIMPORT(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleIMPORT",
+	}
+	format, err := c.exportArgs(cmd, "import")
+	if err != nil {
+		return err
+	}
+	file, err := c.exportPath(string(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	qName := string(cmd.Get(1))
+	if _, err := c.queue(qName, lf); err != nil {
+		return err
+	}
+	n, err := importFile(c.qMan, qName, file, format)
+	if err != nil {
+		log.WithFields(lf).WithError(err).Errorf("stopped after %d messages", n)
+		return c.redisWriter.WriteError(fmt.Sprintf("%s, %d imported", err, n))
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// exportPath returns the file name of export_dir for EXPORT and IMPORT.
+func (c *Client) exportPath(name string) (string, error) {
+	if c.qMan.conf.ExportDir == "" {
+		return "", ExportDirNotSet
+	}
+	return namedPath(c.qMan.conf.ExportDir, name)
+}
+
+// exportArgs checks the arguments of EXPORT and IMPORT and returns the
+// format, writing the error reply if they are wrong.
+func (c *Client) exportArgs(cmd *rp.Command, name string) (exportFormat, error) {
+	if cmd.ArgCount() < 3 || cmd.ArgCount() > 4 {
+		err := fmt.Errorf("wrong number of arguments for '%s' command", name)
+		c.redisWriter.WriteError(err.Error())
+		return formatJSONL, err
+	}
+	format, err := parseExportFormat(string(cmd.Get(3)))
+	if err != nil {
+		c.redisWriter.WriteError(err.Error())
+	}
+	return format, err
+}
+
+// handlePSYNC handles "PSYNC replid offset" from a replica, the connection
+// carries the replication stream from then on.
+func (c *Client) handlePSYNC(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func":    "handlePSYNC",
+		"replica": c.conn.RemoteAddr().String(),
+	}
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'psync' command")
+	}
+	if c.replica != nil || c.subscribed() {
+		return c.redisWriter.WriteError("PSYNC not allowed in this context")
+	}
+	if c.qMan.IsReplica() {
+		return c.redisWriter.WriteError(ReplicaOfReplica.Error())
+	}
+	if c.qMan.raft != nil {
+		return c.redisWriter.WriteError(CommandNotInRaftMode.Error())
+	}
+	// a malformed offset asks for a full sync, like the ID "?"
+	offset, _ := strconv.ParseUint(string(cmd.Get(2)), 10, 64)
+	link := &replicaLink{addr: c.conn.RemoteAddr().String(), stop: make(chan struct{})}
+	c.replica = link
+	err := c.qMan.SyncReplica(link, string(cmd.Get(1)), offset, c.redisWriter.WriteBulks)
+	if err == nil {
+		err = c.redisWriter.Flush()
+	}
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to sync replica")
+		c.conn.Close()
+		return err
+	}
+	log.WithFields(lf).Info("replica synced")
+	go c.feed(link)
+	return nil
+}
+
+// handleREPLCONF handles "REPLCONF ACK offset" from a replica, which has no
+// reply, and replies OK to the other options.
+func (c *Client) handleREPLCONF(cmd *rp.Command) error {
+	if strings.EqualFold(string(cmd.Get(1)), "ACK") {
+		offset, err := strconv.ParseUint(string(cmd.Get(2)), 10, 64)
+		if err == nil && c.replica != nil {
+			c.qMan.repl.ack(c.replica, offset)
+		}
+		return nil
+	}
+	return c.redisWriter.WriteSimpleString("OK")
+}
+
+// handleREPLICAOF handles "REPLICAOF host port", which replicates the primary
+// at host:port, and "REPLICAOF NO ONE", which promotes a replica.
+func (c *Client) handleREPLICAOF(cmd *rp.Command) error {
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'replicaof' command")
+	}
+	if c.qMan.raft != nil {
+		return c.redisWriter.WriteError(CommandNotInRaftMode.Error())
+	}
+	host, port := string(cmd.Get(1)), string(cmd.Get(2))
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		c.qMan.ReplicaOf("")
+		return c.redisWriter.WriteSimpleString("OK")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return c.redisWriter.WriteError("Invalid master port")
+	}
+	c.qMan.ReplicaOf(net.JoinHostPort(host, port))
+	return c.redisWriter.WriteSimpleString("OK")
+}
+
+// handlePEERAUTH handles "PEERAUTH secret" from another raft or cluster node,
+// the connection may send the commands between nodes once secret matches the
+// peer_secret.
+func (c *Client) handlePEERAUTH(cmd *rp.Command) error {
+	if cmd.ArgCount() != 2 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'peerauth' command")
+	}
+	secret := c.qMan.conf.PeerSecret
+	if secret == "" || subtle.ConstantTimeCompare(cmd.Get(1), []byte(secret)) != 1 {
+		c.peer = false
+		return c.redisWriter.WriteError("WRONGPASS invalid peer secret")
+	}
+	c.peer = true
+	return c.redisWriter.WriteBulks([]byte("OK"))
+}
+
+// handleRAFTVOTE handles "RAFTVOTE term candidate lastIndex lastTerm" from a
+// raft candidate.
+func (c *Client) handleRAFTVOTE(cmd *rp.Command) error {
+	if c.qMan.raft == nil {
+		return c.redisWriter.WriteError(RaftModeOff.Error())
+	}
+	if cmd.ArgCount() != 5 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'raftvote' command")
+	}
+	term, granted := c.qMan.raft.handleVote(parseUint(cmd.Get(1)), string(cmd.Get(2)), parseUint(cmd.Get(3)), parseUint(cmd.Get(4)))
+	return c.redisWriter.WriteBulks(uintArg(term), boolArg(granted))
+}
+
+// handleRAFTAPPEND handles "RAFTAPPEND term leader prevIndex prevTerm commit
+// [entryTerm entry]..." from the raft leader.
+func (c *Client) handleRAFTAPPEND(cmd *rp.Command) error {
+	if c.qMan.raft == nil {
+		return c.redisWriter.WriteError(RaftModeOff.Error())
+	}
+	if cmd.ArgCount() < 6 || cmd.ArgCount()%2 != 0 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'raftappend' command")
+	}
+	entries := make([]raftEntry, 0, (cmd.ArgCount()-6)/2)
+	for i := 6; i < cmd.ArgCount(); i += 2 {
+		// the parser reuses its buffer for the next command
+		entries = append(entries, raftEntry{term: parseUint(cmd.Get(i)), data: append([]byte{}, cmd.Get(i+1)...)})
+	}
+	term, ok, last := c.qMan.raft.handleAppend(parseUint(cmd.Get(1)), string(cmd.Get(2)), parseUint(cmd.Get(3)), parseUint(cmd.Get(4)), parseUint(cmd.Get(5)), entries)
+	return c.redisWriter.WriteBulks(uintArg(term), boolArg(ok), uintArg(last))
+}
+
+// handleRAFTINSTALL handles "RAFTINSTALL term leader index indexTerm" from
+// the raft leader, the queues are dropped and the REPLLOAD which follow fill
+// them until RAFTINSTALLED.
+func (c *Client) handleRAFTINSTALL(cmd *rp.Command) error {
+	if c.qMan.raft == nil {
+		return c.redisWriter.WriteError(RaftModeOff.Error())
+	}
+	if cmd.ArgCount() != 5 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'raftinstall' command")
+	}
+	if c.installing {
+		return c.redisWriter.WriteError("RAFTINSTALL not allowed in this context")
+	}
+	term, ok := c.qMan.raft.beginInstall(parseUint(cmd.Get(1)), string(cmd.Get(2)))
+	c.installing = ok
+	return c.redisWriter.WriteBulks(uintArg(term), boolArg(ok))
+}
+
+// handleREPLLOAD handles "REPLLOAD queue deadline data" of a RAFTINSTALL or
+// of a queue moved to this node, which has no reply.
+func (c *Client) handleREPLLOAD(cmd *rp.Command) error {
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'replload' command")
+	}
+	if !c.installing {
+		base, _ := splitLane(string(cmd.Get(1)))
+		if c.qMan.cluster == nil || !c.qMan.cluster.isImporting(queueSlot(base)) {
+			return c.redisWriter.WriteError("REPLLOAD not allowed in this context")
+		}
+		c.loading = base
+	}
+	deadline, err := strconv.ParseInt(string(cmd.Get(2)), 10, 64)
+	if err == nil {
+		err = c.qMan.applyOp(string(cmd.Get(1)), mqueue.Op{Kind: mqueue.OpPut, Data: cmd.Get(3), Deadline: deadline})
+	}
+	if err != nil {
+		// the leader sends the queues again
+		c.conn.Close()
+	}
+	return err
+}
+
+// handleRAFTINSTALLED handles "RAFTINSTALLED index indexTerm" which ends a
+// RAFTINSTALL.
+func (c *Client) handleRAFTINSTALLED(cmd *rp.Command) error {
+	if !c.installing {
+		return c.redisWriter.WriteError("RAFTINSTALLED not allowed in this context")
+	}
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'raftinstalled' command")
+	}
+	c.installing = false
+	term, err := c.qMan.raft.finishInstall(parseUint(cmd.Get(1)), parseUint(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteBulks(uintArg(term), boolArg(true))
+}
+
+// handleASKING handles ASKING, the next command runs on this node if it
+// imports the slot of the queue.
+func (c *Client) handleASKING(cmd *rp.Command) error {
+	if c.qMan.cluster == nil {
+		return c.redisWriter.WriteError(ClusterModeOff.Error())
+	}
+	c.asking = true
+	return c.redisWriter.WriteSimpleString("OK")
+}
+
+// handleSLOTSTATE handles "SLOTSTATE slot IMPORTING|NODE|CANCEL node" from a
+// node migrating slot.
+func (c *Client) handleSLOTSTATE(cmd *rp.Command) error {
+	if c.qMan.cluster == nil {
+		return c.redisWriter.WriteError(ClusterModeOff.Error())
+	}
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'slotstate' command")
+	}
+	slot, err := parseSlot(string(cmd.Get(1)))
+	if err == nil {
+		if strings.EqualFold(string(cmd.Get(2)), "CANCEL") {
+			err = c.qMan.CancelImport(slot, string(cmd.Get(3)))
+		} else {
+			err = c.qMan.SetSlot(slot, string(cmd.Get(2)), string(cmd.Get(3)))
+		}
+	}
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteBulks([]byte("OK"))
+}
+
+// handleSLOTLOADED handles "SLOTLOADED queue count" which ends the REPLLOAD of
+// a queue moved to this node, the queue is dropped unless it has count
+// messages.
+func (c *Client) handleSLOTLOADED(cmd *rp.Command) error {
+	if c.qMan.cluster == nil {
+		return c.redisWriter.WriteError(ClusterModeOff.Error())
+	}
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'slotloaded' command")
+	}
+	qName := string(cmd.Get(1))
+	if !c.qMan.cluster.isImporting(queueSlot(qName)) {
+		return c.redisWriter.WriteError("SLOTLOADED not allowed in this context")
+	}
+	count, err := strconv.Atoi(string(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError("value is not an integer or out of range")
+	}
+	c.loading = ""
+	if n := c.qMan.queueLength(qName); n != count {
+		c.qMan.Delete(qName)
+		return c.redisWriter.WriteError(fmt.Sprintf("loaded %d messages of %s instead of %d", n, qName, count))
+	}
+	c.qMan.cluster.loadedQueue(queueSlot(qName), qName)
+	return c.redisWriter.WriteBulks([]byte("OK"))
+}
+
+// handleRaftLPUSH handles LPUSH on the raft leader, the messages are pushed
+// once a majority of the nodes has them.
+func (c *Client) handleRaftLPUSH(cmd *rp.Command) error {
+	if cmd.ArgCount() < 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lpush' command")
+	}
+	qName := string(cmd.Get(1))
+	if !queueNamePattern.MatchString(qName) {
+		return c.redisWriter.WriteError(QueueNameNotValid.Error())
+	}
+	op := raftOp{kind: raftPush, queue: qName}
+	if ttl := c.qMan.conf.QueueConfig(qName).TTL; ttl > 0 {
+		op.at = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	}
+	for i := 2; i < cmd.ArgCount(); i++ {
+		op.data = append(op.data, cmd.Get(i))
+	}
+	if _, err := c.qMan.raft.propose(op); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	c.publishPushed(qName, op.data)
+	return c.redisWriter.WriteInt(int64(len(op.data)))
+}
+
+// handleRaftRPOP handles "RPOP key [count]" on the raft leader.
+func (c *Client) handleRaftRPOP(cmd *rp.Command) error {
+	op := raftOp{kind: raftPop, queue: string(cmd.Get(1)), at: time.Now().UnixNano(), count: 1}
+	if cmd.ArgCount() > 2 {
+		count, err := strconv.Atoi(string(cmd.Get(2)))
+		if err != nil || count < 0 {
+			return c.redisWriter.WriteError("value is out of range, must be positive")
+		}
+		op.count = count
+	}
+	res, err := c.qMan.raft.propose(op)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if cmd.ArgCount() > 2 {
+		if len(res.data) == 0 {
+			return c.redisWriter.WriteBulk(nil)
+		}
+		return c.redisWriter.WriteBulks(res.data...)
+	}
+	if len(res.data) == 0 {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	return c.redisWriter.WriteBulk(res.data[0])
+}
+
+// handleRaftDEL handles DEL on the raft leader.
+func (c *Client) handleRaftDEL(cmd *rp.Command) error {
+	if _, err := c.qMan.raft.propose(raftOp{kind: raftDel, queue: string(cmd.Get(1))}); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteBulkString("OK")
+}
+
+// handleRaftBRPOP handles "BRPOP key timeout" on the raft leader.
+func (c *Client) handleRaftBRPOP(cmd *rp.Command) error {
+	timeout, err := strconv.Atoi(string(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	op := raftOp{kind: raftPop, queue: string(cmd.Get(1)), count: 1}
+	res, err := c.raftWait(op, time.After(time.Second*time.Duration(timeout)))
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if len(res.data) == 0 {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	return c.redisWriter.WriteBulks(cmd.Get(1), res.data[0])
+}
+
+// handleRaftRPOPLPUSH handles "RPOPLPUSH source destination" on the raft
+// leader.
+func (c *Client) handleRaftRPOPLPUSH(cmd *rp.Command) error {
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'rpoplpush' command")
+	}
+	return c.raftMove(cmd, false, nil)
+}
+
+// handleRaftBRPOPLPUSH handles "BRPOPLPUSH source destination timeout" on the
+// raft leader, 0 waits until the server shuts down.
+func (c *Client) handleRaftBRPOPLPUSH(cmd *rp.Command) error {
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'brpoplpush' command")
+	}
+	timeout, err := strconv.Atoi(string(cmd.Get(3)))
+	if err != nil || timeout < 0 {
+		return c.redisWriter.WriteError("timeout is not an integer or out of range")
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(time.Duration(timeout) * time.Second)
+	}
+	return c.raftMove(cmd, true, expired)
+}
+
+// handleRaftLMOVE handles "LMOVE source destination RIGHT LEFT" on the raft
+// leader.
+func (c *Client) handleRaftLMOVE(cmd *rp.Command) error {
+	if cmd.ArgCount() != 5 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lmove' command")
+	}
+	if !strings.EqualFold(string(cmd.Get(3)), "RIGHT") || !strings.EqualFold(string(cmd.Get(4)), "LEFT") {
+		return c.redisWriter.WriteError("only LMOVE source destination RIGHT LEFT is supported")
+	}
+	return c.raftMove(cmd, false, nil)
+}
+
+// raftMove proposes to move the oldest message of the queue cmd.Get(1) to
+// cmd.Get(2), waiting for one until expired fires if wait is set.
+func (c *Client) raftMove(cmd *rp.Command, wait bool, expired <-chan time.Time) error {
+	dst := string(cmd.Get(2))
+	if !queueNamePattern.MatchString(dst) {
+		return c.redisWriter.WriteError(QueueNameNotValid.Error())
+	}
+	if err := c.qMan.checkPush(dst); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	op := raftOp{kind: raftMove, queue: string(cmd.Get(1)), at: time.Now().UnixNano(), data: [][]byte{[]byte(dst)}}
+	var res raftResult
+	var err error
+	if wait {
+		res, err = c.raftWait(op, expired)
+	} else {
+		res, err = c.qMan.raft.propose(op)
+	}
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if len(res.data) == 0 {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	return c.redisWriter.WriteBulk(res.data[0])
+}
+
+// raftWait proposes op, a pop or a move, whenever the queue it takes from
+// has messages, until it takes one or expired fires. A nil expired waits
+// until the server shuts down.
+func (c *Client) raftWait(op raftOp, expired <-chan time.Time) (raftResult, error) {
+	for {
+		changed := c.qMan.raft.changes()
+		if leader, _ := c.qMan.raft.isLeader(); !leader {
+			return raftResult{}, NoLeader
+		}
+		if c.qMan.queueLength(op.queue) > 0 {
+			op.at = time.Now().UnixNano()
+			res, err := c.qMan.raft.propose(op)
+			if err != nil || len(res.data) > 0 {
+				return res, err
+			}
+		}
+		select {
+		case <-changed:
+		case <-expired:
+			return raftResult{}, nil
+		case <-c.context.Done():
+			return raftResult{}, nil
+		}
+	}
+}
+
 func (c *Client) handleECHO(cmd *rp.Command) error {
 	if cmd.ArgCount() < 2 {
 		return c.redisWriter.WriteError("echo require 1 arg")
@@ -89,6 +721,45 @@ func (c *Client) handleECHO(cmd *rp.Command) error {
 func (c *Client) processCommand(cmd *rp.Command) (err error) {
 	atomic.AddUint64(&opCounter, 1)
 	action := strings.ToUpper(string(cmd.Get(0)))
+	if c.subscribed() {
+		err = c.processSubscribedCommand(action, cmd)
+		if cmd.IsLast() {
+			c.redisWriter.Flush()
+		}
+		return
+	}
+	if peerCommands[action] && !c.peer {
+		err = c.redisWriter.WriteError(PeerNotAuthenticated.Error())
+		if cmd.IsLast() {
+			c.redisWriter.Flush()
+		}
+		return
+	}
+	if writeCommands[action] && c.qMan.IsReplica() {
+		err = c.redisWriter.WriteError(ReadOnlyReplica.Error())
+		if cmd.IsLast() {
+			c.redisWriter.Flush()
+		}
+		return
+	}
+	if c.qMan.raft != nil {
+		var handled bool
+		if handled, err = c.raftCommand(action, cmd); handled {
+			if cmd.IsLast() {
+				c.redisWriter.Flush()
+			}
+			return
+		}
+	}
+	if c.qMan.cluster != nil {
+		var handled bool
+		if handled, err = c.clusterCommand(action, cmd); handled {
+			if cmd.IsLast() {
+				c.redisWriter.Flush()
+			}
+			return
+		}
+	}
 	switch action {
 	case "LPUSH":
 		err = c.handleLPUSH(cmd)
@@ -110,6 +781,98 @@ func (c *Client) processCommand(cmd *rp.Command) (err error) {
 		err = c.handleINFO(cmd)
 	case "ECHO":
 		err = c.handleECHO(cmd)
+	case "LINDEX":
+		err = c.handleLINDEX(cmd)
+	case "LRANGE":
+		err = c.handleLRANGE(cmd)
+	case "RESERVE":
+		err = c.handleRESERVE(cmd)
+	case "BRESERVE":
+		err = c.handleBRESERVE(cmd)
+	case "ACK":
+		err = c.handleACK(cmd)
+	case "NACK":
+		err = c.handleNACK(cmd)
+	case "DLQLIST":
+		err = c.handleDLQLIST(cmd)
+	case "DLQREPLAY":
+		err = c.handleDLQREPLAY(cmd)
+	case "DLQPURGE":
+		err = c.handleDLQPURGE(cmd)
+	case "XADD":
+		err = c.handleXADD(cmd)
+	case "XLEN":
+		err = c.handleXLEN(cmd)
+	case "XRANGE":
+		err = c.handleXRANGE(cmd)
+	case "XREAD":
+		err = c.handleXREAD(cmd)
+	case "XTRIM":
+		err = c.handleXTRIM(cmd)
+	case "XGROUP":
+		err = c.handleXGROUP(cmd)
+	case "XREADGROUP":
+		err = c.handleXREADGROUP(cmd)
+	case "XACK":
+		err = c.handleXACK(cmd)
+	case "SUBSCRIBE":
+		err = c.handleSUBSCRIBE(cmd, false)
+	case "PSUBSCRIBE":
+		err = c.handleSUBSCRIBE(cmd, true)
+	case "UNSUBSCRIBE":
+		err = c.handleUNSUBSCRIBE(cmd, false)
+	case "PUNSUBSCRIBE":
+		err = c.handleUNSUBSCRIBE(cmd, true)
+	case "PUBLISH":
+		err = c.handlePUBLISH(cmd)
+	case "RPOPLPUSH":
+		err = c.handleRPOPLPUSH(cmd)
+	case "BRPOPLPUSH":
+		err = c.handleBRPOPLPUSH(cmd)
+	case "LMOVE":
+		err = c.handleLMOVE(cmd)
+	case "PPUSH":
+		err = c.handlePPUSH(cmd)
+	case "LPUSHEX":
+		err = c.handleLPUSHEX(cmd)
+	case "LPUSHDELAY":
+		err = c.handleLPUSHDELAY(cmd)
+	case "LPUSHAT":
+		err = c.handleLPUSHAT(cmd)
+	case "BACKUP":
+		err = c.handleBACKUP(cmd)
+	case "BGSAVE":
+		err = c.handleBGSAVE(cmd)
+	case "EXPORT":
+		err = c.handleEXPORT(cmd)
+	case "IMPORT":
+		err = c.handleIMPORT(cmd)
+	case "PSYNC":
+		err = c.handlePSYNC(cmd)
+	case "REPLCONF":
+		err = c.handleREPLCONF(cmd)
+	case "REPLICAOF", "SLAVEOF":
+		err = c.handleREPLICAOF(cmd)
+	case "PEERAUTH":
+		err = c.handlePEERAUTH(cmd)
+	case "RAFTVOTE":
+		err = c.handleRAFTVOTE(cmd)
+	case "RAFTAPPEND":
+		err = c.handleRAFTAPPEND(cmd)
+	case "RAFTINSTALL":
+		err = c.handleRAFTINSTALL(cmd)
+	case "REPLLOAD":
+		err = c.handleREPLLOAD(cmd)
+	case "RAFTINSTALLED":
+		err = c.handleRAFTINSTALLED(cmd)
+	case "CLUSTER":
+		err = c.handleCLUSTER(cmd)
+	case "ASKING":
+		err = c.handleASKING(cmd)
+	case "SLOTSTATE":
+		err = c.handleSLOTSTATE(cmd)
+	case "SLOTLOADED":
+		err = c.handleSLOTLOADED(cmd)
 	default:
 		err = c.redisWriter.WriteError("Unsupported command")
 	}
@@ -137,37 +900,30 @@ func (c *Client) handleLLEN(cmd *rp.Command) error {
 	lf := log.Fields{
 		"func": "handleLLEN",
 	}
-	qName := string(cmd.Get(1))
-	q, err := c.qMan.GetOrCreate(qName)
+	lanes, _, err := c.lanes(string(cmd.Get(1)), lf)
 	if err != nil {
-		if err == QueueNameNotValid {
-			lf["client"] = c.conn.RemoteAddr().String()
-			lf["queuename"] = qName
-			log.WithFields(lf).WithError(err).Error("aborted")
-		}
-		c.redisWriter.WriteError(err.Error())
 		return err
 	}
-	return c.redisWriter.WriteInt(int64(q.Len()))
+	var n uint64
+	for _, l := range lanes {
+		n += l.q.Len()
+	}
+	return c.redisWriter.WriteInt(int64(n))
 }
 
 func (c *Client) handleRPOP(cmd *rp.Command) error {
-	qName := string(cmd.Get(1))
-	q, err := c.qMan.GetOrCreate(qName)
 	lf := log.Fields{
 		"func": "handleRPOP",
 	}
+	lanes, _, err := c.lanes(string(cmd.Get(1)), lf)
 	if err != nil {
-		c.redisWriter.WriteError(err.Error())
-		if err == QueueNameNotValid {
-			lf["client"] = c.conn.RemoteAddr().String()
-			lf["queuename"] = qName
-			log.WithFields(lf).WithError(err).Error("aborted")
-		}
 		return err
 	}
 
-	n, err := q.Get(c.buffer)
+	if cmd.ArgCount() > 2 {
+		return c.rpopCount(lanes, cmd, lf)
+	}
+	data, err := c.popLanes(lanes)
 	if err != nil {
 		if err == mqueue.ErrEmpty {
 			return c.redisWriter.WriteBulk(nil)
@@ -176,7 +932,71 @@ func (c *Client) handleRPOP(cmd *rp.Command) error {
 		log.WithFields(lf).WithError(err).Error("Unexpected error")
 		return c.redisWriter.WriteError(err.Error())
 	}
-	return c.redisWriter.WriteBulk(c.buffer[:n])
+	return c.redisWriter.WriteBulk(data)
+}
+
+// rpopCount handles "RPOP key count", popping up to count messages at once,
+// from the highest priority lane down.
+func (c *Client) rpopCount(lanes []lane, cmd *rp.Command, lf log.Fields) error {
+	count, err := strconv.Atoi(string(cmd.Get(2)))
+	if err != nil || count < 0 {
+		return c.redisWriter.WriteError("value is out of range, must be positive")
+	}
+	var items [][]byte
+	for _, l := range lanes {
+		if len(items) >= count {
+			break
+		}
+		batch, err := l.q.GetBatch(count - len(items))
+		if err == mqueue.ErrEmpty {
+			continue
+		}
+		if err != nil {
+			log.WithFields(lf).WithError(err).Error("Unexpected error")
+			return c.redisWriter.WriteError(err.Error())
+		}
+		items = append(items, batch...)
+	}
+	if len(items) == 0 {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	return c.redisWriter.WriteBulks(items...)
+}
+
+// pop consumes the oldest message of q into the client buffer, the buffer
+// keeps the size of the largest message popped so far.
+func (c *Client) pop(q *mqueue.CompositeQueue) ([]byte, error) {
+	data, err := q.Pop(c.buffer)
+	if cap(data) > cap(c.buffer) {
+		c.buffer = data[:cap(data)]
+	}
+	return data, err
+}
+
+// popLanes pops from the highest priority lane which has a message.
+func (c *Client) popLanes(lanes []lane) ([]byte, error) {
+	for _, l := range lanes {
+		data, err := c.pop(l.q)
+		if err != mqueue.ErrEmpty {
+			return data, err
+		}
+	}
+	return nil, mqueue.ErrEmpty
+}
+
+// lanes returns the lanes of the queue qName, writing the error reply if it
+// can not be opened.
+func (c *Client) lanes(qName string, lf log.Fields) ([]lane, <-chan struct{}, error) {
+	lanes, added, err := c.qMan.Lanes(qName)
+	if err != nil {
+		if err == QueueNameNotValid {
+			lf["client"] = c.conn.RemoteAddr().String()
+			lf["queuename"] = qName
+			log.WithFields(lf).WithError(err).Error("aborted")
+		}
+		c.redisWriter.WriteError(err.Error())
+	}
+	return lanes, added, err
 }
 
 func (c *Client) handleBRPOP(cmd *rp.Command) error {
@@ -190,39 +1010,129 @@ func (c *Client) handleBRPOP(cmd *rp.Command) error {
 		return c.redisWriter.WriteError(err.Error())
 	}
 
-	q, err := c.qMan.GetOrCreate(qName)
+	expired := time.After(time.Second * time.Duration(timeout))
+	for {
+		lanes, added, err := c.lanes(qName, lf)
+		if err != nil {
+			return err
+		}
+		data, err := c.popLanes(lanes)
+		if err == nil {
+			return c.redisWriter.WriteBulks(cmd.Get(1), data)
+		}
+		if err != mqueue.ErrEmpty {
+			log.WithFields(lf).WithError(err).Error("Unexpected error")
+			return c.redisWriter.WriteError(err.Error())
+		}
+		// wait on every lane, and look again if a lane is added meanwhile
+		cases := make([]reflect.SelectCase, 0, len(lanes)+2)
+		for _, l := range lanes {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(l.q.Chan())})
+		}
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(added)},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(expired)})
+		chosen, value, _ := reflect.Select(cases)
+		switch chosen {
+		case len(lanes):
+			continue
+		case len(lanes) + 1:
+			return c.redisWriter.WriteBulk(nil)
+		}
+		return c.redisWriter.WriteBulks(cmd.Get(1), value.Bytes())
+	}
+}
+
+// handlePPUSH pushes a message with a priority from 0, the default of LPUSH,
+// to maxPriority. RPOP and BRPOP return the messages of the highest priority
+// first.
+func (c *Client) handlePPUSH(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handlePPUSH",
+	}
+	if cmd.ArgCount() < 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'ppush' command")
+	}
+	qName := string(cmd.Get(1))
+	priority, err := strconv.Atoi(string(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError(PriorityNotInRange.Error())
+	}
+	q, err := c.qMan.Lane(qName, priority)
 	if err != nil {
-		c.redisWriter.WriteError(err.Error())
 		if err == QueueNameNotValid {
 			lf["client"] = c.conn.RemoteAddr().String()
 			lf["queuename"] = qName
 			log.WithFields(lf).WithError(err).Error("aborted")
 		}
-		return err
+		return c.redisWriter.WriteError(err.Error())
 	}
-
-	n, err := q.Get(c.buffer)
-	if err == nil {
-		return c.redisWriter.WriteBulks(cmd.Get(1), c.buffer[:n])
+	values := make([][]byte, 0, cmd.ArgCount()-3)
+	for i := 3; i < cmd.ArgCount(); i++ {
+		values = append(values, cmd.Get(i))
 	}
-	if err != mqueue.ErrEmpty {
-		log.WithFields(lf).WithError(err).Error("Unexpected error")
-		return c.redisWriter.WriteError(err.Error())
+	n, err := q.PutBatch(values)
+	c.publishPushed(qName, values[:n])
+	if err != nil {
+		return c.redisWriter.WriteError(fmt.Sprintf("%s, %d of %d pushed", err, n, len(values)))
 	}
-	select {
-	case data := <-q.Chan():
-		return c.redisWriter.WriteBulks(cmd.Get(1), data)
-	case <-time.After(time.Second * time.Duration(timeout)):
-		return c.redisWriter.WriteBulk(nil)
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// publishPushed publishes the messages pushed to the queue qName on the
+// channel of the same name, if the queue publishes on push.
+func (c *Client) publishPushed(qName string, values [][]byte) {
+	if !c.qMan.conf.QueueConfig(qName).PublishOnPush {
+		return
+	}
+	for _, v := range values {
+		c.qMan.pubsub.Publish(qName, v)
 	}
 }
 
 func (c *Client) handleLPUSH(cmd *rp.Command) error {
+	if cmd.ArgCount() < 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lpush' command")
+	}
 	qName := string(cmd.Get(1))
-	data := cmd.Get(2)
 	lf := log.Fields{
 		"func": "handleLPUSH",
 	}
+	if err := c.qMan.checkPush(qName); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	q, err := c.qMan.GetOrCreate(qName)
+	if err != nil {
+		if err == QueueNameNotValid {
+			lf["client"] = c.conn.RemoteAddr().String()
+			lf["queuename"] = qName
+			log.WithFields(lf).WithError(err).Error("aborted")
+		}
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if cmd.ArgCount() == 3 {
+		err = q.Put(cmd.Get(2))
+		if err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+		c.publishPushed(qName, [][]byte{cmd.Get(2)})
+		return c.redisWriter.WriteInt(1)
+	}
+	values := make([][]byte, 0, cmd.ArgCount()-2)
+	for i := 2; i < cmd.ArgCount(); i++ {
+		values = append(values, cmd.Get(i))
+	}
+	n, err := q.PutBatch(values)
+	c.publishPushed(qName, values[:n])
+	if err != nil {
+		return c.redisWriter.WriteError(fmt.Sprintf("%s, %d of %d pushed", err, n, len(values)))
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// queue returns the queue named qName, writing the error reply if it can not
+// be opened.
+func (c *Client) queue(qName string, lf log.Fields) (*mqueue.CompositeQueue, error) {
 	q, err := c.qMan.GetOrCreate(qName)
 	if err != nil {
 		if err == QueueNameNotValid {
@@ -230,12 +1140,1016 @@ func (c *Client) handleLPUSH(cmd *rp.Command) error {
 			lf["queuename"] = qName
 			log.WithFields(lf).WithError(err).Error("aborted")
 		}
+		c.redisWriter.WriteError(err.Error())
+	}
+	return q, err
+}
+
+// redisIndex converts an index of a redis list, where 0 is the head that
+// LPUSH writes to, into an index of CompositeQueue, where 0 is the oldest
+// message that RPOP reads.
+func redisIndex(i int64) int64 {
+	return -i - 1
+}
+
+func (c *Client) handleLINDEX(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleLINDEX",
+	}
+	index, err := strconv.ParseInt(string(cmd.Get(2)), 10, 64)
+	if err != nil {
 		return c.redisWriter.WriteError(err.Error())
 	}
-	err = q.Put(data)
+	lanes, _, err := c.lanes(string(cmd.Get(1)), lf)
 	if err != nil {
+		return err
+	}
+	q, i, ok := laneIndex(lanes, redisIndex(index))
+	if !ok {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	data, err := q.Index(i)
+	if err == mqueue.ErrEmpty {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
 		return c.redisWriter.WriteError(err.Error())
 	}
-	err = c.redisWriter.WriteInt(1)
-	return err
+	return c.redisWriter.WriteBulk(data)
+}
+
+func (c *Client) handleLRANGE(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleLRANGE",
+	}
+	start, err := strconv.ParseInt(string(cmd.Get(2)), 10, 64)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	stop, err := strconv.ParseInt(string(cmd.Get(3)), 10, 64)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	lanes, _, err := c.lanes(string(cmd.Get(1)), lf)
+	if err != nil {
+		return err
+	}
+	// the head of the redis list is the message consumed last, walk backward
+	items, err := rangeLanes(lanes, redisIndex(stop), redisIndex(start))
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return c.redisWriter.WriteBulks(items...)
+}
+
+// reserve consumes the oldest message of the highest priority lane which has
+// one like popLanes, and keeps it in flight until this client acknowledges
+// it. The id is the one formatLaneID returns.
+func (c *Client) reserve(lanes []lane) ([]byte, []byte, error) {
+	for _, l := range lanes {
+		id, data, err := l.q.Reserve(c.buffer)
+		if cap(data) > cap(c.buffer) {
+			c.buffer = data[:cap(data)]
+		}
+		if err == mqueue.ErrEmpty {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		c.reserved[reservation{l.q, id}] = struct{}{}
+		return formatLaneID(l.priority, id), data, nil
+	}
+	return nil, nil, mqueue.ErrEmpty
+}
+
+func (c *Client) handleRESERVE(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleRESERVE",
+	}
+	lanes, _, err := c.lanes(string(cmd.Get(1)), lf)
+	if err != nil {
+		return err
+	}
+	id, data, err := c.reserve(lanes)
+	if err != nil {
+		if err == mqueue.ErrEmpty {
+			return c.redisWriter.WriteBulk(nil)
+		}
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteBulks(id, data)
+}
+
+func (c *Client) handleBRESERVE(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleBRESERVE",
+	}
+	qName := string(cmd.Get(1))
+	timeout, err := strconv.Atoi(string(cmd.Get(2)))
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	expired := time.After(time.Second * time.Duration(timeout))
+	for {
+		lanes, added, err := c.lanes(qName, lf)
+		if err != nil {
+			return err
+		}
+		id, data, err := c.reserve(lanes)
+		if err == nil {
+			return c.redisWriter.WriteBulks(cmd.Get(1), id, data)
+		}
+		if err != mqueue.ErrEmpty {
+			log.WithFields(lf).WithError(err).Error("Unexpected error")
+			return c.redisWriter.WriteError(err.Error())
+		}
+		// wait on every lane like BRPOP, the message is tracked by its lane
+		cases := make([]reflect.SelectCase, 0, len(lanes)+2)
+		for _, l := range lanes {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(l.q.Chan())})
+		}
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(added)},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(expired)})
+		chosen, value, _ := reflect.Select(cases)
+		switch chosen {
+		case len(lanes):
+			continue
+		case len(lanes) + 1:
+			return c.redisWriter.WriteBulk(nil)
+		}
+		l := lanes[chosen]
+		n, err := l.q.Track(value.Bytes())
+		if err != nil {
+			log.WithFields(lf).WithError(err).Error("Unexpected error")
+			return c.redisWriter.WriteError(err.Error())
+		}
+		c.reserved[reservation{l.q, n}] = struct{}{}
+		return c.redisWriter.WriteBulks(cmd.Get(1), formatLaneID(l.priority, n), value.Bytes())
+	}
+}
+
+// reservedLane returns the lane of qName holding the reservation with the
+// client id and the id of the reservation in it, nil if there is no such
+// lane. The error is the reply to send.
+func (c *Client) reservedLane(qName, clientID string, lf log.Fields) (*mqueue.CompositeQueue, uint64, error) {
+	priority, id, err := parseLaneID(clientID)
+	if err != nil {
+		return nil, 0, errors.New("invalid message id")
+	}
+	q, err := c.qMan.ExistingLane(qName, priority)
+	if err == QueueNameNotValid {
+		lf["client"] = c.conn.RemoteAddr().String()
+		lf["queuename"] = qName
+		log.WithFields(lf).WithError(err).Error("aborted")
+	}
+	return q, id, err
+}
+
+func (c *Client) handleACK(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleACK",
+	}
+	q, id, err := c.reservedLane(string(cmd.Get(1)), string(cmd.Get(2)), lf)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if q == nil {
+		return c.redisWriter.WriteInt(0)
+	}
+	delete(c.reserved, reservation{q, id})
+	ok, err := q.Ack(id)
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if ok {
+		return c.redisWriter.WriteInt(1)
+	}
+	return c.redisWriter.WriteInt(0)
+}
+
+// handleNACK handles "NACK key id [reason]", the message is delivered again
+// or, after max_deliveries deliveries, moved to the dead letter queue.
+func (c *Client) handleNACK(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleNACK",
+	}
+	qName := string(cmd.Get(1))
+	q, id, err := c.reservedLane(qName, string(cmd.Get(2)), lf)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if q == nil {
+		return c.redisWriter.WriteInt(0)
+	}
+	delete(c.reserved, reservation{q, id})
+	ok, err := q.Nack(id, string(cmd.Get(3)))
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	c.qMan.RouteDead(qName, q)
+	if ok {
+		return c.redisWriter.WriteInt(1)
+	}
+	return c.redisWriter.WriteInt(0)
+}
+
+// countArg returns the optional count argument at index i, def if missing.
+func countArg(cmd *rp.Command, i int, def int) (int, bool) {
+	if cmd.ArgCount() <= i {
+		return def, true
+	}
+	count, err := strconv.Atoi(string(cmd.Get(i)))
+	return count, err == nil && count > 0
+}
+
+// handleDLQLIST handles "DLQLIST key [count]", it replies with the queue,
+// deliveries, last failure reason and message of the oldest dead letters.
+func (c *Client) handleDLQLIST(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleDLQLIST",
+	}
+	count, ok := countArg(cmd, 2, 100)
+	if !ok {
+		return c.redisWriter.WriteError("value is out of range, must be positive")
+	}
+	q, err := c.queue(string(cmd.Get(1)), lf)
+	if err != nil {
+		return err
+	}
+	items, err := q.Range(0, int64(count)-1)
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	letters := make([]interface{}, len(items))
+	for i, data := range items {
+		// messages pushed by hand are listed without details
+		letter, err := decodeDeadLetter(data)
+		if err != nil {
+			letters[i] = []interface{}{nil, 0, nil, data}
+			continue
+		}
+		letters[i] = []interface{}{letter.queue, letter.Deliveries, letter.Reason, letter.Data}
+	}
+	return c.redisWriter.WriteObjectsSlice(letters)
+}
+
+// handleDLQREPLAY handles "DLQREPLAY key [count]", it moves the oldest dead
+// letters, all of them by default, back to their queue.
+func (c *Client) handleDLQREPLAY(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleDLQREPLAY",
+	}
+	count, ok := countArg(cmd, 2, math.MaxInt32)
+	if !ok {
+		return c.redisWriter.WriteError("value is out of range, must be positive")
+	}
+	n, err := c.qMan.ReplayDead(string(cmd.Get(1)), count)
+	if err != nil {
+		log.WithFields(lf).WithError(err).Errorf("stopped after %d messages", n)
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+func (c *Client) handleDLQPURGE(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleDLQPURGE",
+	}
+	n, err := c.qMan.PurgeDead(string(cmd.Get(1)))
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("Unexpected error")
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// queuePair returns the lanes of the source and the destination queue of a
+// move command, and the channel Lanes returns for the source.
+func (c *Client) queuePair(cmd *rp.Command, lf log.Fields) (src []lane, added <-chan struct{}, dst *mqueue.CompositeQueue, err error) {
+	if src, added, err = c.lanes(string(cmd.Get(1)), lf); err != nil {
+		return
+	}
+	if err = c.qMan.checkPush(string(cmd.Get(2))); err != nil {
+		c.redisWriter.WriteError(err.Error())
+		return
+	}
+	dst, err = c.queue(string(cmd.Get(2)), lf)
+	return
+}
+
+// writeMoved replies to a move command with the moved message, or nil if the
+// source was empty.
+func (c *Client) writeMoved(data []byte, err error, lf log.Fields) error {
+	if err == mqueue.ErrEmpty {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	if err != nil {
+		if err != mqueue.ErrQueueFull {
+			log.WithFields(lf).WithError(err).Error("Unexpected error")
+		}
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteBulk(data)
+}
+
+func (c *Client) handleRPOPLPUSH(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleRPOPLPUSH",
+	}
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'rpoplpush' command")
+	}
+	src, _, dst, err := c.queuePair(cmd, lf)
+	if err != nil {
+		return err
+	}
+	data, err := mqueue.MoveFirst(laneQueues(src), dst)
+	return c.writeMoved(data, err, lf)
+}
+
+// handleBRPOPLPUSH waits up to timeout seconds for a message, 0 waits until
+// the server shuts down.
+func (c *Client) handleBRPOPLPUSH(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleBRPOPLPUSH",
+	}
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'brpoplpush' command")
+	}
+	timeout, err := strconv.Atoi(string(cmd.Get(3)))
+	if err != nil || timeout < 0 {
+		return c.redisWriter.WriteError("timeout is not an integer or out of range")
+	}
+	ctx := c.context
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	for {
+		src, added, dst, err := c.queuePair(cmd, lf)
+		if err != nil {
+			return err
+		}
+		// wait on the lanes there are, and look again once a lane is added
+		laneCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-added:
+				cancel()
+			case <-laneCtx.Done():
+			}
+		}()
+		data, err := mqueue.WaitMoveFirst(laneCtx, laneQueues(src), dst)
+		cancel()
+		if err == mqueue.ErrEmpty && ctx.Err() == nil {
+			select {
+			case <-added:
+				continue
+			default:
+			}
+		}
+		return c.writeMoved(data, err, lf)
+	}
+}
+
+// handleLMOVE moves from the consuming end of the source to the producing
+// end of the destination, the only direction a queue supports.
+func (c *Client) handleLMOVE(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleLMOVE",
+	}
+	if cmd.ArgCount() != 5 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lmove' command")
+	}
+	if !strings.EqualFold(string(cmd.Get(3)), "RIGHT") || !strings.EqualFold(string(cmd.Get(4)), "LEFT") {
+		return c.redisWriter.WriteError("only LMOVE source destination RIGHT LEFT is supported")
+	}
+	src, _, dst, err := c.queuePair(cmd, lf)
+	if err != nil {
+		return err
+	}
+	data, err := mqueue.MoveFirst(laneQueues(src), dst)
+	return c.writeMoved(data, err, lf)
+}
+
+// handleLPUSHDELAY pushes a message which becomes visible after a number of
+// seconds, fractions of a second are allowed.
+func (c *Client) handleLPUSHDELAY(cmd *rp.Command) error {
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lpushdelay' command")
+	}
+	seconds, err := strconv.ParseFloat(string(cmd.Get(2)), 64)
+	if err != nil || seconds < 0 {
+		return c.redisWriter.WriteError("delay is not a number or out of range")
+	}
+	return c.pushAt(cmd, time.Now().Add(time.Duration(seconds*float64(time.Second))), log.Fields{
+		"func": "handleLPUSHDELAY",
+	})
+}
+
+// handleLPUSHAT pushes a message which becomes visible at a unix timestamp
+// in seconds.
+func (c *Client) handleLPUSHAT(cmd *rp.Command) error {
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lpushat' command")
+	}
+	timestamp, err := strconv.ParseInt(string(cmd.Get(2)), 10, 64)
+	if err != nil {
+		return c.redisWriter.WriteError("timestamp is not an integer")
+	}
+	return c.pushAt(cmd, time.Unix(timestamp, 0), log.Fields{
+		"func": "handleLPUSHAT",
+	})
+}
+
+func (c *Client) pushAt(cmd *rp.Command, at time.Time, lf log.Fields) error {
+	if err := c.qMan.checkPush(string(cmd.Get(1))); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	q, err := c.queue(string(cmd.Get(1)), lf)
+	if err != nil {
+		return err
+	}
+	if err = q.PutAt(cmd.Get(3), at); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteInt(1)
+}
+
+// handleLPUSHEX pushes a message which expires after a number of seconds,
+// fractions of a second are allowed. Expired messages are skipped by RPOP.
+func (c *Client) handleLPUSHEX(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleLPUSHEX",
+	}
+	if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'lpushex' command")
+	}
+	seconds, err := strconv.ParseFloat(string(cmd.Get(2)), 64)
+	if err != nil || seconds <= 0 {
+		return c.redisWriter.WriteError("ttl is not a number or out of range")
+	}
+	if err := c.qMan.checkPush(string(cmd.Get(1))); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	q, err := c.queue(string(cmd.Get(1)), lf)
+	if err != nil {
+		return err
+	}
+	if err = q.PutTTL(cmd.Get(3), time.Duration(seconds*float64(time.Second))); err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	return c.redisWriter.WriteInt(1)
+}
+
+// defaultReadCount is how many messages XREADGROUP and XREAD return without
+// COUNT, unlike redis which returns them all.
+const defaultReadCount = 100
+
+// writeStreamError replies with err, prefixed with the error code redis uses.
+func (c *Client) writeStreamError(err error, lf log.Fields) error {
+	switch err {
+	case mqueue.ErrNoGroup:
+		return c.redisWriter.WriteError("NOGROUP " + err.Error())
+	case mqueue.ErrGroupExists:
+		return c.redisWriter.WriteError("BUSYGROUP " + err.Error())
+	case mqueue.ErrNotRetained, mqueue.ErrDeleted, InvalidStreamID, StreamIDTooSmall, NotStream, NotStreamEntry:
+		return c.redisWriter.WriteError(err.Error())
+	}
+	log.WithFields(lf).WithError(err).Error("Unexpected error")
+	return c.redisWriter.WriteError(err.Error())
+}
+
+// readArgs are the options of XREAD and XREADGROUP.
+type readArgs struct {
+	count int
+	block int // milliseconds, -1 if the command does not block
+	noAck bool
+	keys  [][]byte
+	ids   []string
+}
+
+// parseReadArgs parses "[COUNT n] [BLOCK ms] [NOACK] STREAMS key [key ...]
+// id [id ...]" from the argument i on.
+func parseReadArgs(cmd *rp.Command, i int) (*readArgs, error) {
+	args := &readArgs{count: defaultReadCount, block: -1}
+	for ; i < cmd.ArgCount(); i++ {
+		var err error
+		switch strings.ToUpper(string(cmd.Get(i))) {
+		case "COUNT":
+			i++
+			if args.count, err = strconv.Atoi(string(cmd.Get(i))); err != nil || args.count <= 0 {
+				return nil, errors.New("value is not an integer or out of range")
+			}
+			continue
+		case "BLOCK":
+			i++
+			if args.block, err = strconv.Atoi(string(cmd.Get(i))); err != nil || args.block < 0 {
+				return nil, errors.New("timeout is not an integer or out of range")
+			}
+			continue
+		case "NOACK":
+			args.noAck = true
+			continue
+		case "STREAMS":
+		default:
+			return nil, errors.New("syntax error")
+		}
+		break
+	}
+	n := cmd.ArgCount() - i - 1
+	if n <= 0 || n%2 != 0 {
+		return nil, errors.New("Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	for j := 0; j < n/2; j++ {
+		args.keys = append(args.keys, cmd.Get(i+1+j))
+		args.ids = append(args.ids, string(cmd.Get(i+1+n/2+j)))
+	}
+	return args, nil
+}
+
+// blockContext returns the context of a command which blocks for ms
+// milliseconds, 0 meaning until the client goes away.
+func (c *Client) blockContext(ms int) (context.Context, context.CancelFunc) {
+	if ms > 0 {
+		return context.WithTimeout(c.context, time.Duration(ms)*time.Millisecond)
+	}
+	return context.WithCancel(c.context)
+}
+
+// parseMaxLen parses "MAXLEN [=|~] n" from the argument i on, and returns
+// the argument after it.
+func parseMaxLen(cmd *rp.Command, i int) (uint64, int, error) {
+	i++
+	if arg := string(cmd.Get(i)); arg == "=" || arg == "~" {
+		// the trimming is always exact
+		i++
+	}
+	n, err := strconv.ParseUint(string(cmd.Get(i)), 10, 64)
+	if err != nil {
+		return 0, i, errors.New("value is not an integer or out of range")
+	}
+	return n, i + 1, nil
+}
+
+// handleXADD handles "XADD key [MAXLEN [=|~] n] id field value [field
+// value ...]", the queue must be in stream mode.
+func (c *Client) handleXADD(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXADD",
+	}
+	i := 2
+	maxLen := uint64(math.MaxUint64)
+	if strings.ToUpper(string(cmd.Get(i))) == "MAXLEN" {
+		var err error
+		if maxLen, i, err = parseMaxLen(cmd, i); err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+	}
+	n := cmd.ArgCount() - i - 1
+	if n <= 0 || n%2 != 0 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'xadd' command")
+	}
+	fields := make([][]byte, n)
+	for j := range fields {
+		fields[j] = cmd.Get(i + 1 + j)
+	}
+	qName := string(cmd.Get(1))
+	q, err := c.queue(qName, lf)
+	if err != nil {
+		return err
+	}
+	id, err := c.qMan.stream(qName).add(q, string(cmd.Get(i)), fields)
+	if err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	if maxLen != math.MaxUint64 {
+		if _, err = q.Trim(maxLen); err != nil {
+			return c.writeStreamError(err, lf)
+		}
+	}
+	return c.redisWriter.WriteBulkString(id.String())
+}
+
+func (c *Client) handleXLEN(cmd *rp.Command) error {
+	// like Redis, a missing stream is empty
+	q := c.qMan.ExistingQueue(string(cmd.Get(1)))
+	if q == nil {
+		return c.redisWriter.WriteInt(0)
+	}
+	return c.redisWriter.WriteInt(int64(q.Len()))
+}
+
+// handleXRANGE handles "XRANGE key start end [COUNT n]".
+func (c *Client) handleXRANGE(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXRANGE",
+	}
+	count := math.MaxInt32
+	if cmd.ArgCount() == 6 && strings.ToUpper(string(cmd.Get(4))) == "COUNT" {
+		var err error
+		if count, err = strconv.Atoi(string(cmd.Get(5))); err != nil || count < 0 {
+			return c.redisWriter.WriteError("value is not an integer or out of range")
+		}
+	} else if cmd.ArgCount() != 4 {
+		return c.redisWriter.WriteError("syntax error")
+	}
+	start, err := parseRangeID(string(cmd.Get(2)), 0)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	end, err := parseRangeID(string(cmd.Get(3)), math.MaxUint64)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	qName := string(cmd.Get(1))
+	q := c.qMan.ExistingQueue(qName)
+	if q == nil {
+		return c.redisWriter.WriteObjectsSlice(nil)
+	}
+	s := c.qMan.stream(qName)
+	offset, err := s.offsetFrom(q, start)
+	if err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	var res []mqueue.Entry
+	for len(res) < count {
+		entries, err := q.ReadFrom(offset, defaultReadCount)
+		if err != nil {
+			return c.writeStreamError(err, lf)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, e := range entries {
+			if id, _ := s.decode(e); end.less(id) || len(res) == count {
+				return c.redisWriter.WriteObjectsSlice(s.reply(res))
+			}
+			res = append(res, e)
+		}
+		offset = entries[len(entries)-1].Offset + 1
+	}
+	return c.redisWriter.WriteObjectsSlice(s.reply(res))
+}
+
+// handleXREAD handles "XREAD [COUNT n] [BLOCK ms] STREAMS key [key ...] id
+// [id ...]", where id is $ to read only the entries added from now on.
+func (c *Client) handleXREAD(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXREAD",
+	}
+	args, err := parseReadArgs(cmd, 1)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	queues := make([]*mqueue.CompositeQueue, len(args.keys))
+	offsets := make([]uint64, len(args.keys))
+	for i, key := range args.keys {
+		if queues[i] = c.qMan.ExistingQueue(string(key)); queues[i] == nil {
+			if args.block < 0 {
+				// a missing stream has nothing to read
+				continue
+			}
+			// waiting needs the queue, which the XADD waited for creates anyway
+			if queues[i], err = c.queue(string(key), lf); err != nil {
+				return err
+			}
+		}
+		if args.ids[i] == "$" {
+			_, offsets[i], err = queues[i].Bounds()
+		} else {
+			var id streamID
+			if id, err = parseStreamID(args.ids[i], 0); err == nil {
+				offsets[i], err = c.qMan.stream(string(key)).offsetAfter(queues[i], id)
+			}
+		}
+		if err != nil {
+			return c.writeStreamError(err, lf)
+		}
+	}
+	res, err := c.readStreams(args, queues, offsets)
+	if err == nil && len(res) == 0 && args.block >= 0 {
+		ctx, cancel := c.blockContext(args.block)
+		defer cancel()
+		if c.waitAny(ctx, queues, offsets) {
+			res, err = c.readStreams(args, queues, offsets)
+		}
+	}
+	if err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	if len(res) == 0 {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	return c.redisWriter.WriteObjectsSlice(res)
+}
+
+// readStreams reads the queues from offsets and replies with the entries of
+// those which have some.
+func (c *Client) readStreams(args *readArgs, queues []*mqueue.CompositeQueue, offsets []uint64) ([]interface{}, error) {
+	var res []interface{}
+	for i, q := range queues {
+		if q == nil {
+			continue
+		}
+		entries, err := q.ReadFrom(offsets[i], args.count)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			s := c.qMan.stream(string(args.keys[i]))
+			res = append(res, []interface{}{args.keys[i], s.reply(entries)})
+		}
+	}
+	return res, nil
+}
+
+// waitAny waits until one of queues has a message at its offset, and
+// returns false if ctx is done first.
+func (c *Client) waitAny(ctx context.Context, queues []*mqueue.CompositeQueue, offsets []uint64) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan bool, len(queues))
+	for i, q := range queues {
+		go func(q *mqueue.CompositeQueue, offset uint64) {
+			results <- q.WaitFor(ctx, offset)
+		}(q, offsets[i])
+	}
+	found := false
+	for range queues {
+		if <-results && !found {
+			found = true
+			cancel()
+		}
+	}
+	return found
+}
+
+// handleXTRIM handles "XTRIM key MAXLEN [=|~] n" and replies with how many
+// entries were dropped.
+func (c *Client) handleXTRIM(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXTRIM",
+	}
+	if strings.ToUpper(string(cmd.Get(2))) != "MAXLEN" {
+		return c.redisWriter.WriteError("syntax error, only MAXLEN is supported")
+	}
+	maxLen, i, err := parseMaxLen(cmd, 2)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if i != cmd.ArgCount() {
+		return c.redisWriter.WriteError("syntax error")
+	}
+	q := c.qMan.ExistingQueue(string(cmd.Get(1)))
+	if q == nil {
+		return c.redisWriter.WriteInt(0)
+	}
+	n, err := q.Trim(maxLen)
+	if err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// handleXGROUP handles "XGROUP CREATE key group id [MKSTREAM]", where id is
+// $ to read only new entries, and "XGROUP DESTROY key group".
+func (c *Client) handleXGROUP(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXGROUP",
+	}
+	sub := strings.ToUpper(string(cmd.Get(1)))
+	if (sub != "CREATE" || cmd.ArgCount() < 5) && (sub != "DESTROY" || cmd.ArgCount() != 4) {
+		return c.redisWriter.WriteError("syntax error, only XGROUP CREATE and XGROUP DESTROY are supported")
+	}
+	qName := string(cmd.Get(2))
+	q, err := c.queue(qName, lf)
+	if err != nil {
+		return err
+	}
+	group := string(cmd.Get(3))
+	if sub == "DESTROY" {
+		ok, err := q.DestroyGroup(group)
+		if err != nil {
+			return c.writeStreamError(err, lf)
+		}
+		if ok {
+			return c.redisWriter.WriteInt(1)
+		}
+		return c.redisWriter.WriteInt(0)
+	}
+	offset := uint64(math.MaxUint64)
+	if id := string(cmd.Get(4)); id != "$" {
+		// the group reads the entries after id
+		var after streamID
+		if after, err = parseStreamID(id, 0); err == nil {
+			offset, err = c.qMan.stream(qName).offsetAfter(q, after)
+		}
+		if err != nil {
+			return c.writeStreamError(err, lf)
+		}
+	}
+	if err = q.CreateGroup(group, offset); err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	return c.redisWriter.WriteSimpleString("OK")
+}
+
+// handleXREADGROUP handles "XREADGROUP GROUP group consumer [COUNT n]
+// [BLOCK ms] [NOACK] STREAMS key id" for a single key. With id > it returns
+// new entries, otherwise the entries of the group pending after id. The
+// consumer name is not used, the entries are pending for the whole group.
+func (c *Client) handleXREADGROUP(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXREADGROUP",
+	}
+	if cmd.ArgCount() < 7 || strings.ToUpper(string(cmd.Get(1))) != "GROUP" {
+		return c.redisWriter.WriteError("wrong number of arguments for 'xreadgroup' command")
+	}
+	group := string(cmd.Get(2))
+	args, err := parseReadArgs(cmd, 4)
+	if err != nil {
+		return c.redisWriter.WriteError(err.Error())
+	}
+	if len(args.keys) != 1 {
+		return c.redisWriter.WriteError("syntax error, only one stream is supported")
+	}
+	key := args.keys[0]
+	q, err := c.queue(string(key), lf)
+	if err != nil {
+		return err
+	}
+	s := c.qMan.stream(string(key))
+	var entries []mqueue.Entry
+	if args.ids[0] != ">" {
+		var after streamID
+		var from uint64
+		if after, err = parseStreamID(args.ids[0], 0); err == nil {
+			if from, err = s.offsetAfter(q, after); err == nil {
+				entries, err = q.PendingGroup(group, from, args.count)
+			}
+		}
+	} else if args.block < 0 {
+		entries, err = q.ReadGroup(group, args.count, args.noAck)
+	} else {
+		ctx, cancel := c.blockContext(args.block)
+		defer cancel()
+		entries, err = q.WaitReadGroup(ctx, group, args.count, args.noAck)
+	}
+	if err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	if len(entries) == 0 && args.ids[0] == ">" {
+		return c.redisWriter.WriteBulk(nil)
+	}
+	return c.redisWriter.WriteObjects([]interface{}{key, s.reply(entries)})
+}
+
+// handleXACK handles "XACK key group id [id ...]" and replies with how many
+// entries were pending.
+func (c *Client) handleXACK(cmd *rp.Command) error {
+	lf := log.Fields{
+		"func": "handleXACK",
+	}
+	if cmd.ArgCount() < 4 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'xack' command")
+	}
+	ids := make([]streamID, 0, cmd.ArgCount()-3)
+	for i := 3; i < cmd.ArgCount(); i++ {
+		id, err := parseStreamID(string(cmd.Get(i)), 0)
+		if err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+		ids = append(ids, id)
+	}
+	qName := string(cmd.Get(1))
+	q, err := c.queue(qName, lf)
+	if err != nil {
+		return err
+	}
+	s := c.qMan.stream(qName)
+	offsets := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		offset, ok, err := s.offsetOf(q, id)
+		if err != nil {
+			return c.writeStreamError(err, lf)
+		}
+		if ok {
+			offsets = append(offsets, offset)
+		}
+	}
+	n, err := q.AckGroup(string(cmd.Get(2)), offsets...)
+	if err != nil {
+		return c.writeStreamError(err, lf)
+	}
+	return c.redisWriter.WriteInt(int64(n))
+}
+
+// subscribed tells whether the client is in subscriber mode, where only the
+// pub/sub commands are allowed.
+func (c *Client) subscribed() bool {
+	return c.sub != nil && len(c.sub.channels)+len(c.sub.patterns) > 0
+}
+
+func (c *Client) processSubscribedCommand(action string, cmd *rp.Command) error {
+	switch action {
+	case "SUBSCRIBE":
+		return c.handleSUBSCRIBE(cmd, false)
+	case "PSUBSCRIBE":
+		return c.handleSUBSCRIBE(cmd, true)
+	case "UNSUBSCRIBE":
+		return c.handleUNSUBSCRIBE(cmd, false)
+	case "PUNSUBSCRIBE":
+		return c.handleUNSUBSCRIBE(cmd, true)
+	case "PING":
+		return c.redisWriter.WriteObjects("pong", string(cmd.Get(1)))
+	case "QUIT":
+		return c.redisWriter.WriteSimpleString("OK")
+	}
+	return c.redisWriter.WriteError(fmt.Sprintf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(action)))
+}
+
+// handleSUBSCRIBE handles SUBSCRIBE and, if pattern is true, PSUBSCRIBE.
+// The client then stays in subscriber mode until it unsubscribes from all.
+func (c *Client) handleSUBSCRIBE(cmd *rp.Command, pattern bool) error {
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	if cmd.ArgCount() < 2 {
+		return c.redisWriter.WriteError("wrong number of arguments for '" + kind + "' command")
+	}
+	if c.sub == nil {
+		c.sub = newSubscriber()
+		go c.deliver(c.sub.out)
+	}
+	for i := 1; i < cmd.ArgCount(); i++ {
+		channel := string(cmd.Get(i))
+		n := c.qMan.pubsub.Subscribe(c.sub, channel, pattern)
+		if err := c.redisWriter.WriteObjects(kind, channel, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleUNSUBSCRIBE handles UNSUBSCRIBE and, if pattern is true,
+// PUNSUBSCRIBE. Without arguments, it unsubscribes from every channel or
+// pattern.
+func (c *Client) handleUNSUBSCRIBE(cmd *rp.Command, pattern bool) error {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+	var channels []string
+	for i := 1; i < cmd.ArgCount(); i++ {
+		channels = append(channels, string(cmd.Get(i)))
+	}
+	if len(channels) == 0 && c.sub != nil {
+		own := c.sub.channels
+		if pattern {
+			own = c.sub.patterns
+		}
+		for channel := range own {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) == 0 {
+		n := 0
+		if c.sub != nil {
+			n = len(c.sub.channels) + len(c.sub.patterns)
+		}
+		return c.redisWriter.WriteObjects(kind, nil, n)
+	}
+	for _, channel := range channels {
+		n := 0
+		if c.sub != nil {
+			n = c.qMan.pubsub.Unsubscribe(c.sub, channel, pattern)
+		}
+		if err := c.redisWriter.WriteObjects(kind, channel, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePUBLISH handles "PUBLISH channel message" and replies with how many
+// subscribers received the message.
+func (c *Client) handlePUBLISH(cmd *rp.Command) error {
+	if cmd.ArgCount() != 3 {
+		return c.redisWriter.WriteError("wrong number of arguments for 'publish' command")
+	}
+	return c.redisWriter.WriteInt(int64(c.qMan.pubsub.Publish(string(cmd.Get(1)), cmd.Get(2))))
 }
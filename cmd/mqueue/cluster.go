@@ -0,0 +1,820 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	rp "github.com/secmask/go-redisproto"
+	"github.com/secmask/mqueue"
+)
+
+// In cluster mode the queues are spread over the nodes of cluster.nodes like
+// the keys of Redis Cluster: a queue hashes to one of the 16384 slots, see
+// keySlot, and each slot is owned by one node. A node answers the commands
+// naming a queue of a slot it does not own with MOVED to the owner, so that
+// cluster aware Redis clients, which learn the slots of the nodes from
+// CLUSTER SLOTS or CLUSTER SHARDS, send them to the right node. The lanes of
+// a queue hash like the queue; the expired_queue and dead_letter_queue of a
+// queue must share its hash tag, e.g. {jobs}-dead, to be on the same node.
+//
+// CLUSTER MIGRATE slot node moves a slot to node as a single step, commands
+// naming a queue of the slot wait meanwhile. It refuses to start while a
+// queue of the slot is in log mode or has reserved or delayed messages, which
+// only the source knows about. The source talks to the target over a
+// connection which starts with PEERAUTH peer_secret like those of raft:
+//
+//	SLOTSTATE slot IMPORTING source -> OK, sent to the target
+//	the source marks the slot migrating, then for every queue of the slot:
+//	REPLLOAD queue deadline data, without reply, for every message
+//	SLOTLOADED queue count -> OK, the target checks it has count messages
+//	SLOTSTATE slot NODE target -> OK, sent to the target then the other nodes
+//
+// If a step fails before the target owns the slot, the source puts the
+// queues back and marks the slot stable, and sends
+//
+//	SLOTSTATE slot CANCEL source -> OK, the target drops the queues it loaded
+//
+// CLUSTER SETSLOT slot MIGRATING and IMPORTING mark a slot by hand instead:
+// the source answers the commands naming a queue it does not have with ASK to
+// the target, which serves them after ASKING.
+//
+// Ownership changes are saved in data_dir/cluster.state, which replaces the
+// slots of the config once it exists. Nodes do not gossip: a node which
+// missed a change redirects to the former owner, which redirects again.
+
+var (
+	SlotNotServed  = errors.New("CLUSTERDOWN Hash slot not served")
+	CrossSlot      = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+	QueueMoving    = errors.New("TRYAGAIN queue is moving to another node")
+	ClusterModeOff = errors.New("This instance has cluster support disabled")
+	InvalidSlot    = errors.New("Invalid or out of range slot")
+)
+
+const (
+	clusterTimeout  = 5 * time.Second // of a call to another node
+	clusterPortStep = 10000           // from the client port to the cluster bus port CLUSTER NODES shows
+)
+
+// cluster is the slots of the nodes as this node knows them.
+type cluster struct {
+	lock      sync.Mutex
+	self      string
+	ids       []string              // every node, sorted
+	addrs     map[string]string     // host:port of every node by id
+	owner     [slotCount]string     // node owning the slot, empty if none
+	migrating map[int]string        // slots this node moves to another
+	importing map[int]string        // slots another node moves to this one
+	moving    map[int]chan struct{} // slots being migrated, closed once the migration ends
+	restoring map[string]bool       // queues put back after a failed move
+	loaded    map[int][]string      // queues loaded for the slots being imported
+	path      string
+
+	migrateLock sync.Mutex // held while a slot is migrated
+}
+
+// StartCluster makes the QueueMan a node of the cluster of its config.
+func (q *QueueMan) StartCluster() error {
+	conf := q.conf.Cluster
+	cl := &cluster{
+		self:      conf.ID,
+		addrs:     make(map[string]string),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+		moving:    make(map[int]chan struct{}),
+		restoring: make(map[string]bool),
+		loaded:    make(map[int][]string),
+		path:      path.Join(q.conf.DataDir, "cluster.state"),
+	}
+	for id, node := range conf.Nodes {
+		cl.ids = append(cl.ids, id)
+		cl.addrs[id] = node.Addr
+		ranges, err := parseSlotRanges(node.Slots)
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				cl.owner[slot] = id
+			}
+		}
+	}
+	sort.Strings(cl.ids)
+	if err := cl.load(); err != nil {
+		return err
+	}
+	q.cluster = cl
+	return nil
+}
+
+// parseSlotRanges parses slot ranges like 0-5460,6000.
+func parseSlotRanges(s string) ([][2]int, error) {
+	var res [][2]int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := parseSlot(bounds[0])
+		end := start
+		if err == nil && len(bounds) == 2 {
+			end, err = parseSlot(bounds[1])
+		}
+		if err != nil || end < start {
+			return nil, fmt.Errorf("bad slot range %q", part)
+		}
+		res = append(res, [2]int{start, end})
+	}
+	return res, nil
+}
+
+func parseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || slot < 0 || slot >= slotCount {
+		return 0, InvalidSlot
+	}
+	return slot, nil
+}
+
+// queueSlot returns the slot of the queue or lane qName, the lanes of a queue
+// hash like the queue.
+func queueSlot(qName string) int {
+	base, _ := splitLane(qName)
+	return keySlot([]byte(base))
+}
+
+func formatSlotRanges(ranges [][2]int) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.Itoa(r[0])
+		if r[1] != r[0] {
+			parts[i] += "-" + strconv.Itoa(r[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// load reads the slots saved by a former run, if any.
+func (cl *cluster) load() error {
+	b, err := ioutil.ReadFile(cl.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cl.owner = [slotCount]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, ok := cl.addrs[fields[0]]; !ok || len(fields) > 2 {
+			return fmt.Errorf("%s: bad line %q", cl.path, line)
+		}
+		if len(fields) == 1 {
+			continue
+		}
+		ranges, err := parseSlotRanges(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", cl.path, err)
+		}
+		for _, r := range ranges {
+			for slot := r[0]; slot <= r[1]; slot++ {
+				cl.owner[slot] = fields[0]
+			}
+		}
+	}
+	return nil
+}
+
+// save writes the slots of every node, the caller holds the lock.
+func (cl *cluster) save() error {
+	var b strings.Builder
+	for _, id := range cl.ids {
+		fmt.Fprintf(&b, "%s %s\n", id, formatSlotRanges(cl.ranges(id)))
+	}
+	tmpPath := cl.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, cl.path)
+}
+
+// ranges returns the slot ranges of the node id, the caller holds the lock.
+func (cl *cluster) ranges(id string) [][2]int {
+	var res [][2]int
+	for slot := 0; slot < slotCount; slot++ {
+		if cl.owner[slot] != id {
+			continue
+		}
+		if n := len(res); n > 0 && res[n-1][1] == slot-1 {
+			res[n-1][1] = slot
+		} else {
+			res = append(res, [2]int{slot, slot})
+		}
+	}
+	return res
+}
+
+// mayCreate tells whether the queue qName may be created on this node, the
+// caller holds the protector.
+func (cl *cluster) mayCreate(qName string) error {
+	base, _ := splitLane(qName)
+	slot := queueSlot(qName)
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if cl.restoring[base] || cl.importing[slot] != "" {
+		return nil
+	}
+	if cl.owner[slot] != cl.self {
+		return SlotNotServed
+	}
+	if _, ok := cl.moving[slot]; ok || cl.migrating[slot] != "" {
+		return QueueMoving
+	}
+	return nil
+}
+
+// isImporting tells whether another node moves slot to this one.
+func (cl *cluster) isImporting(slot int) bool {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.importing[slot] != ""
+}
+
+// hasQueue tells whether the queue qName or one of its lanes is on this node.
+func (q *QueueMan) hasQueue(qName string) bool {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	_, ok := q.queues[qName]
+	return ok || len(q.lanes[qName]) > 0
+}
+
+// queuesOf returns the queue qName and its lanes.
+func (q *QueueMan) queuesOf(qName string) []*mqueue.CompositeQueue {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	var res []*mqueue.CompositeQueue
+	if m, ok := q.queues[qName]; ok {
+		res = append(res, m)
+	}
+	for _, l := range q.lanes[qName] {
+		res = append(res, l.q)
+	}
+	return res
+}
+
+// queuesOfSlot returns the names of the queues of slot on this node, lanes
+// aside.
+func (q *QueueMan) queuesOfSlot(slot int) []string {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	var res []string
+	for name := range q.queues {
+		if keySlot([]byte(name)) == slot {
+			res = append(res, name)
+		}
+	}
+	for name := range q.lanes {
+		if _, ok := q.queues[name]; !ok && keySlot([]byte(name)) == slot {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// queueLength returns how many messages the queue qName and its lanes have.
+func (q *QueueMan) queueLength(qName string) int {
+	n := 0
+	for _, m := range q.queuesOf(qName) {
+		n += int(m.Len())
+	}
+	return n
+}
+
+// route tells where a command naming the queue qName runs: here if redirect
+// is empty, else the reply is redirect, MOVED or ASK, with the slot and addr.
+// Commands naming a queue of a slot which is migrated wait until it ends.
+func (q *QueueMan) route(qName string, asking bool) (redirect string, slot int, addr string, err error) {
+	cl := q.cluster
+	slot = queueSlot(qName)
+	for {
+		cl.lock.Lock()
+		owner := cl.owner[slot]
+		if owner != cl.self {
+			importing := cl.importing[slot] != ""
+			cl.lock.Unlock()
+			if asking && importing {
+				return "", slot, "", nil
+			}
+			if owner == "" {
+				return "", slot, "", SlotNotServed
+			}
+			return "MOVED", slot, cl.addrs[owner], nil
+		}
+		target := cl.migrating[slot]
+		moved, moving := cl.moving[slot]
+		cl.lock.Unlock()
+		if moving {
+			<-moved
+			continue
+		}
+		if target != "" && !q.hasQueue(qName) {
+			return "ASK", slot, cl.addrs[target], nil
+		}
+		return "", slot, "", nil
+	}
+}
+
+// SetSlot changes the state of slot like CLUSTER SETSLOT: IMPORTING from
+// node, MIGRATING to node, STABLE or owned by NODE.
+func (q *QueueMan) SetSlot(slot int, state, node string) error {
+	cl := q.cluster
+	if state == "NODE" && node != cl.self && len(q.queuesOfSlot(slot)) > 0 {
+		return fmt.Errorf("Can't assign hashslot %d to a different node while I still hold queues for this hash slot", slot)
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	if _, ok := cl.addrs[node]; !ok && state != "STABLE" {
+		return fmt.Errorf("I don't know about node %s", node)
+	}
+	switch state {
+	case "IMPORTING":
+		if cl.owner[slot] == cl.self {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		cl.importing[slot] = node
+	case "MIGRATING":
+		if cl.owner[slot] != cl.self {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		cl.migrating[slot] = node
+	case "STABLE":
+		delete(cl.importing, slot)
+		delete(cl.migrating, slot)
+		delete(cl.loaded, slot)
+	case "NODE":
+		delete(cl.importing, slot)
+		delete(cl.migrating, slot)
+		delete(cl.loaded, slot)
+		cl.owner[slot] = node
+		return cl.save()
+	default:
+		return errors.New("Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	return nil
+}
+
+// MigrateSlot moves slot and its queues to the node target, it returns how
+// many queues were moved. Either every queue moves and target owns the slot,
+// or the queues are put back, target drops what it got and the slot is
+// stable again.
+func (q *QueueMan) MigrateSlot(slot int, target string) (int, error) {
+	cl := q.cluster
+	cl.migrateLock.Lock()
+	defer cl.migrateLock.Unlock()
+	cl.lock.Lock()
+	addr, ok := cl.addrs[target]
+	owner, migrating := cl.owner[slot], cl.migrating[slot]
+	cl.lock.Unlock()
+	switch {
+	case !ok:
+		return 0, fmt.Errorf("I don't know about node %s", target)
+	case owner != cl.self:
+		return 0, fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	case target == cl.self:
+		return 0, fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	case migrating != "" && migrating != target:
+		return 0, fmt.Errorf("hash slot %d is migrating to %s", slot, migrating)
+	}
+	done := make(chan struct{})
+	cl.lock.Lock()
+	cl.moving[slot] = done
+	cl.lock.Unlock()
+	defer func() {
+		cl.lock.Lock()
+		delete(cl.moving, slot)
+		cl.lock.Unlock()
+		close(done)
+	}()
+	if err := q.checkMovable(slot); err != nil {
+		return 0, err
+	}
+	conn := &nodeConn{id: target, addr: addr, secret: q.conf.PeerSecret}
+	defer conn.close()
+	snaps := make(map[string]*mqueue.Snapshot)
+	defer func() {
+		for _, snap := range snaps {
+			snap.Close()
+		}
+	}()
+	err := setSlotOn(conn, slot, "IMPORTING", cl.self)
+	if err == nil {
+		err = q.SetSlot(slot, "MIGRATING", target)
+	}
+	for _, qName := range q.queuesOfSlot(slot) {
+		if err != nil {
+			break
+		}
+		var snap *mqueue.Snapshot
+		if snap, err = q.moveQueue(conn, qName); err != nil {
+			err = fmt.Errorf("queue %s: %v", qName, err)
+		} else if snap != nil {
+			snaps[qName] = snap
+		}
+	}
+	if err == nil {
+		err = setSlotOn(conn, slot, "NODE", target)
+	}
+	if err != nil {
+		q.revertSlot(slot, target, addr, snaps)
+		return 0, err
+	}
+	if err := q.SetSlot(slot, "NODE", target); err != nil {
+		// target owns the slot, only saving it failed
+		return len(snaps), err
+	}
+	for _, id := range cl.ids {
+		if id == cl.self || id == target {
+			continue
+		}
+		other := &nodeConn{id: id, addr: cl.addrs[id], secret: q.conf.PeerSecret}
+		if err := setSlotOn(other, slot, "NODE", target); err != nil {
+			// it redirects to this node, which redirects to the target
+			log.WithField("node", id).WithError(err).Warnf("failed to tell the new owner of slot %d", slot)
+		}
+		other.close()
+	}
+	return len(snaps), nil
+}
+
+// checkMovable fails naming the queues of slot which can not move: the logs
+// and the queues with reserved or delayed messages, which have to be
+// acknowledged or delivered first.
+func (q *QueueMan) checkMovable(slot int) error {
+	var blocking []string
+	for _, qName := range q.queuesOfSlot(slot) {
+		if q.conf.QueueConfig(qName).Retain() {
+			blocking = append(blocking, qName+" (log)")
+			continue
+		}
+		for _, m := range q.queuesOf(qName) {
+			if m.InFlight() > 0 || m.Delayed() > 0 {
+				blocking = append(blocking, qName+" (reserved or delayed messages)")
+				break
+			}
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("hash slot %d can not move, blocked by %s", slot, strings.Join(blocking, ", "))
+	}
+	return nil
+}
+
+// revertSlot undoes a failed migration of slot to target: target drops the
+// queues it loaded, the queues of snaps are put back and the slot is stable.
+func (q *QueueMan) revertSlot(slot int, target, addr string, snaps map[string]*mqueue.Snapshot) {
+	lf := log.Fields{"slot": slot, "node": target}
+	conn := &nodeConn{id: target, addr: addr, secret: q.conf.PeerSecret}
+	if err := setSlotOn(conn, slot, "CANCEL", q.cluster.self); err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to cancel the import, the node may keep a copy of the queues")
+	}
+	conn.close()
+	for qName, snap := range snaps {
+		if err := q.restoreQueue(qName, snap); err != nil {
+			log.WithFields(lf).WithField("queue", qName).WithError(err).Error("failed to put back a queue after a failed migration")
+		}
+	}
+	if err := q.SetSlot(slot, "STABLE", ""); err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to mark the slot stable")
+	}
+}
+
+// CancelImport undoes the import of slot from source after the migration
+// failed: the queues loaded for it are dropped and the slot is stable.
+func (q *QueueMan) CancelImport(slot int, source string) error {
+	cl := q.cluster
+	cl.lock.Lock()
+	if cl.importing[slot] != source {
+		cl.lock.Unlock()
+		return fmt.Errorf("hash slot %d is not imported from %s", slot, source)
+	}
+	loaded := cl.loaded[slot]
+	delete(cl.importing, slot)
+	delete(cl.loaded, slot)
+	cl.lock.Unlock()
+	for _, qName := range loaded {
+		if err := q.Delete(qName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadedQueue notes that the queue qName was loaded for slot, which is
+// imported.
+func (cl *cluster) loadedQueue(slot int, qName string) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	cl.loaded[slot] = append(cl.loaded[slot], qName)
+}
+
+// setSlotOn sends SLOTSTATE slot state node to conn.
+func setSlotOn(conn *nodeConn, slot int, state, node string) error {
+	_, err := conn.call(clusterTimeout, []byte("SLOTSTATE"), []byte(strconv.Itoa(slot)), []byte(state), []byte(node))
+	return err
+}
+
+// moveQueue moves the queue qName and its lanes through conn, and returns
+// the snapshot they were detached in, nil if there were none. The caller
+// closes it, or restores it if the slot does not move after all. If the move
+// fails the queue is put back as it was.
+func (q *QueueMan) moveQueue(conn *nodeConn, qName string) (*mqueue.Snapshot, error) {
+	queues := q.queuesOf(qName)
+	if len(queues) == 0 {
+		return nil, nil
+	}
+	snap, err := mqueue.Detach(queues)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	conn.lock.Lock()
+	err = snap.EachMessage(func(queue string, data []byte, deadline int64) error {
+		n++
+		return conn.send(clusterTimeout, []byte("REPLLOAD"), []byte(queue), []byte(strconv.FormatInt(deadline, 10)), data)
+	})
+	if err == nil {
+		err = conn.send(clusterTimeout, []byte("SLOTLOADED"), []byte(qName), []byte(strconv.Itoa(n)))
+	}
+	if err == nil {
+		_, err = conn.reply(clusterTimeout)
+	}
+	conn.lock.Unlock()
+	if err == nil {
+		err = q.Delete(qName)
+	}
+	if err != nil {
+		if rErr := q.restoreQueue(qName, snap); rErr != nil {
+			log.WithField("queue", qName).WithError(rErr).Error("failed to put back a queue after a failed move")
+		}
+		snap.Close()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// restoreQueue replaces the detached queue qName with the messages of snap.
+func (q *QueueMan) restoreQueue(qName string, snap *mqueue.Snapshot) error {
+	cl := q.cluster
+	cl.lock.Lock()
+	cl.restoring[qName] = true
+	cl.lock.Unlock()
+	defer func() {
+		cl.lock.Lock()
+		delete(cl.restoring, qName)
+		cl.lock.Unlock()
+	}()
+	if err := q.Delete(qName); err != nil {
+		return err
+	}
+	return snap.EachMessage(func(queue string, data []byte, deadline int64) error {
+		return q.applyOp(queue, mqueue.Op{Kind: mqueue.OpPut, Data: data, Deadline: deadline})
+	})
+}
+
+// commandKeys returns the queues a command names.
+func commandKeys(action string, cmd *rp.Command) [][]byte {
+	switch action {
+	case "RPOPLPUSH", "BRPOPLPUSH", "LMOVE":
+		if cmd.ArgCount() > 2 {
+			return [][]byte{cmd.Get(1), cmd.Get(2)}
+		}
+	case "XGROUP":
+		if cmd.ArgCount() > 2 {
+			return [][]byte{cmd.Get(2)}
+		}
+		return nil
+	case "XREAD", "XREADGROUP":
+		for i := 1; i < cmd.ArgCount(); i++ {
+			if strings.EqualFold(string(cmd.Get(i)), "STREAMS") {
+				var keys [][]byte
+				for j := i + 1; j < i+1+(cmd.ArgCount()-i-1)/2; j++ {
+					keys = append(keys, cmd.Get(j))
+				}
+				return keys
+			}
+		}
+		return nil
+	}
+	if cmd.ArgCount() > 1 {
+		return [][]byte{cmd.Get(1)}
+	}
+	return nil
+}
+
+// clusterCommand routes a command in cluster mode, it returns false if the
+// command runs as usual.
+func (c *Client) clusterCommand(action string, cmd *rp.Command) (bool, error) {
+	asking := c.asking
+	c.asking = false
+	if serverCommands[action] {
+		return false, nil
+	}
+	keys := commandKeys(action, cmd)
+	if len(keys) == 0 {
+		return false, nil
+	}
+	for _, key := range keys[1:] {
+		if queueSlot(string(key)) != queueSlot(string(keys[0])) {
+			return true, c.redisWriter.WriteError(CrossSlot.Error())
+		}
+	}
+	base, _ := splitLane(string(keys[0]))
+	redirect, slot, addr, err := c.qMan.route(base, asking)
+	if err != nil {
+		return true, c.redisWriter.WriteError(err.Error())
+	}
+	if redirect != "" {
+		return true, c.redisWriter.WriteError(fmt.Sprintf("%s %d %s", redirect, slot, addr))
+	}
+	return false, nil
+}
+
+// handleCLUSTER handles the CLUSTER subcommands: SLOTS, SHARDS, NODES, INFO,
+// MYID, KEYSLOT key, COUNTKEYSINSLOT slot, GETKEYSINSLOT slot count, SETSLOT
+// slot IMPORTING|MIGRATING|NODE node, SETSLOT slot STABLE and MIGRATE slot
+// node, which moves a slot to node and replies with how many queues moved.
+func (c *Client) handleCLUSTER(cmd *rp.Command) error {
+	sub := strings.ToUpper(string(cmd.Get(1)))
+	if sub == "KEYSLOT" {
+		if cmd.ArgCount() != 3 {
+			return c.redisWriter.WriteError("wrong number of arguments for 'cluster|keyslot' command")
+		}
+		return c.redisWriter.WriteInt(int64(keySlot(cmd.Get(2))))
+	}
+	cl := c.qMan.cluster
+	if cl == nil {
+		return c.redisWriter.WriteError(ClusterModeOff.Error())
+	}
+	switch sub {
+	case "SLOTS":
+		return c.redisWriter.WriteObjectsSlice(cl.slots())
+	case "SHARDS":
+		return c.redisWriter.WriteObjectsSlice(cl.shards())
+	case "NODES":
+		return c.redisWriter.WriteBulkString(cl.nodes())
+	case "INFO":
+		return c.redisWriter.WriteBulkString(cl.info())
+	case "MYID":
+		return c.redisWriter.WriteBulkString(cl.self)
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		slot, err := parseSlot(string(cmd.Get(2)))
+		if err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+		names := c.qMan.queuesOfSlot(slot)
+		if sub == "COUNTKEYSINSLOT" {
+			return c.redisWriter.WriteInt(int64(len(names)))
+		}
+		count, err := strconv.Atoi(string(cmd.Get(3)))
+		if err != nil || count < 0 {
+			return c.redisWriter.WriteError("Invalid number of keys")
+		}
+		if count < len(names) {
+			names = names[:count]
+		}
+		return c.redisWriter.WriteBulkStrings(names)
+	case "SETSLOT":
+		slot, err := parseSlot(string(cmd.Get(2)))
+		if err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+		if err = c.qMan.SetSlot(slot, strings.ToUpper(string(cmd.Get(3))), string(cmd.Get(4))); err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+		return c.redisWriter.WriteSimpleString("OK")
+	case "MIGRATE":
+		if cmd.ArgCount() != 4 {
+			return c.redisWriter.WriteError("wrong number of arguments for 'cluster|migrate' command")
+		}
+		slot, err := parseSlot(string(cmd.Get(2)))
+		if err != nil {
+			return c.redisWriter.WriteError(err.Error())
+		}
+		n, err := c.qMan.MigrateSlot(slot, string(cmd.Get(3)))
+		if err != nil {
+			return c.redisWriter.WriteError(fmt.Sprintf("%s, %d queues moved", err, n))
+		}
+		return c.redisWriter.WriteInt(int64(n))
+	}
+	return c.redisWriter.WriteError(fmt.Sprintf("unknown subcommand '%s'", cmd.Get(1)))
+}
+
+// hostPort splits the address of a node for the replies describing it.
+func hostPort(addr string) (string, int) {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// slots is the reply of CLUSTER SLOTS.
+func (cl *cluster) slots() []interface{} {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	res := []interface{}{}
+	for _, id := range cl.ids {
+		host, port := hostPort(cl.addrs[id])
+		for _, r := range cl.ranges(id) {
+			res = append(res, []interface{}{r[0], r[1], []interface{}{host, port, id}})
+		}
+	}
+	return res
+}
+
+// shards is the reply of CLUSTER SHARDS, a node is a shard of its own.
+func (cl *cluster) shards() []interface{} {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	res := []interface{}{}
+	for _, id := range cl.ids {
+		host, port := hostPort(cl.addrs[id])
+		slots := []interface{}{}
+		for _, r := range cl.ranges(id) {
+			slots = append(slots, r[0], r[1])
+		}
+		node := []interface{}{"id", id, "port", port, "ip", host, "endpoint", host,
+			"role", "master", "replication-offset", 0, "health", "online"}
+		res = append(res, []interface{}{"slots", slots, "nodes", []interface{}{node}})
+	}
+	return res
+}
+
+// nodes is the reply of CLUSTER NODES.
+func (cl *cluster) nodes() string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	var b strings.Builder
+	for _, id := range cl.ids {
+		host, port := hostPort(cl.addrs[id])
+		flags := "master"
+		if id == cl.self {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s:%d@%d %s - 0 0 0 connected", id, host, port, port+clusterPortStep, flags)
+		for _, r := range cl.ranges(id) {
+			b.WriteString(" " + strings.Replace(formatSlotRanges([][2]int{r}), ",", " ", -1))
+		}
+		if id == cl.self {
+			for _, slot := range sortedSlots(cl.migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, cl.migrating[slot])
+			}
+			for _, slot := range sortedSlots(cl.importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, cl.importing[slot])
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func sortedSlots(m map[int]string) []int {
+	res := make([]int, 0, len(m))
+	for slot := range m {
+		res = append(res, slot)
+	}
+	sort.Ints(res)
+	return res
+}
+
+// info is the reply of CLUSTER INFO.
+func (cl *cluster) info() string {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	assigned := 0
+	size := make(map[string]bool)
+	for _, owner := range cl.owner {
+		if owner != "" {
+			assigned++
+			size[owner] = true
+		}
+	}
+	state := "ok"
+	if assigned < slotCount {
+		state = "fail"
+	}
+	return fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\ncluster_my_id:%s\r\n",
+		state, assigned, assigned, len(cl.ids), len(size), cl.self)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// clusterNode serves a QueueMan of a test cluster.
+type clusterNode struct {
+	addr string
+	dir  string
+	qMan *QueueMan
+}
+
+// startCluster serves a node for every slot range of slots, named a, b...
+func startCluster(t *testing.T, dir string, slots ...string) ([]*clusterNode, func()) {
+	nodes := make([]*clusterNode, len(slots))
+	conf := make(map[string]ClusterNode)
+	for i, ranges := range slots {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = &clusterNode{addr: listener.Addr().String(), dir: path.Join(dir, string(rune('a'+i)))}
+		listener.Close()
+		if err = os.Mkdir(nodes[i].dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		conf[string(rune('a'+i))] = ClusterNode{Addr: nodes[i].addr, Slots: ranges}
+	}
+	var stops []func()
+	for i, n := range nodes {
+		n.qMan = NewQueueMan(&Config{DataDir: n.dir, FileBlockUnit: "4k", Cache: "1k", PeerSecret: "s3cret",
+			Cluster: ClusterConfig{ID: string(rune('a' + i)), Nodes: conf}})
+		if err := n.qMan.StartCluster(); err != nil {
+			t.Fatal(err)
+		}
+		var stop func()
+		n.addr, stop = serveQueueManAt(t, n.qMan, n.addr)
+		stops = append(stops, stop, n.qMan.CloseAll)
+	}
+	return nodes, func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodes, stop := startCluster(t, dir, "0-8191", "8192-16383")
+	defer stop()
+	a, b := nodes[0], nodes[1]
+
+	// a queue of a, in a slot which does not end its range
+	var qName string
+	for i := 0; qName == "" || keySlot([]byte(qName)) >= 8191; i++ {
+		qName = "jobs" + strconv.Itoa(i)
+	}
+	slot := keySlot([]byte(qName))
+	if reply := command(t, b.addr, "LPUSH", qName, "x"); reply != fmt.Sprintf("-MOVED %d %s\r\n", slot, a.addr) {
+		t.Fatalf("Expect a redirect to the owner, got %q", reply)
+	}
+	if reply := command(t, a.addr, "RPOPLPUSH", qName, "other"); !strings.HasPrefix(reply, "-CROSSSLOT") {
+		t.Fatalf("Expect a CROSSSLOT error, got %q", reply)
+	}
+	hostA, portA := hostPort(a.addr)
+	hostB, portB := hostPort(b.addr)
+	expected := fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n*3\r\n$%d\r\n%s\r\n:%d\r\n$1\r\na\r\n*3\r\n:8192\r\n:16383\r\n*3\r\n$%d\r\n%s\r\n:%d\r\n$1\r\nb\r\n",
+		len(hostA), hostA, portA, len(hostB), hostB, portB)
+	if reply := command(t, a.addr, "CLUSTER", "SLOTS"); reply != expected {
+		t.Fatalf("Unexpected CLUSTER SLOTS %q", reply)
+	}
+
+	m, err := a.qMan.GetOrCreate(qName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if err = m.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lane, err := a.qMan.Lane(qName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lane.Put([]byte("urgent")); err != nil {
+		t.Fatal(err)
+	}
+
+	// while the slot migrates, a serves the queues it has and sends the others
+	// to b
+	if reply := command(t, a.addr, "CLUSTER", "SETSLOT", strconv.Itoa(slot), "MIGRATING", "b"); reply != "+OK\r\n" {
+		t.Fatalf("Expect SETSLOT to succeed, got %q", reply)
+	}
+	tagged := "{" + qName + "}-new"
+	if reply := command(t, a.addr, "LPUSH", tagged, "x"); reply != fmt.Sprintf("-ASK %d %s\r\n", slot, b.addr) {
+		t.Fatalf("Expect an ASK redirect, got %q", reply)
+	}
+	if reply := command(t, a.addr, "LLEN", qName); reply != ":201\r\n" {
+		t.Fatalf("Expect the queue to be served, got %q", reply)
+	}
+	if reply := command(t, b.addr, "CLUSTER", "SETSLOT", strconv.Itoa(slot), "IMPORTING", "a"); reply != "+OK\r\n" {
+		t.Fatalf("Expect SETSLOT to succeed, got %q", reply)
+	}
+	conn, err := net.Dial("tcp", b.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if reply := roundTrip(t, conn, "LPUSH", tagged, "x"); !strings.HasPrefix(reply, "-MOVED") {
+		t.Fatalf("Expect a redirect without ASKING, got %q", reply)
+	}
+	roundTrip(t, conn, "ASKING")
+	if reply := roundTrip(t, conn, "LPUSH", tagged, "x"); reply != ":1\r\n" {
+		t.Fatalf("Expect LPUSH after ASKING to succeed, got %q", reply)
+	}
+
+	// the queue and its lanes move to b
+	if reply := command(t, a.addr, "CLUSTER", "MIGRATE", strconv.Itoa(slot), "b"); reply != ":1\r\n" {
+		t.Fatalf("Expect one queue moved, got %q", reply)
+	}
+	if queueLen(a.qMan, qName) != -1 || queueLen(a.qMan, qName+".p2") != -1 {
+		t.Fatal("Expect the queue to leave a")
+	}
+	if reply := command(t, b.addr, "RPOP", qName); reply != "$6\r\nurgent\r\n" {
+		t.Fatalf("Expect the lane to move, got %q", reply)
+	}
+	for i := 0; i < 200; i++ {
+		if reply := command(t, b.addr, "RPOP", qName); reply != fmt.Sprintf("$%d\r\n%d\r\n", len(strconv.Itoa(i)), i) {
+			t.Fatalf("Expect message %d, got %q", i, reply)
+		}
+	}
+	if reply := command(t, a.addr, "LPUSH", qName, "y"); reply != fmt.Sprintf("-MOVED %d %s\r\n", slot, b.addr) {
+		t.Fatalf("Expect a redirect to the new owner, got %q", reply)
+	}
+	if reply := command(t, b.addr, "LLEN", tagged); reply != ":1\r\n" {
+		t.Fatalf("Expect b to own the slot, got %q", reply)
+	}
+
+	// the new owner survives a restart
+	state, err := ioutil.ReadFile(path.Join(a.dir, "cluster.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(state), fmt.Sprintf("b %d,8192-16383\n", slot)) {
+		t.Fatalf("Unexpected cluster state %q", state)
+	}
+	restarted := NewQueueMan(a.qMan.conf)
+	defer restarted.CloseAll()
+	if err = restarted.StartCluster(); err != nil {
+		t.Fatal(err)
+	}
+	if redirect, _, addr, _ := restarted.route(qName, false); redirect != "MOVED" || addr != b.addr {
+		t.Fatalf("Expect the restarted node to redirect to b, got %s %s", redirect, addr)
+	}
+}
+
+func TestClusterMigrateRevert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodes, stop := startCluster(t, dir, "0-8191", "8192-16383")
+	defer stop()
+	a, b := nodes[0], nodes[1]
+
+	// two queues of a slot of a
+	var tag string
+	for i := 0; tag == "" || keySlot([]byte(tag)) >= 8192; i++ {
+		tag = "t" + strconv.Itoa(i)
+	}
+	slot := keySlot([]byte(tag))
+	first, second := "{"+tag+"}a", "{"+tag+"}b"
+	for qName, n := range map[string]int{first: 2, second: 3} {
+		m, err := a.qMan.GetOrCreate(qName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err = m.Put([]byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stable := func() {
+		t.Helper()
+		a.qMan.cluster.lock.Lock()
+		defer a.qMan.cluster.lock.Unlock()
+		b.qMan.cluster.lock.Lock()
+		defer b.qMan.cluster.lock.Unlock()
+		if a.qMan.cluster.owner[slot] != "a" || a.qMan.cluster.migrating[slot] != "" || b.qMan.cluster.importing[slot] != "" {
+			t.Fatalf("Expect slot %d to stay on a and stable", slot)
+		}
+	}
+
+	// b refuses a with another secret, nothing moves
+	a.qMan.conf.PeerSecret = "other"
+	reply := command(t, a.addr, "CLUSTER", "MIGRATE", strconv.Itoa(slot), "b")
+	if !strings.HasPrefix(reply, "-") || !strings.Contains(reply, "WRONGPASS") {
+		t.Fatalf("Expect b to refuse the migration, got %q", reply)
+	}
+	a.qMan.conf.PeerSecret = "s3cret"
+	stable()
+	if queueLen(a.qMan, first) != 2 || queueLen(a.qMan, second) != 3 {
+		t.Fatalf("Unexpected lengths %d and %d on a", queueLen(a.qMan, first), queueLen(a.qMan, second))
+	}
+
+	// a reserved message blocks the migration before anything moves
+	m, _ := a.qMan.GetOrCreate(first)
+	id, _, err := m.Reserve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = command(t, a.addr, "CLUSTER", "MIGRATE", strconv.Itoa(slot), "b")
+	if !strings.HasPrefix(reply, "-") || !strings.Contains(reply, first+" (reserved or delayed messages)") {
+		t.Fatalf("Expect the migration to name the blocking queue, got %q", reply)
+	}
+	stable()
+	if ok, err := m.Ack(id); !ok || err != nil {
+		t.Fatalf("Unexpected ack %t, %v", ok, err)
+	}
+
+	// b can not create the second queue, the first comes back to a
+	blocker := path.Join(b.dir, second+".mq")
+	if err = os.Mkdir(blocker, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if reply = command(t, a.addr, "CLUSTER", "MIGRATE", strconv.Itoa(slot), "b"); !strings.HasPrefix(reply, "-") {
+		t.Fatalf("Expect the migration to fail, got %q", reply)
+	}
+	stable()
+	if queueLen(a.qMan, first) != 1 || queueLen(a.qMan, second) != 3 {
+		t.Fatalf("Unexpected lengths %d and %d on a", queueLen(a.qMan, first), queueLen(a.qMan, second))
+	}
+	if queueLen(b.qMan, first) != -1 || queueLen(b.qMan, second) != -1 {
+		t.Fatal("Expect b to drop what it loaded")
+	}
+	if reply = command(t, a.addr, "RPOP", first); reply != "$1\r\n1\r\n" {
+		t.Fatalf("Expect a to serve the queue again, got %q", reply)
+	}
+
+	os.Remove(blocker)
+	if reply = command(t, a.addr, "CLUSTER", "MIGRATE", strconv.Itoa(slot), "b"); reply != ":2\r\n" {
+		t.Fatalf("Expect the queues to move, got %q", reply)
+	}
+	if queueLen(b.qMan, second) != 3 {
+		t.Fatalf("Unexpected length %d on b", queueLen(b.qMan, second))
+	}
+}
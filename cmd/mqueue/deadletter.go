@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/secmask/mqueue"
+)
+
+// deadLetterVersion is the first byte of the messages of dead letter queues.
+const deadLetterVersion = 1
+
+var NotDeadLetter = errors.New("message is not a dead letter")
+
+// deadLetter is a message of a dead letter queue: a message which failed
+// max_deliveries deliveries and the queue it comes from.
+type deadLetter struct {
+	queue string
+	mqueue.DeadLetter
+}
+
+// encode returns the message stored in the dead letter queue, the version,
+// the queue name and its 2 bytes length, the deliveries on 4 bytes, the
+// reason and its 2 bytes length, then the message itself.
+func (d *deadLetter) encode() []byte {
+	reason := d.Reason
+	if len(reason) > 0xffff {
+		reason = reason[:0xffff]
+	}
+	buff := make([]byte, 0, 9+len(d.queue)+len(reason)+len(d.Data))
+	buff = append(buff, deadLetterVersion)
+	buff = appendString(buff, d.queue)
+	buff = append(buff, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(buff[len(buff)-4:], uint32(d.Deliveries))
+	buff = appendString(buff, reason)
+	return append(buff, d.Data...)
+}
+
+func appendString(buff []byte, s string) []byte {
+	buff = append(buff, 0, 0)
+	binary.LittleEndian.PutUint16(buff[len(buff)-2:], uint16(len(s)))
+	return append(buff, s...)
+}
+
+// decodeDeadLetter parses a message of a dead letter queue, the returned
+// letter shares data.
+func decodeDeadLetter(data []byte) (*deadLetter, error) {
+	if len(data) < 1 || data[0] != deadLetterVersion {
+		return nil, NotDeadLetter
+	}
+	d := &deadLetter{}
+	queue, rest, ok := cutString(data[1:])
+	if !ok || len(rest) < 4 {
+		return nil, NotDeadLetter
+	}
+	d.queue = queue
+	d.Deliveries = int(binary.LittleEndian.Uint32(rest))
+	if d.Reason, rest, ok = cutString(rest[4:]); !ok {
+		return nil, NotDeadLetter
+	}
+	d.Data = rest
+	return d, nil
+}
+
+func cutString(buff []byte) (string, []byte, bool) {
+	if len(buff) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(buff)) + 2
+	if len(buff) < n {
+		return "", nil, false
+	}
+	return string(buff[2:n]), buff[n:], true
+}
+
+// RouteDead moves the dead messages of the queue qName to its dead letter
+// queue. The messages the dead letter queue refuses stay in m for the next
+// call.
+func (q *QueueMan) RouteDead(qName string, m *mqueue.CompositeQueue) {
+	if m.KeptDead() == 0 {
+		return
+	}
+	base, _ := splitLane(qName)
+	target := q.conf.QueueConfig(base).DeadLetterQueue
+	err := q.checkPush(target)
+	var dlq *mqueue.CompositeQueue
+	if err == nil {
+		dlq, err = q.GetOrCreate(target)
+	}
+	if err == nil {
+		_, err = m.MoveDead(dlq, func(d mqueue.DeadLetter) []byte {
+			return (&deadLetter{queue: base, DeadLetter: d}).encode()
+		})
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"func":  "QueueMan#RouteDead",
+			"queue": qName,
+		}).WithError(err).Errorf("kept dead messages, %s refused them", target)
+	}
+}
+
+// ReplayDead moves up to count messages of the dead letter queue dlqName
+// back to the queues they come from, and returns how many were moved. Each
+// letter leaves the dead letter queue as it enters its queue, the first one
+// which can not be moved stops the replay and stays in place.
+func (q *QueueMan) ReplayDead(dlqName string, count int) (int, error) {
+	dlq, err := q.GetOrCreate(dlqName)
+	if err != nil {
+		return 0, err
+	}
+	var buff []byte
+	n := 0
+	for n < count {
+		buff, err = dlq.Peek(buff)
+		if err == mqueue.ErrEmpty {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		letter, err := decodeDeadLetter(buff)
+		if err != nil {
+			return n, err
+		}
+		if err = q.checkPush(letter.queue); err != nil {
+			return n, err
+		}
+		m, err := q.GetOrCreate(letter.queue)
+		if err != nil {
+			return n, err
+		}
+		err = dlq.MoveFront(m, buff, letter.Data)
+		if err == mqueue.ErrChanged {
+			// another replay took the letter, look at the next one
+			continue
+		}
+		if err == mqueue.ErrEmpty {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// PurgeDead drops every message of the dead letter queue dlqName and returns
+// how many there were.
+func (q *QueueMan) PurgeDead(dlqName string) (int, error) {
+	dlq, err := q.GetOrCreate(dlqName)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		batch, err := dlq.GetBatch(1024)
+		if err == mqueue.ErrEmpty {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n += len(batch)
+	}
+}
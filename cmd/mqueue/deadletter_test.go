@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/secmask/mqueue"
+)
+
+func TestDeadLetterEncoding(t *testing.T) {
+	d := &deadLetter{queue: "jobs", DeadLetter: mqueue.DeadLetter{
+		Data:       []byte("payload"),
+		Deliveries: 3,
+		Reason:     "timeout",
+	}}
+	res, err := decodeDeadLetter(d.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.queue != "jobs" || res.Deliveries != 3 || res.Reason != "timeout" || string(res.Data) != "payload" {
+		t.Fatalf("Unexpected dead letter %+v", res)
+	}
+	for _, data := range []string{"", "payload", "\x01\x09\x00jobs"} {
+		if _, err = decodeDeadLetter([]byte(data)); err != NotDeadLetter {
+			t.Errorf("Expect NotDeadLetter for %q, got %v", data, err)
+		}
+	}
+}
+
+func TestQueueManDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	letters := QueueConfig{MaxDeliveries: 1, DeadLetterQueue: "dead", MaxLength: 1}
+	conf := &Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k", QueueDefaults: letters,
+		Queues: map[string]QueueConfig{"dead": {MaxLength: 1}}}
+	qMan := NewQueueMan(conf)
+	defer qMan.CloseAll()
+	q, err := qMan.GetOrCreate("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b"} {
+		if err = q.Put([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		id, _, err := q.Reserve(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := q.Nack(id, "failed"); !ok {
+			t.Fatal("Expect nack to succeed")
+		}
+		qMan.RouteDead("jobs", q)
+	}
+	dlq, err := qMan.GetOrCreate("dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the full dead letter queue refused b, it waits in jobs
+	if dlq.Len() != 1 || q.Len() != 0 || q.KeptDead() != 1 {
+		t.Fatalf("Unexpected dead letter queue len %d, queue len %d, kept %d", dlq.Len(), q.Len(), q.KeptDead())
+	}
+	if n, err := qMan.ReplayDead("dead", 1); n != 1 || err != nil {
+		t.Fatalf("Unexpected replay %d, %v", n, err)
+	}
+	qMan.RouteDead("jobs", q)
+	if dlq.Len() != 1 || q.KeptDead() != 0 {
+		t.Fatalf("Unexpected dead letter queue len %d, kept %d", dlq.Len(), q.KeptDead())
+	}
+	// the full queue refuses b, it stays in the dead letter queue
+	if n, err := qMan.ReplayDead("dead", 1); n != 0 || err != mqueue.ErrQueueFull || dlq.Len() != 1 {
+		t.Fatalf("Unexpected replay %d, %v, dead letter queue len %d", n, err, dlq.Len())
+	}
+	if data, err := q.Pop(nil); err != nil || string(data) != "a" {
+		t.Fatalf("Unexpected replayed message %q, %v", data, err)
+	}
+	if n, err := qMan.PurgeDead("dead"); n != 1 || err != nil {
+		t.Fatalf("Unexpected purge %d, %v", n, err)
+	}
+	if dlq.Len() != 0 || qMan.Dead() != 2 {
+		t.Fatalf("Unexpected dead letter queue len %d, dead %d", dlq.Len(), qMan.Dead())
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/secmask/mqueue"
+)
+
+// exportFormat is how the messages of a queue are written by EXPORT and
+// read by IMPORT.
+type exportFormat int
+
+const (
+	formatJSONL  exportFormat = iota // a JSON object per line, the payload in base64
+	formatBinary                     // a 4 bytes little endian length, then the payload
+)
+
+var (
+	UnknownExportFormat = errors.New("unknown export format, must be JSONL or BINARY")
+	ExportDirNotSet     = errors.New("export_dir is not set, use the export and import subcommands")
+)
+
+// importBatch is how many messages IMPORT puts at once.
+const importBatch = 1024
+
+func parseExportFormat(s string) (exportFormat, error) {
+	switch strings.ToUpper(s) {
+	case "", "JSONL":
+		return formatJSONL, nil
+	case "BINARY":
+		return formatBinary, nil
+	}
+	return formatJSONL, UnknownExportFormat
+}
+
+// exportRecord is a message in the JSONL format.
+type exportRecord struct {
+	Data     []byte `json:"data"`
+	Deadline int64  `json:"deadline,omitempty"` // expiry time in unix nanoseconds, the binary format has none
+	Priority int    `json:"priority,omitempty"` // the lane of the message, the binary format has none
+}
+
+// exportQueue writes the messages of lanes to w in format, in the order they
+// are consumed, and returns how many there were. The lanes are left as is.
+func exportQueue(lanes []lane, w io.Writer, format exportFormat) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var length [4]byte
+	n := 0
+	for _, l := range lanes {
+		err := l.q.Export(func(data []byte, deadline int64) error {
+			n++
+			if format == formatJSONL {
+				return enc.Encode(exportRecord{Data: data, Deadline: deadline, Priority: l.priority})
+			}
+			binary.LittleEndian.PutUint32(length[:], uint32(len(data)))
+			if _, err := bw.Write(length[:]); err != nil {
+				return err
+			}
+			_, err := bw.Write(data)
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// importQueue puts the messages read from r in format in the lanes of qName
+// they were exported from, in order, and returns how many were put. The
+// messages which expired meanwhile are skipped.
+func importQueue(qMan *QueueMan, qName string, r io.Reader, format exportFormat) (int, error) {
+	n := 0
+	q, err := qMan.Lane(qName, 0)
+	if err != nil {
+		return 0, err
+	}
+	priority := 0
+	batch := make([][]byte, 0, importBatch)
+	flush := func() error {
+		put, err := q.PutBatch(batch)
+		n += put
+		batch = batch[:0]
+		return err
+	}
+	err = readExport(r, format, func(rec exportRecord) error {
+		if rec.Priority != priority {
+			if err := flush(); err != nil {
+				return err
+			}
+			lane, err := qMan.Lane(qName, rec.Priority)
+			if err != nil {
+				return err
+			}
+			q, priority = lane, rec.Priority
+		}
+		if rec.Deadline == 0 {
+			batch = append(batch, rec.Data)
+			if len(batch) < importBatch {
+				return nil
+			}
+			return flush()
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		ttl := time.Until(time.Unix(0, rec.Deadline))
+		if ttl <= 0 {
+			return nil
+		}
+		if err := q.PutTTL(rec.Data, ttl); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return n, err
+}
+
+// readExport calls fn with every message read from r in format.
+func readExport(r io.Reader, format exportFormat, fn func(rec exportRecord) error) error {
+	br := bufio.NewReader(r)
+	if format == formatJSONL {
+		dec := json.NewDecoder(br)
+		for {
+			var rec exportRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(br, length[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rec := exportRecord{Data: make([]byte, binary.LittleEndian.Uint32(length[:]))}
+		if _, err := io.ReadFull(br, rec.Data); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// exportFile writes the messages of lanes to a new file at path.
+func exportFile(lanes []lane, path string, format exportFormat) (int, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := exportQueue(lanes, f, format)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return n, err
+}
+
+// importFile puts the messages of the file at path in the lanes of qName.
+func importFile(qMan *QueueMan, qName string, path string, format exportFormat) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return importQueue(qMan, qName, f, format)
+}
+
+// offlineQueue opens the data_dir of the config file, while no server has
+// it open. The queue qName must exist unless create is true.
+func offlineQueue(qName string, create bool) (*QueueMan, error) {
+	conf, err := ConfigFromFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	qMan := NewQueueMan(conf)
+	qMan.Load()
+	exists := false
+	for _, name := range qMan.Queues() {
+		exists = exists || name == qName
+	}
+	if !exists {
+		// a queue Load could not open, e.g. locked by a server, tells why
+		backFile := path.Join(conf.DataDir, qName+".mq")
+		files, _ := filepath.Glob(path.Join(conf.DataDir, qName+"*.mq"))
+		for _, f := range files {
+			exists = exists || mqueue.SegmentBase(f) == backFile
+		}
+		if exists || create {
+			_, err = qMan.GetOrCreate(qName)
+		} else {
+			err = fmt.Errorf("no queue %s in %s", qName, conf.DataDir)
+		}
+		if err != nil {
+			qMan.CloseAll()
+			return nil, err
+		}
+	}
+	return qMan, nil
+}
+
+// exportTool handles "export [-format jsonl|binary] [-o file] <queue>", it
+// writes the messages of a queue of data_dir to file, or to the output.
+func exportTool(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatName := fs.String("format", "jsonl", "jsonl or binary")
+	output := fs.String("o", "", "file to write, the output if not set")
+	qName, ok := toolFlags(fs, args, out)
+	if !ok {
+		return 2
+	}
+	format, err := parseExportFormat(*formatName)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+	qMan, err := offlineQueue(qName, false)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	defer qMan.CloseAll()
+	lanes, _, err := qMan.Lanes(qName)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if *output == "" {
+		if _, err = exportQueue(lanes, out, format); err != nil {
+			fmt.Fprintln(out, err)
+			return 1
+		}
+		return 0
+	}
+	n, err := exportFile(lanes, *output, format)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	fmt.Fprintf(out, "exported %d messages of %s to %s\n", n, qName, *output)
+	return 0
+}
+
+// importTool handles "import [-format jsonl|binary] <queue> <file>", it puts
+// the messages of file in a queue of data_dir, which is created if needed.
+func importTool(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	formatName := fs.String("format", "jsonl", "jsonl or binary")
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(out, toolUsage)
+		return 2
+	}
+	format, err := parseExportFormat(*formatName)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+	qName, path := fs.Arg(0), fs.Arg(1)
+	qMan, err := offlineQueue(qName, true)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	defer qMan.CloseAll()
+	n, err := importFile(qMan, qName, path, format)
+	fmt.Fprintf(out, "imported %d messages to %s\n", n, qName)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
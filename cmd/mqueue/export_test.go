@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	qMan := NewQueueMan(&Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k"})
+	defer qMan.CloseAll()
+	src, err := qMan.GetOrCreate("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < 200; i++ {
+		want = append(want, strconv.Itoa(i))
+		if err = src.Put([]byte(want[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = src.PutTTL([]byte("ttl"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "ttl")
+	for _, format := range []exportFormat{formatJSONL, formatBinary} {
+		buff := &bytes.Buffer{}
+		n, err := exportQueue([]lane{{priority: 0, q: src}}, buff, format)
+		if err != nil || n != len(want) {
+			t.Fatalf("Unexpected export %d, %v", n, err)
+		}
+		dstName := "dst" + strconv.Itoa(int(format))
+		if n, err = importQueue(qMan, dstName, buff, format); err != nil || n != len(want) {
+			t.Fatalf("Unexpected import %d, %v", n, err)
+		}
+		dst, _ := qMan.GetOrCreate(dstName)
+		items, err := dst.Range(0, -1)
+		if err != nil || len(items) != len(want) {
+			t.Fatalf("Unexpected range of %d, %v", len(items), err)
+		}
+		for i := range want {
+			if string(items[i]) != want[i] {
+				t.Fatalf("Unexpected message %q, want %s", items[i], want[i])
+			}
+		}
+	}
+	if src.Len() != uint64(len(want)) {
+		t.Fatalf("Export changed the queue, len %d", src.Len())
+	}
+
+	// expired messages are not imported
+	jsonl := `{"data":"YQ=="}` + "\n" + `{"data":"Yg==","deadline":1}` + "\n"
+	if n, err := importQueue(qMan, "expired", bytes.NewBufferString(jsonl), formatJSONL); err != nil || n != 1 {
+		t.Fatalf("Unexpected import %d, %v", n, err)
+	}
+	if _, err = parseExportFormat("xml"); err != UnknownExportFormat {
+		t.Fatalf("Expect UnknownExportFormat, got %v", err)
+	}
+}
+
+func TestExportDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k"}
+	qMan := NewQueueMan(conf)
+	defer qMan.CloseAll()
+	addr, stop := serveQueueMan(t, qMan)
+	command(t, addr, "LPUSH", "jobs", "a")
+	reply := command(t, addr, "EXPORT", "jobs", "jobs.jsonl")
+	stop()
+	if reply != "-"+ExportDirNotSet.Error()+"\r\n" {
+		t.Fatalf("Expect EXPORT to be refused without export_dir, got %q", reply)
+	}
+
+	// clients only name a file of export_dir
+	conf.ExportDir = path.Join(dir, "export")
+	if err = os.Mkdir(conf.ExportDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	addr, stop = serveQueueMan(t, qMan)
+	defer stop()
+	for _, name := range []string{"../jobs.jsonl", path.Join(dir, "jobs.jsonl"), "a/jobs.jsonl", ".."} {
+		if reply := command(t, addr, "EXPORT", "jobs", name); reply != "-"+FileNameNotValid.Error()+"\r\n" {
+			t.Fatalf("Expect FileNameNotValid for %s, got %q", name, reply)
+		}
+	}
+	if reply := command(t, addr, "EXPORT", "jobs", "jobs.jsonl"); reply != ":1\r\n" {
+		t.Fatalf("Unexpected EXPORT reply %q", reply)
+	}
+	if _, err = os.Stat(path.Join(conf.ExportDir, "jobs.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := command(t, addr, "IMPORT", "copy", "jobs.jsonl"); reply != ":1\r\n" {
+		t.Fatalf("Unexpected IMPORT reply %q", reply)
+	}
+}
@@ -11,11 +11,13 @@ import (
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/secmask/mqueue"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
 	configFile = flag.String("c", "config.yml", "config file")
+	restoreDir = flag.String("restore", "", "backup to copy into data_dir before the queues are loaded")
 	version    string
 )
 
@@ -37,6 +39,9 @@ func ctxWithDone(parent context.Context, done <-chan struct{}) *AppContext {
 
 func main() {
 	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(runTool(flag.Args(), os.Stdout))
+	}
 	config, err := ConfigFromFile(*configFile)
 	if err != nil {
 		log.WithError(err).Error("failed to load config file")
@@ -60,6 +65,13 @@ func main() {
 		}
 	}
 
+	if *restoreDir != "" {
+		if err = mqueue.Restore(*restoreDir, config.DataDir); err != nil {
+			log.WithError(err).Fatal("failed to restore backup")
+		}
+		log.Printf("restored backup %s to %s", *restoreDir, config.DataDir)
+	}
+
 	done := make(chan struct{})
 	appContext := ctxWithDone(context.Background(), done)
 
@@ -70,6 +82,19 @@ func main() {
 
 	qMan := NewQueueMan(config)
 	qMan.Load()
+	if config.ReplicaOf != "" {
+		qMan.ReplicaOf(config.ReplicaOf)
+	}
+	if config.Raft.ID != "" {
+		if err = qMan.StartRaft(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.Cluster.ID != "" {
+		if err = qMan.StartCluster(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	wg := &sync.WaitGroup{}
 	go func() {
 		for {
@@ -88,6 +113,7 @@ func main() {
 	signal.Notify(osSignal, syscall.SIGINT, syscall.SIGTERM)
 	for range osSignal {
 		close(done)
+		qMan.Interrupt()
 		log.Println("wait for clean close all client")
 		wg.Wait()
 		break
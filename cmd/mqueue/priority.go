@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/secmask/mqueue"
+)
+
+// maxPriority is the highest priority PPUSH accepts, 0 being the lowest.
+const maxPriority = 9
+
+var (
+	laneSuffix         = regexp.MustCompile(`^(.+)\.p([0-9]+)$`)
+	PriorityNotInRange = errors.New("priority is not an integer or out of range")
+)
+
+// lane is the queue holding the messages of one priority above 0 of a queue,
+// messages of priority 0 are in the queue itself.
+type lane struct {
+	priority int
+	q        *mqueue.CompositeQueue
+}
+
+// laneName returns the name of the lane of qName for priority, it is not a
+// valid queue name so lanes are not visible as queues of their own.
+func laneName(qName string, priority int) string {
+	return qName + ".p" + strconv.Itoa(priority)
+}
+
+// splitLane returns the queue and the priority of the lane name, or name
+// and 0 if name is not a lane.
+func splitLane(name string) (string, int) {
+	if m := laneSuffix.FindStringSubmatch(name); m != nil {
+		if priority, err := strconv.Atoi(m[2]); err == nil && priority > 0 && priority <= maxPriority {
+			return m[1], priority
+		}
+	}
+	return name, 0
+}
+
+// Lane returns the queue holding the messages of qName with priority,
+// creating it if needed.
+func (q *QueueMan) Lane(qName string, priority int) (*mqueue.CompositeQueue, error) {
+	if priority < 0 || priority > maxPriority {
+		return nil, PriorityNotInRange
+	}
+	if err := q.checkPush(qName); err != nil {
+		return nil, err
+	}
+	if priority > 0 && q.conf.QueueConfig(qName).Retain() {
+		// consumer groups only read the queue itself
+		return nil, mqueue.ErrRetained
+	}
+	base, err := q.GetOrCreate(qName)
+	if err != nil || priority == 0 {
+		return base, err
+	}
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	for _, l := range q.lanes[qName] {
+		if l.priority == priority {
+			return l.q, nil
+		}
+	}
+	name := laneName(qName, priority)
+	if q.cluster != nil {
+		if err := q.cluster.mayCreate(name); err != nil {
+			return nil, err
+		}
+	}
+	m, err := mqueue.OpenCompositionQueue(q.queueOption(name, path.Join(q.conf.DataDir, name+".mq")))
+	if err != nil {
+		return nil, err
+	}
+	if q.stopping {
+		m.Interrupt()
+	}
+	q.addLane(qName, priority, m)
+	return m, nil
+}
+
+// Lanes returns the queue qName and its lanes, highest priority first, and
+// a channel closed once a lane is added to qName. The queue itself is the
+// last lane, of priority 0.
+func (q *QueueMan) Lanes(qName string) ([]lane, <-chan struct{}, error) {
+	base, err := q.GetOrCreate(qName)
+	if err != nil {
+		return nil, nil, err
+	}
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	res := make([]lane, 0, len(q.lanes[qName])+1)
+	res = append(res, q.lanes[qName]...)
+	res = append(res, lane{priority: 0, q: base})
+	added, ok := q.laneAdded[qName]
+	if !ok {
+		added = make(chan struct{})
+		q.laneAdded[qName] = added
+	}
+	return res, added, nil
+}
+
+// laneQueues returns the queues of lanes, in the same order.
+func laneQueues(lanes []lane) []*mqueue.CompositeQueue {
+	res := make([]*mqueue.CompositeQueue, len(lanes))
+	for i, l := range lanes {
+		res[i] = l.q
+	}
+	return res
+}
+
+// ExistingLane returns the lane of qName for priority, nil if qName has no
+// such lane. Unlike Lane it never creates one.
+func (q *QueueMan) ExistingLane(qName string, priority int) (*mqueue.CompositeQueue, error) {
+	if priority == 0 {
+		return q.GetOrCreate(qName)
+	}
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	for _, l := range q.lanes[qName] {
+		if l.priority == priority {
+			return l.q, nil
+		}
+	}
+	return nil, nil
+}
+
+// formatLaneID returns the message id a client sees for the reservation id of
+// a lane of priority, ids of the queue itself are left as they are.
+func formatLaneID(priority int, id uint64) []byte {
+	res := strconv.FormatUint(id, 10)
+	if priority > 0 {
+		res = strconv.Itoa(priority) + "-" + res
+	}
+	return []byte(res)
+}
+
+// parseLaneID is the reverse of formatLaneID.
+func parseLaneID(s string) (int, uint64, error) {
+	priority := 0
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		p, err := strconv.Atoi(s[:i])
+		if err != nil || p <= 0 || p > maxPriority {
+			return 0, 0, PriorityNotInRange
+		}
+		priority, s = p, s[i+1:]
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	return priority, id, err
+}
+
+// laneIndex returns the lane holding the message at index i of lanes, taken
+// as a single list in consumption order, and the index of the message in it.
+// Negative indexes count from the end like those of CompositeQueue.Index.
+func laneIndex(lanes []lane, i int64) (*mqueue.CompositeQueue, int64, bool) {
+	lengths := make([]int64, len(lanes))
+	var n int64
+	for j, l := range lanes {
+		lengths[j] = int64(l.q.Len())
+		n += lengths[j]
+	}
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return nil, 0, false
+	}
+	for j, l := range lanes {
+		if i < lengths[j] {
+			return l.q, i, true
+		}
+		i -= lengths[j]
+	}
+	return nil, 0, false
+}
+
+// rangeLanes returns the messages of lanes, taken as a single list in
+// consumption order, from index start to stop like CompositeQueue.Range.
+func rangeLanes(lanes []lane, start, stop int64) ([][]byte, error) {
+	lengths := make([]int64, len(lanes))
+	var n int64
+	for j, l := range lanes {
+		lengths[j] = int64(l.q.Len())
+		n += lengths[j]
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	var items [][]byte
+	for j, l := range lanes {
+		// start and stop are indexes of the lane j from here
+		from, to := start, stop
+		if from < 0 {
+			from = 0
+		}
+		if to >= lengths[j] {
+			to = lengths[j] - 1
+		}
+		if from <= to {
+			batch, err := l.q.Range(from, to)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, batch...)
+		}
+		start -= lengths[j]
+		stop -= lengths[j]
+	}
+	return items, nil
+}
+
+// addLane registers m as the lane of qName for priority, the caller holds
+// the protector unless QueueMan is still loading.
+func (q *QueueMan) addLane(qName string, priority int, m *mqueue.CompositeQueue) {
+	lanes := append(q.lanes[qName], lane{priority: priority, q: m})
+	sort.Slice(lanes, func(i, j int) bool { return lanes[i].priority > lanes[j].priority })
+	q.lanes[qName] = lanes
+	if added, ok := q.laneAdded[qName]; ok {
+		close(added)
+		delete(q.laneAdded, qName)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestQueueManLanes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k"}
+	qMan := NewQueueMan(conf)
+	for _, priority := range []int{0, 5, 2} {
+		q, err := qMan.Lane("jobs", priority)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Put([]byte{byte(priority)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = qMan.Lane("jobs", maxPriority+1); err != PriorityNotInRange {
+		t.Fatalf("Expect PriorityNotInRange, got %v", err)
+	}
+	if queues := qMan.Queues(); len(queues) != 1 || queues[0] != "jobs" {
+		t.Fatalf("Expect lanes to be hidden, got %v", queues)
+	}
+	qMan.CloseAll()
+
+	// lanes are found again by their file names, highest priority first
+	qMan = NewQueueMan(conf)
+	qMan.Load()
+	defer qMan.CloseAll()
+	lanes, _, err := qMan.Lanes("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lanes) != 3 {
+		t.Fatalf("Expect 3 lanes, got %d", len(lanes))
+	}
+	for i, want := range []byte{5, 2, 0} {
+		data, err := lanes[i].q.Pop(nil)
+		if err != nil || len(data) != 1 || data[0] != want {
+			t.Fatalf("Unexpected message %v, %v in lane %d", data, err, i)
+		}
+	}
+	if err = qMan.Delete("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expect every lane to be deleted, %d files left", len(files))
+	}
+}
+
+func TestLaneCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	qMan := NewQueueMan(&Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k"})
+	defer qMan.CloseAll()
+	for _, m := range []struct {
+		priority int
+		data     string
+	}{{0, "a"}, {0, "b"}, {3, "c"}, {7, "d"}, {3, "e"}} {
+		q, err := qMan.Lane("jobs", m.priority)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Put([]byte(m.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lanes, _, err := qMan.Lanes("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lanes read as a single list in the order RPOP consumes them
+	items, err := rangeLanes(lanes, 0, -1)
+	if err != nil || len(items) != 5 {
+		t.Fatalf("Unexpected range of %d, %v", len(items), err)
+	}
+	for i, want := range []string{"d", "c", "e", "a", "b"} {
+		if string(items[i]) != want {
+			t.Fatalf("Unexpected message %q at %d, want %s", items[i], i, want)
+		}
+		q, j, ok := laneIndex(lanes, int64(i))
+		if !ok {
+			t.Fatalf("Expect index %d in the lanes", i)
+		}
+		if data, err := q.Index(j); err != nil || string(data) != want {
+			t.Fatalf("Unexpected message %q, %v at %d, want %s", data, err, i, want)
+		}
+	}
+	if items, _ = rangeLanes(lanes, 2, -2); len(items) != 2 || string(items[0]) != "e" || string(items[1]) != "a" {
+		t.Fatalf("Unexpected range %q", items)
+	}
+	if _, _, ok := laneIndex(lanes, 5); ok {
+		t.Fatal("Expect index 5 out of range")
+	}
+
+	// exports keep the lanes, imports bring the messages back in them
+	buff := &bytes.Buffer{}
+	if n, err := exportQueue(lanes, buff, formatJSONL); err != nil || n != 5 {
+		t.Fatalf("Unexpected export %d, %v", n, err)
+	}
+	if n, err := importQueue(qMan, "copy", buff, formatJSONL); err != nil || n != 5 {
+		t.Fatalf("Unexpected import %d, %v", n, err)
+	}
+	copied, _, err := qMan.Lanes("copy")
+	if err != nil || len(copied) != 3 {
+		t.Fatalf("Expect 3 lanes in the copy, got %d, %v", len(copied), err)
+	}
+	if items, _ = rangeLanes(copied, 0, -1); len(items) != 5 || string(items[0]) != "d" || string(items[4]) != "b" {
+		t.Fatalf("Unexpected copy %q", items)
+	}
+
+	for _, id := range []struct {
+		priority int
+		id       uint64
+		s        string
+	}{{0, 12, "12"}, {4, 7, "4-7"}} {
+		if s := string(formatLaneID(id.priority, id.id)); s != id.s {
+			t.Fatalf("Unexpected id %s, want %s", s, id.s)
+		}
+		if priority, n, err := parseLaneID(id.s); err != nil || priority != id.priority || n != id.id {
+			t.Fatalf("Unexpected lane %d, id %d, %v for %s", priority, n, err, id.s)
+		}
+	}
+	if _, _, err := parseLaneID("10-1"); err != PriorityNotInRange {
+		t.Fatalf("Expect PriorityNotInRange, got %v", err)
+	}
+}
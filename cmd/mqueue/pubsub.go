@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// subscriberBacklog is how many published messages wait for a slow
+// subscriber, the next ones are dropped.
+const subscriberBacklog = 1024
+
+// subscriber is the subscriptions of a client, and the messages published
+// to it which are not written yet.
+type subscriber struct {
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	out      chan []interface{}
+}
+
+func newSubscriber() *subscriber {
+	return &subscriber{
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		out:      make(chan []interface{}, subscriberBacklog),
+	}
+}
+
+// PubSub delivers the published messages to the subscribers of their channel
+// and of the patterns matching it.
+type PubSub struct {
+	lock     sync.Mutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+// Subscribe subscribes s to channel, or to the channels matching channel if
+// pattern is true, and returns how many subscriptions s has.
+func (p *PubSub) Subscribe(s *subscriber, channel string, pattern bool) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subs, own := p.channels, s.channels
+	if pattern {
+		subs, own = p.patterns, s.patterns
+	}
+	own[channel] = struct{}{}
+	if subs[channel] == nil {
+		subs[channel] = make(map[*subscriber]struct{})
+	}
+	subs[channel][s] = struct{}{}
+	return len(s.channels) + len(s.patterns)
+}
+
+// Unsubscribe removes the subscription of s to channel, or to the pattern
+// channel, and returns how many subscriptions s has left.
+func (p *PubSub) Unsubscribe(s *subscriber, channel string, pattern bool) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	subs, own := p.channels, s.channels
+	if pattern {
+		subs, own = p.patterns, s.patterns
+	}
+	delete(own, channel)
+	delete(subs[channel], s)
+	if len(subs[channel]) == 0 {
+		delete(subs, channel)
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// Publish sends msg to the subscribers of channel and returns how many
+// received it. A subscriber too slow to keep up misses it.
+func (p *PubSub) Publish(channel string, msg []byte) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := 0
+	for s := range p.channels[channel] {
+		if p.send(s, []interface{}{"message", channel, msg}) {
+			n++
+		}
+	}
+	for pattern, subs := range p.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for s := range subs {
+			if p.send(s, []interface{}{"pmessage", pattern, channel, msg}) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (p *PubSub) send(s *subscriber, msg []interface{}) bool {
+	select {
+	case s.out <- msg:
+		return true
+	default:
+		log.WithFields(log.Fields{
+			"func":    "PubSub#Publish",
+			"channel": msg[len(msg)-2],
+		}).Warn("dropped a message for a slow subscriber")
+		return false
+	}
+}
+
+// close removes every subscription of s and stops its delivery.
+func (p *PubSub) close(s *subscriber) {
+	for channel := range s.channels {
+		p.Unsubscribe(s, channel, false)
+	}
+	for pattern := range s.patterns {
+		p.Unsubscribe(s, pattern, true)
+	}
+	close(s.out)
+}
+
+// globMatch tells whether s matches the glob-style pattern the way redis
+// does: * and ? match any characters, [...] a set or a range of them, ^
+// negating it, and \ escapes the next character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			if pattern, ok = matchSet(pattern[1:], s[0]); !ok {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchSet matches c against the set at the start of pattern, after its [,
+// and returns the pattern from the closing ] on.
+func matchSet(pattern string, c byte) (string, bool) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			pattern = pattern[1:]
+			match = match || pattern[0] == c
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || lo <= c && c <= hi
+			pattern = pattern[2:]
+		default:
+			match = match || pattern[0] == c
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) == 0 {
+		// an unterminated set ends the pattern, like in redis
+		return pattern + "]", match != not
+	}
+	return pattern, match != not
+}
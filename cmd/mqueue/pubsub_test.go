@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"news.*", "news.tech", true},
+		{"news.*", "news", false},
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	}
+	for _, c := range cases {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Errorf("Expect globMatch(%q, %q) to be %v", c.pattern, c.s, c.match)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	p := NewPubSub()
+	a, b := newSubscriber(), newSubscriber()
+	if n := p.Subscribe(a, "news.tech", false); n != 1 {
+		t.Errorf("Unexpected subscriptions %d", n)
+	}
+	if n := p.Subscribe(a, "news.*", true); n != 2 {
+		t.Errorf("Unexpected subscriptions %d", n)
+	}
+	p.Subscribe(b, "news.*", true)
+	if n := p.Publish("news.tech", []byte("hello")); n != 3 {
+		t.Errorf("Expect 3 receivers, got %d", n)
+	}
+	if n := p.Publish("weather", []byte("rain")); n != 0 {
+		t.Errorf("Expect no receiver, got %d", n)
+	}
+	if msg := <-a.out; msg[0] != "message" || msg[1] != "news.tech" || string(msg[2].([]byte)) != "hello" {
+		t.Errorf("Unexpected message %v", msg)
+	}
+	if msg := <-b.out; msg[0] != "pmessage" || msg[1] != "news.*" || msg[2] != "news.tech" {
+		t.Errorf("Unexpected message %v", msg)
+	}
+	if n := p.Unsubscribe(a, "news.tech", false); n != 1 {
+		t.Errorf("Unexpected subscriptions %d", n)
+	}
+	p.close(b)
+	if n := p.Publish("news.tech", []byte("bye")); n != 1 {
+		t.Errorf("Expect 1 receiver, got %d", n)
+	}
+}
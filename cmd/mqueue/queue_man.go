@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/secmask/mqueue"
 
@@ -14,22 +15,264 @@ import (
 )
 
 var (
-	queueNamePattern  = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+	queueNamePattern  = regexp.MustCompile("^[a-zA-Z0-9_{}-]+$") // braces make hash tags, see keySlot
 	QueueNameNotValid = errors.New("queue name is not valid")
 )
 
 type QueueMan struct {
 	queues    map[string]*mqueue.CompositeQueue
+	lanes     map[string][]lane        // priority lanes of queues, highest priority first
+	laneAdded map[string]chan struct{} // closed when a lane is added to the queue
+	streams   map[string]*stream       // queues written by XADD
+	pubsub    *PubSub
+	backup    *backupState
+	repl      *replication
+	raft      *Raft    // nil unless in raft mode
+	cluster   *cluster // nil unless in cluster mode
 	protector sync.Locker
+	stopping  bool // set by Interrupt, new queues are interrupted too
 	conf      *Config
+	done      chan struct{}   // closed by CloseAll to stop background jobs
+	jobs      *sync.WaitGroup // background jobs of this QueueMan
 }
 
 func NewQueueMan(conf *Config) *QueueMan {
-	return &QueueMan{
+	q := &QueueMan{
 		queues:    make(map[string]*mqueue.CompositeQueue),
+		lanes:     make(map[string][]lane),
+		laneAdded: make(map[string]chan struct{}),
+		streams:   make(map[string]*stream),
+		pubsub:    NewPubSub(),
+		backup:    &backupState{},
+		repl:      newReplication(int(conf.ReplBacklog.ValueWithDefault(megabyte))),
 		protector: &sync.Mutex{},
 		conf:      conf,
+		done:      make(chan struct{}),
+		jobs:      &sync.WaitGroup{},
 	}
+	if conf.FsyncPolicy() == mqueue.FsyncEverySec {
+		q.jobs.Add(1)
+		go q.flushEverySecond()
+	}
+	q.jobs.Add(3)
+	go q.requeueExpired()
+	go q.deliverDelayed()
+	go q.routeExpired()
+	return q
+}
+
+// routeExpired moves, once a second, the expired messages of the queues with
+// an expired_queue to that queue, until CloseAll is called.
+func (q *QueueMan) routeExpired() {
+	defer q.jobs.Done()
+	lf := log.Fields{
+		"func": "QueueMan#routeExpired",
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+		for name, m := range q.named() {
+			expired := m.TakeExpired()
+			if len(expired) == 0 {
+				continue
+			}
+			base, _ := splitLane(name)
+			lf["queue"] = name
+			q.putAside(q.conf.QueueConfig(base).ExpiredQueue, expired, lf)
+		}
+	}
+}
+
+// putAside puts msgs in the queue target, the messages it refuses are logged
+// and dropped.
+func (q *QueueMan) putAside(target string, msgs [][]byte, lf log.Fields) {
+	err := q.checkPush(target)
+	var side *mqueue.CompositeQueue
+	if err == nil {
+		side, err = q.GetOrCreate(target)
+	}
+	if err == nil {
+		var n int
+		n, err = side.PutBatch(msgs)
+		msgs = msgs[n:]
+	}
+	if err != nil {
+		log.WithFields(lf).WithError(err).Errorf("dropped %d messages for %s", len(msgs), target)
+	}
+}
+
+// deliverDelayed puts the delayed messages in their queue as they become due,
+// until CloseAll is called.
+func (q *QueueMan) deliverDelayed() {
+	defer q.jobs.Done()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case now := <-ticker.C:
+			for _, m := range q.all() {
+				m.DeliverDue(now)
+			}
+		}
+	}
+}
+
+// requeueExpired delivers again, once a second, the reserved messages whose
+// lease expired, or moves them to the dead letter queue, until CloseAll is
+// called.
+func (q *QueueMan) requeueExpired() {
+	defer q.jobs.Done()
+	lf := log.Fields{
+		"func": "QueueMan#requeueExpired",
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case now := <-ticker.C:
+			for name, m := range q.named() {
+				if n := m.RequeueExpired(now); n > 0 {
+					log.WithFields(lf).Debugf("requeued %d expired messages", n)
+					q.RouteDead(name, m)
+				}
+			}
+		}
+	}
+}
+
+// flushEverySecond syncs every queue once a second until CloseAll is called.
+func (q *QueueMan) flushEverySecond() {
+	defer q.jobs.Done()
+	lf := log.Fields{
+		"func": "QueueMan#flushEverySecond",
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+		for _, m := range q.all() {
+			if err := m.Sync(); err != nil {
+				log.WithFields(lf).WithError(err).Error("failed to sync queue")
+			}
+		}
+	}
+}
+
+// SyncStats returns the oldest last successful sync and the longest sync
+// latency among all queues.
+func (q *QueueMan) SyncStats() (last time.Time, latency time.Duration) {
+	for _, m := range q.all() {
+		l, d := m.SyncStats()
+		if last.IsZero() || l.Before(last) {
+			last = l
+		}
+		if d > latency {
+			latency = d
+		}
+	}
+	return
+}
+
+// InFlight returns how many reserved messages of all queues wait for ACK.
+func (q *QueueMan) InFlight() int {
+	var n int
+	for _, m := range q.all() {
+		n += m.InFlight()
+	}
+	return n
+}
+
+// Delayed returns how many delayed messages of all queues are not due yet.
+func (q *QueueMan) Delayed() int {
+	var n int
+	for _, m := range q.all() {
+		n += m.Delayed()
+	}
+	return n
+}
+
+// Expired returns how many expired messages all queues skipped.
+func (q *QueueMan) Expired() uint64 {
+	var n uint64
+	for _, m := range q.all() {
+		n += m.Expired()
+	}
+	return n
+}
+
+// Dead returns how many messages all queues dropped after too many deliveries.
+func (q *QueueMan) Dead() uint64 {
+	var n uint64
+	for _, m := range q.all() {
+		n += m.Dead()
+	}
+	return n
+}
+
+// Evicted returns how many messages all queues dropped to make room.
+func (q *QueueMan) Evicted() uint64 {
+	var n uint64
+	for _, m := range q.all() {
+		n += m.Evicted()
+	}
+	return n
+}
+
+// named returns every queue and lane by name.
+func (q *QueueMan) named() map[string]*mqueue.CompositeQueue {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	res := make(map[string]*mqueue.CompositeQueue, len(q.queues))
+	for name, m := range q.queues {
+		res[name] = m
+	}
+	for name, lanes := range q.lanes {
+		for _, l := range lanes {
+			res[laneName(name, l.priority)] = l.q
+		}
+	}
+	return res
+}
+
+func (q *QueueMan) all() []*mqueue.CompositeQueue {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	return q.allLocked()
+}
+
+// allLocked is all for a caller holding the protector.
+func (q *QueueMan) allLocked() []*mqueue.CompositeQueue {
+	res := make([]*mqueue.CompositeQueue, 0, len(q.queues))
+	for _, m := range q.queues {
+		res = append(res, m)
+	}
+	for _, lanes := range q.lanes {
+		for _, l := range lanes {
+			res = append(res, l.q)
+		}
+	}
+	return res
+}
+
+// ExistingQueue returns the queue qName, nil if there is none. Unlike
+// GetOrCreate it never creates one.
+func (q *QueueMan) ExistingQueue(qName string) *mqueue.CompositeQueue {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	return q.queues[qName]
 }
 
 func (q *QueueMan) GetOrCreate(qName string) (*mqueue.CompositeQueue, error) {
@@ -42,32 +285,74 @@ func (q *QueueMan) GetOrCreate(qName string) (*mqueue.CompositeQueue, error) {
 	if !queueNamePattern.MatchString(qName) {
 		return nil, QueueNameNotValid
 	}
-	opt := mqueue.CompositeQueueOption{
-		Name:          qName,
-		BackFile:      path.Join(q.conf.DataDir, qName+".mq"),
-		FileBlockUnit: uint64(q.conf.FileBlockUnit.ValueWithDefault(gigabyte)),
-		CacheSize:     uint64(q.conf.Cache.ValueWithDefault(8 * megabyte)),
+	if q.cluster != nil {
+		if err := q.cluster.mayCreate(qName); err != nil {
+			return nil, err
+		}
 	}
-	m, err := mqueue.OpenCompositionQueue(opt)
+	m, err := mqueue.OpenCompositionQueue(q.queueOption(qName, path.Join(q.conf.DataDir, qName+".mq")))
 	if err != nil {
 		return nil, err
 	}
+	if q.stopping {
+		m.Interrupt()
+	}
 	q.queues[qName] = m
 	return m, nil
 }
 
+func (q *QueueMan) queueOption(qName string, backFile string) mqueue.CompositeQueueOption {
+	// the lanes of a queue have its settings
+	base, _ := splitLane(qName)
+	qc := q.conf.QueueConfig(base)
+	return mqueue.CompositeQueueOption{
+		Name:           qName,
+		BackFile:       backFile,
+		FileBlockUnit:  uint64(q.conf.FileBlockUnit.ValueWithDefault(gigabyte)),
+		CacheSize:      uint64(q.conf.Cache.ValueWithDefault(8 * megabyte)),
+		Journal:        q.conf.Journal,
+		Fsync:          q.conf.FsyncPolicy(),
+		Recovery:       q.conf.RecoveryPolicy(),
+		MaxMessageSize: uint64(q.conf.MaxMessage.ValueWithDefault(8 * megabyte)),
+		MaxLength:      qc.MaxLength,
+		MaxBytes:       uint64(qc.MaxBytes.ValueWithDefault(0)),
+		Overflow:       qc.OverflowPolicy(),
+		BlockTimeout:   time.Duration(qc.BlockTimeout) * time.Second,
+
+		VisibilityTimeout: time.Duration(qc.VisibilityTimeout) * time.Second,
+		TTL:               time.Duration(qc.TTL) * time.Second,
+		// expired messages are kept for another queue, as a queue receiving
+		// its own would never drop them, and never in raft mode, where only
+		// the log changes the queues
+		KeepExpired:   qc.ExpiredQueue != "" && qc.ExpiredQueue != base && q.conf.Raft.ID == "",
+		MaxDeliveries: qc.MaxDeliveries,
+		KeepDead:      qc.DeadLetterQueue != "" && qc.DeadLetterQueue != base,
+		Retain:        qc.Retain(),
+		Observer: func(op mqueue.Op) {
+			q.repl.observe(qName, op)
+		},
+	}
+}
+
 func (q *QueueMan) Delete(qName string) error {
 	q.protector.Lock()
 	defer q.protector.Unlock()
-	m, ok := q.queues[qName]
-	if !ok {
-		return nil
+	for len(q.lanes[qName]) > 0 {
+		lanes := q.lanes[qName]
+		if err := lanes[0].q.Delete(); err != nil {
+			return err
+		}
+		q.lanes[qName] = lanes[1:]
 	}
-	err := m.Delete()
-	if err != nil {
-		return err
+	delete(q.lanes, qName)
+	delete(q.streams, qName)
+	if m, ok := q.queues[qName]; ok {
+		if err := m.Delete(); err != nil {
+			return err
+		}
+		delete(q.queues, qName)
 	}
-	delete(q.queues, qName)
+	q.repl.add(replOp{cmd: "REPLDEL", queue: qName})
 	return nil
 }
 
@@ -81,10 +366,31 @@ func (q *QueueMan) Queues() []string {
 	return res
 }
 
+// Interrupt wakes up the clients waiting for room in a queue, so that they
+// finish before the queues are closed.
+func (q *QueueMan) Interrupt() {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	q.stopping = true
+	for _, m := range q.queues {
+		m.Interrupt()
+	}
+	for _, lanes := range q.lanes {
+		for _, l := range lanes {
+			l.q.Interrupt()
+		}
+	}
+}
+
 func (q *QueueMan) CloseAll() {
 	lf := log.Fields{
 		"func": "QueueMan#CloseAll",
 	}
+	close(q.done)
+	if q.raft != nil {
+		q.raft.close()
+	}
+	q.jobs.Wait()
 	q.protector.Lock()
 	defer q.protector.Unlock()
 	for k, m := range q.queues {
@@ -94,6 +400,14 @@ func (q *QueueMan) CloseAll() {
 			log.WithFields(lf).WithError(err).Errorf("failed to close queue %s", k)
 		}
 	}
+	for k, lanes := range q.lanes {
+		for _, l := range lanes {
+			if err := l.q.Close(); err != nil {
+				log.WithFields(lf).WithError(err).Errorf("failed to close queue %s", laneName(k, l.priority))
+			}
+		}
+		delete(q.lanes, k)
+	}
 }
 
 func (q *QueueMan) Load() {
@@ -105,20 +419,25 @@ func (q *QueueMan) Load() {
 		log.WithFields(lf).WithError(err).Error("failed to listing data file")
 		return
 	}
+	loaded := make(map[string]bool)
 	for _, f := range files {
-		baseName := filepath.Base(f)
+		// every segment of a queue matches, open the queue once from its base name
+		backFile := mqueue.SegmentBase(f)
+		baseName := filepath.Base(backFile)
 		qName := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-		opt := mqueue.CompositeQueueOption{
-			Name:          qName,
-			BackFile:      f,
-			FileBlockUnit: uint64(q.conf.FileBlockUnit.ValueWithDefault(gigabyte)),
-			CacheSize:     uint64(q.conf.Cache.ValueWithDefault(8 * megabyte)),
+		if _, ok := q.queues[qName]; ok || loaded[qName] {
+			continue
 		}
-		m, err := mqueue.OpenCompositionQueue(opt)
+		m, err := mqueue.OpenCompositionQueue(q.queueOption(qName, backFile))
 		if err != nil {
 			log.WithFields(lf).WithError(err).Error("failed to load data file")
 			continue
 		}
-		q.queues[qName] = m
+		loaded[qName] = true
+		if base, priority := splitLane(qName); priority > 0 {
+			q.addLane(base, priority, m)
+		} else {
+			q.queues[qName] = m
+		}
 	}
 }
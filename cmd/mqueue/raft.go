@@ -0,0 +1,1273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	rp "github.com/secmask/go-redisproto"
+	"github.com/secmask/mqueue"
+)
+
+// In raft mode the nodes listed in raft.peers elect a leader, which takes the
+// LPUSH, RPOP and DEL of every queue and appends them to a log it replicates
+// to the other nodes. An entry is applied to the queues of every node, in log
+// order, once a majority of the nodes has it; the leader replies then. A
+// follower redirects the commands naming a queue to the leader with MOVED.
+//
+// The nodes talk over their client port, every connection starts with
+// PEERAUTH peer_secret -> OK, the commands below are refused without it:
+//
+//	RAFTVOTE term candidate lastIndex lastTerm -> term granted
+//	RAFTAPPEND term leader prevIndex prevTerm commit [entryTerm entry]... -> term success lastIndex
+//	RAFTINSTALL term leader index indexTerm -> term accepted
+//	REPLLOAD queue deadline data, without reply, for every stored message
+//	RAFTINSTALLED index indexTerm -> term 1
+//
+// RAFTINSTALL sends the queues as of an index to a node missing entries the
+// log dropped once they were applied.
+//
+// A node saves its queues as of the base of its log in raft.snapshot before
+// it drops the entries up to there. The entries applied since may or may not
+// have reached the queue files when the node stops, so a restart rebuilds the
+// queues from the snapshot and applies the log again.
+
+var (
+	LeadershipLost       = errors.New("leadership lost, the command may or may not be applied")
+	NoLeader             = errors.New("CLUSTERDOWN No leader elected")
+	CommandNotInRaftMode = errors.New("command not supported in raft mode")
+	RaftModeOff          = errors.New("raft mode is off")
+	PeerNotAuthenticated = errors.New("NOPERM commands between nodes need PEERAUTH")
+)
+
+const (
+	raftBatch        = 512  // most entries sent at once
+	raftCompactAfter = 8192 // applied entries kept in the log before it is compacted
+)
+
+// raftRole is what a node is in its term.
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// The kinds of raftOp.
+const (
+	raftNoop byte = iota // first entry of a leader, it commits the entries of the former leaders
+	raftPush
+	raftPop
+	raftDel
+	raftMove
+)
+
+// raftOp is the command of a log entry.
+type raftOp struct {
+	kind  byte
+	queue string
+	at    int64    // push: expiry time of the messages, 0 if none; pop and move: time of the pop
+	count int      // pop: most messages popped
+	data  [][]byte // push: the messages; move: the destination queue
+}
+
+func (op raftOp) encode() []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	b := []byte{op.kind}
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(op.queue)))]...)
+	b = append(b, op.queue...)
+	b = append(b, tmp[:binary.PutVarint(tmp[:], op.at)]...)
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(op.count))]...)
+	b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(op.data)))]...)
+	for _, d := range op.data {
+		b = append(b, tmp[:binary.PutUvarint(tmp[:], uint64(len(d)))]...)
+		b = append(b, d...)
+	}
+	return b
+}
+
+var (
+	errBadRaftOp       = errors.New("malformed raft entry")
+	errBadRaftSnapshot = errors.New("malformed raft snapshot")
+)
+
+func decodeRaftOp(b []byte) (raftOp, error) {
+	var op raftOp
+	if len(b) == 0 {
+		return op, errBadRaftOp
+	}
+	op.kind = b[0]
+	b = b[1:]
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			b = nil
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	bytes := func() []byte {
+		n := uvarint()
+		if n > uint64(len(b)) {
+			b = nil
+			return nil
+		}
+		res := b[:n]
+		b = b[n:]
+		return res
+	}
+	op.queue = string(bytes())
+	at, n := binary.Varint(b)
+	if n <= 0 {
+		return op, errBadRaftOp
+	}
+	b = b[n:]
+	op.at = at
+	op.count = int(uvarint())
+	for i := uvarint(); i > 0 && b != nil; i-- {
+		op.data = append(op.data, bytes())
+	}
+	if b == nil {
+		return op, errBadRaftOp
+	}
+	return op, nil
+}
+
+type raftEntry struct {
+	term uint64
+	data []byte // encoded raftOp
+}
+
+// raftResult is the outcome of applying an entry, for the node which
+// proposed it.
+type raftResult struct {
+	term uint64   // term of the entry applied
+	data [][]byte // messages popped
+	err  error
+}
+
+// nodeConn is a connection to another node, used by one goroutine at a time.
+type nodeConn struct {
+	id     string
+	addr   string
+	secret string // peer_secret, sent by PEERAUTH once connected
+	lock   sync.Mutex
+	conn   net.Conn // nil until connected
+	w      *rp.Writer
+	parser *rp.Parser
+}
+
+// call sends a command to the peer and returns its reply.
+func (p *nodeConn) call(timeout time.Duration, args ...[]byte) (*rp.Command, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.send(timeout, args...); err != nil {
+		return nil, err
+	}
+	return p.reply(timeout)
+}
+
+// send writes a command to the peer, connecting first if needed, the caller
+// holds the lock. The connection is dropped on error.
+func (p *nodeConn) send(timeout time.Duration, args ...[]byte) error {
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+		p.w = rp.NewWriter(bufio.NewWriter(conn))
+		p.parser = rp.NewParser(conn)
+		if err = p.auth(timeout); err != nil {
+			return err
+		}
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := p.w.WriteBulks(args...)
+	if err == nil {
+		err = p.w.Flush()
+	}
+	if err != nil {
+		p.close()
+	}
+	return err
+}
+
+// auth sends PEERAUTH on a new connection, the peer refuses the commands
+// between nodes without it. The connection is dropped on error.
+func (p *nodeConn) auth(timeout time.Duration) error {
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := p.w.WriteBulks([]byte("PEERAUTH"), []byte(p.secret))
+	if err == nil {
+		err = p.w.Flush()
+	}
+	if err != nil {
+		p.close()
+		return err
+	}
+	_, err = p.reply(timeout)
+	return err
+}
+
+// reply reads the reply to the last command, the caller holds the lock. An
+// error reply of the peer is returned as the error. The connection is dropped
+// on error.
+func (p *nodeConn) reply(timeout time.Duration) (*rp.Command, error) {
+	p.conn.SetReadDeadline(time.Now().Add(timeout))
+	cmd, err := p.parser.ReadCommand()
+	if err == nil {
+		err = replyError(cmd)
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// replyError returns the error of an error reply, nil for any other reply.
+// The parser reads a line of "-ERR text" as the args "-ERR" and "text".
+func replyError(cmd *rp.Command) error {
+	if cmd.ArgCount() == 0 || len(cmd.Get(0)) == 0 || cmd.Get(0)[0] != '-' {
+		return nil
+	}
+	args := make([]string, cmd.ArgCount())
+	for i := range args {
+		args[i] = string(cmd.Get(i))
+	}
+	return errors.New(strings.Join(args, " ")[1:])
+}
+
+func (p *nodeConn) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// Raft is the raft node of a QueueMan.
+type Raft struct {
+	lock    sync.Mutex
+	cond    *sync.Cond // broadcast when commit moves or the node closes
+	qMan    *QueueMan
+	id      string
+	addrs   map[string]string // host:port of every node by id
+	peers   []*nodeConn
+	dir     string
+	fsync   bool          // sync the log on every write
+	timeout time.Duration // election timeout
+
+	// persisted
+	term     uint64
+	votedFor string
+	base     uint64      // index of the last entry dropped from the log
+	baseTerm uint64      // term of the entry base
+	log      []raftEntry // log[0] has the index base+1
+	logFile  *os.File
+
+	role     raftRole
+	applied  uint64    // last entry applied to the queues
+	leader   string    // id of the leader of the term, empty if unknown
+	commit   uint64    // last entry known to be on a majority
+	heard    time.Time // when the election timer was last reset
+	deadline time.Duration
+	next     map[string]uint64    // next entry to send by peer, on the leader
+	match    map[string]uint64    // last entry known to be on the peer, on the leader
+	contact  map[string]time.Time // last reply of the peer, on the leader
+	waiters  map[uint64]chan raftResult
+	appended chan struct{} // closed when entries are appended on the leader
+	changed  chan struct{} // closed when entries are applied, the node stops leading or closes
+	closed   bool
+	wg       sync.WaitGroup
+
+	applyLock sync.Mutex // held while entries are applied or the queues are captured or replaced
+}
+
+// StartRaft makes the QueueMan a node of the raft cluster of its config.
+func (q *QueueMan) StartRaft() error {
+	conf := q.conf.Raft
+	r := &Raft{
+		qMan:     q,
+		id:       conf.ID,
+		addrs:    conf.Peers,
+		dir:      q.conf.DataDir,
+		fsync:    q.conf.FsyncPolicy() == mqueue.FsyncAlways,
+		timeout:  time.Duration(conf.ElectionTimeout) * time.Millisecond,
+		waiters:  make(map[uint64]chan raftResult),
+		appended: make(chan struct{}),
+		changed:  make(chan struct{}),
+	}
+	if r.timeout == 0 {
+		r.timeout = time.Second
+	}
+	r.cond = sync.NewCond(&r.lock)
+	ids := make([]string, 0, len(conf.Peers))
+	for id := range conf.Peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if id != r.id {
+			r.peers = append(r.peers, &nodeConn{id: id, addr: conf.Peers[id], secret: q.conf.PeerSecret})
+		}
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	r.commit = r.applied
+	r.resetTimer()
+	q.raft = r
+	r.wg.Add(2)
+	go r.run()
+	go r.applyLoop()
+	return nil
+}
+
+// close stops the node, the queues are left as they are.
+func (r *Raft) close() {
+	r.lock.Lock()
+	r.closed = true
+	r.failWaiters()
+	r.cond.Broadcast()
+	close(r.appended)
+	r.appended = make(chan struct{})
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.lock.Unlock()
+	r.wg.Wait()
+	for _, p := range r.peers {
+		p.lock.Lock()
+		p.close()
+		p.lock.Unlock()
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.logFile != nil {
+		r.logFile.Close()
+		r.logFile = nil
+	}
+}
+
+// goLocked runs fn in a goroutine unless the node is closed, the caller
+// holds the lock.
+func (r *Raft) goLocked(fn func()) {
+	if r.closed {
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		fn()
+	}()
+}
+
+func (r *Raft) statePath() string {
+	return path.Join(r.dir, "raft.state")
+}
+
+func (r *Raft) logPath() string {
+	return path.Join(r.dir, "raft.log")
+}
+
+func (r *Raft) snapshotPath() string {
+	return path.Join(r.dir, "raft.snapshot")
+}
+
+// load reads the state, the snapshot and the log of a former run, if any.
+func (r *Raft) load() error {
+	b, err := ioutil.ReadFile(r.statePath())
+	if err == nil {
+		_, err = fmt.Sscan(string(b), &r.term, &r.votedFor, &r.base, &r.baseTerm)
+		if r.votedFor == "-" {
+			r.votedFor = ""
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", r.statePath(), err)
+	}
+	if err = r.loadSnapshot(); err != nil {
+		return fmt.Errorf("%s: %v", r.snapshotPath(), err)
+	}
+	file, err := os.Open(r.logPath())
+	if err == nil {
+		br := bufio.NewReader(file)
+		for {
+			var header [20]byte
+			if _, err = io.ReadFull(br, header[:]); err != nil {
+				break
+			}
+			index := binary.LittleEndian.Uint64(header[0:])
+			e := raftEntry{term: binary.LittleEndian.Uint64(header[8:])}
+			e.data = make([]byte, binary.LittleEndian.Uint32(header[16:]))
+			if _, err = io.ReadFull(br, e.data); err != nil {
+				break
+			}
+			if index <= r.base {
+				continue
+			}
+			if index != r.lastIndex()+1 {
+				break
+			}
+			r.log = append(r.log, e)
+		}
+		file.Close()
+	}
+	r.applied = r.base
+	return r.rewriteLog()
+}
+
+// loadSnapshot replaces the queues with those of the snapshot, which becomes
+// the base of the log. A log which does not go on from there is dropped by
+// load, the leader sends the queues again.
+func (r *Raft) loadSnapshot() error {
+	b, err := ioutil.ReadFile(r.snapshotPath())
+	if os.IsNotExist(err) {
+		b, err = make([]byte, 16), nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) < 16 {
+		return errBadRaftSnapshot
+	}
+	r.base, r.baseTerm = binary.LittleEndian.Uint64(b[0:]), binary.LittleEndian.Uint64(b[8:])
+	if err = r.qMan.dropAll(); err != nil {
+		return err
+	}
+	for b = b[16:]; len(b) > 0; {
+		if len(b) < 16 {
+			return errBadRaftSnapshot
+		}
+		queueLen, dataLen := int(binary.LittleEndian.Uint32(b[0:])), int(binary.LittleEndian.Uint32(b[12:]))
+		deadline := int64(binary.LittleEndian.Uint64(b[4:]))
+		if len(b) < 16+queueLen+dataLen {
+			return errBadRaftSnapshot
+		}
+		queue, data := string(b[16:16+queueLen]), b[16+queueLen:16+queueLen+dataLen]
+		if err = r.qMan.applyOp(queue, mqueue.Op{Kind: mqueue.OpPut, Data: data, Deadline: deadline}); err != nil {
+			return err
+		}
+		b = b[16+queueLen+dataLen:]
+	}
+	return nil
+}
+
+// saveSnapshot writes the queues as the snapshot of the entry index of
+// indexTerm, the caller holds the apply lock so that they are as of index.
+func (r *Raft) saveSnapshot(index, indexTerm uint64) error {
+	r.qMan.protector.Lock()
+	snap, err := mqueue.Capture(r.qMan.allLocked(), nil)
+	r.qMan.protector.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint64(b[0:], index)
+	binary.LittleEndian.PutUint64(b[8:], indexTerm)
+	err = snap.Each(func(queue string, data []byte, deadline int64) error {
+		var header [16]byte
+		binary.LittleEndian.PutUint32(header[0:], uint32(len(queue)))
+		binary.LittleEndian.PutUint64(header[4:], uint64(deadline))
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(data)))
+		b = append(append(append(b, header[:]...), queue...), data...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return mqueue.ReplaceFile(r.snapshotPath()+".tmp", r.snapshotPath(), b)
+}
+
+// compact drops the entries of the log up to index of indexTerm once the
+// queues as of index are saved, the caller holds the apply lock.
+func (r *Raft) compact(index, indexTerm uint64) error {
+	if err := r.saveSnapshot(index, indexTerm); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.log = append([]raftEntry{}, r.log[index-r.base:]...)
+	r.base, r.baseTerm = index, indexTerm
+	return r.rewriteLog()
+}
+
+// saveState writes the persisted state but the log, the caller holds the
+// lock.
+func (r *Raft) saveState() error {
+	votedFor := r.votedFor
+	if votedFor == "" {
+		votedFor = "-"
+	}
+	tmpPath := r.statePath() + ".tmp"
+	state := fmt.Sprintf("%d %s %d %d\n", r.term, votedFor, r.base, r.baseTerm)
+	return mqueue.ReplaceFile(tmpPath, r.statePath(), []byte(state))
+}
+
+// saveStateOrLog saves the state for the callers which have nothing to
+// report an error to.
+func (r *Raft) saveStateOrLog() {
+	if err := r.saveState(); err != nil {
+		log.WithError(err).Error("failed to save the raft state")
+	}
+}
+
+func appendEntry(b []byte, index uint64, e raftEntry) []byte {
+	var header [20]byte
+	binary.LittleEndian.PutUint64(header[0:], index)
+	binary.LittleEndian.PutUint64(header[8:], e.term)
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(e.data)))
+	return append(append(b, header[:]...), e.data...)
+}
+
+// writeEntries appends the entries of the log from index from on to the log
+// file, the caller holds the lock.
+func (r *Raft) writeEntries(from uint64) error {
+	var b []byte
+	for i := from; i <= r.lastIndex(); i++ {
+		b = appendEntry(b, i, r.log[i-r.base-1])
+	}
+	if _, err := r.logFile.Write(b); err != nil {
+		return err
+	}
+	if r.fsync {
+		return r.logFile.Sync()
+	}
+	return nil
+}
+
+// rewriteLog replaces the log file with the log, after a truncation or a
+// compaction. The caller holds the lock.
+func (r *Raft) rewriteLog() error {
+	var b []byte
+	for i, e := range r.log {
+		b = appendEntry(b, r.base+1+uint64(i), e)
+	}
+	tmpPath := r.logPath() + ".compact"
+	if err := mqueue.ReplaceFile(tmpPath, r.logPath(), b); err != nil {
+		return err
+	}
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	file, err := os.OpenFile(r.logPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	r.logFile = file
+	return r.saveState()
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.base + uint64(len(r.log))
+}
+
+func (r *Raft) lastTerm() uint64 {
+	return r.termAt(r.lastIndex())
+}
+
+// termAt returns the term of the entry index, 0 if it was dropped.
+func (r *Raft) termAt(index uint64) uint64 {
+	if index == r.base {
+		return r.baseTerm
+	}
+	if index < r.base || index > r.lastIndex() {
+		return 0
+	}
+	return r.log[index-r.base-1].term
+}
+
+// quorum tells whether n nodes are a majority.
+func (r *Raft) quorum(n int) bool {
+	return n > (len(r.peers)+1)/2
+}
+
+// resetTimer restarts the election timer with a random timeout.
+func (r *Raft) resetTimer() {
+	r.heard = time.Now()
+	r.deadline = r.timeout + time.Duration(rand.Int63n(int64(r.timeout)))
+}
+
+func (r *Raft) heartbeat() time.Duration {
+	return r.timeout / 10
+}
+
+// run starts an election once the election timer expires, and makes a leader
+// which lost the majority step down, until the node closes.
+func (r *Raft) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.heartbeat())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.qMan.done:
+			return
+		case <-ticker.C:
+		}
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			return
+		}
+		if r.role == raftLeader {
+			n := 1
+			for _, p := range r.peers {
+				if time.Since(r.contact[p.id]) < r.timeout {
+					n++
+				}
+			}
+			if !r.quorum(n) {
+				log.WithField("term", r.term).Warn("lost the majority, stepping down")
+				r.stepDown(r.term, "")
+			}
+		} else if time.Since(r.heard) > r.deadline {
+			r.campaign()
+		}
+		r.lock.Unlock()
+	}
+}
+
+// campaign starts an election for the next term, the caller holds the lock.
+func (r *Raft) campaign() {
+	r.role = raftCandidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	r.resetTimer()
+	r.saveStateOrLog()
+	term := r.term
+	votes := 1
+	if r.quorum(votes) {
+		r.becomeLeader()
+		return
+	}
+	args := [][]byte{[]byte("RAFTVOTE"), uintArg(term), []byte(r.id), uintArg(r.lastIndex()), uintArg(r.lastTerm())}
+	for _, p := range r.peers {
+		p := p
+		r.goLocked(func() {
+			reply, err := p.call(r.timeout, args...)
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			if replyTerm := parseUint(reply.Get(0)); replyTerm > r.term {
+				r.stepDown(replyTerm, "")
+				return
+			}
+			if string(reply.Get(1)) != "1" || r.role != raftCandidate || r.term != term {
+				return
+			}
+			votes++
+			if r.quorum(votes) {
+				r.becomeLeader()
+			}
+		})
+	}
+}
+
+// becomeLeader starts replicating the log to the peers, the caller holds
+// the lock.
+func (r *Raft) becomeLeader() {
+	log.WithField("term", r.term).Info("elected raft leader")
+	r.role = raftLeader
+	r.leader = r.id
+	r.next = make(map[string]uint64)
+	r.match = make(map[string]uint64)
+	r.contact = make(map[string]time.Time)
+	for _, p := range r.peers {
+		r.next[p.id] = r.lastIndex() + 1
+		r.contact[p.id] = time.Now()
+	}
+	r.appendLocal(raftEntry{term: r.term, data: raftOp{kind: raftNoop}.encode()})
+	term := r.term
+	for _, p := range r.peers {
+		p := p
+		r.goLocked(func() { r.replicate(p, term) })
+	}
+}
+
+// stepDown makes the node a follower of leader in term, the caller holds the
+// lock.
+func (r *Raft) stepDown(term uint64, leader string) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.saveStateOrLog()
+	}
+	if r.role == raftLeader {
+		r.failWaiters()
+		close(r.appended)
+		r.appended = make(chan struct{})
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+	r.role = raftFollower
+	r.leader = leader
+}
+
+// failWaiters fails the proposals waiting for their entry, which may be
+// applied later on or never.
+func (r *Raft) failWaiters() {
+	for index, ch := range r.waiters {
+		ch <- raftResult{err: LeadershipLost}
+		delete(r.waiters, index)
+	}
+}
+
+// appendLocal appends e to the log of the leader, the caller holds the lock.
+func (r *Raft) appendLocal(e raftEntry) error {
+	r.log = append(r.log, e)
+	if err := r.writeEntries(r.lastIndex()); err != nil {
+		r.log = r.log[:len(r.log)-1]
+		return err
+	}
+	close(r.appended)
+	r.appended = make(chan struct{})
+	r.advanceCommit()
+	return nil
+}
+
+// advanceCommit commits the last entry of the term a majority has, the caller
+// holds the lock.
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commit && r.termAt(n) == r.term; n-- {
+		votes := 1
+		for _, m := range r.match {
+			if m >= n {
+				votes++
+			}
+		}
+		if r.quorum(votes) {
+			r.commit = n
+			r.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// replicate sends the log to p for as long as the node leads term.
+func (r *Raft) replicate(p *nodeConn, term uint64) {
+	for {
+		r.lock.Lock()
+		if r.closed || r.role != raftLeader || r.term != term {
+			r.lock.Unlock()
+			return
+		}
+		next := r.next[p.id]
+		if next <= r.base {
+			r.lock.Unlock()
+			if err := r.sendSnapshot(p, term); err != nil {
+				log.WithField("peer", p.id).WithError(err).Warn("failed to send the queues")
+				r.sleep(r.heartbeat())
+			}
+			continue
+		}
+		prev := next - 1
+		args := [][]byte{[]byte("RAFTAPPEND"), uintArg(term), []byte(r.id), uintArg(prev), uintArg(r.termAt(prev)), uintArg(r.commit)}
+		n := 0
+		for i := next; i <= r.lastIndex() && n < raftBatch; i++ {
+			e := r.log[i-r.base-1]
+			args = append(args, uintArg(e.term), e.data)
+			n++
+		}
+		r.lock.Unlock()
+
+		reply, err := p.call(r.timeout, args...)
+		if err != nil {
+			r.sleep(r.heartbeat())
+			continue
+		}
+		r.lock.Lock()
+		if replyTerm := parseUint(reply.Get(0)); replyTerm > r.term {
+			r.stepDown(replyTerm, "")
+			r.lock.Unlock()
+			return
+		}
+		if r.role != raftLeader || r.term != term {
+			r.lock.Unlock()
+			return
+		}
+		r.contact[p.id] = time.Now()
+		if string(reply.Get(1)) == "1" {
+			if match := prev + uint64(n); match > r.match[p.id] {
+				r.match[p.id] = match
+				r.next[p.id] = match + 1
+				r.advanceCommit()
+			}
+		} else if last := parseUint(reply.Get(2)); last < prev {
+			// the peer misses entries, go back to its last one
+			r.next[p.id] = last + 1
+		} else {
+			// the entry prev conflicts
+			r.next[p.id] = prev
+		}
+		more := r.next[p.id] <= r.lastIndex()
+		appended := r.appended
+		r.lock.Unlock()
+		if more {
+			continue
+		}
+		select {
+		case <-appended:
+		case <-time.After(r.heartbeat()):
+		}
+	}
+}
+
+// sleep waits for d or until the node closes.
+func (r *Raft) sleep(d time.Duration) {
+	select {
+	case <-r.qMan.done:
+	case <-time.After(d):
+	}
+}
+
+// sendSnapshot sends the queues as of the last applied entry to p, which
+// misses entries the log dropped.
+func (r *Raft) sendSnapshot(p *nodeConn, term uint64) error {
+	r.applyLock.Lock()
+	r.lock.Lock()
+	index := r.applied
+	indexTerm := r.termAt(index)
+	r.lock.Unlock()
+	r.qMan.protector.Lock()
+	snap, err := mqueue.Capture(r.qMan.allLocked(), nil)
+	r.qMan.protector.Unlock()
+	r.applyLock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	reply, err := r.sendInstall(p, term, [][]byte{[]byte("RAFTINSTALL"), uintArg(term), []byte(r.id), uintArg(index), uintArg(indexTerm)})
+	if err != nil || reply == nil {
+		return err
+	}
+	err = snap.Each(func(queue string, data []byte, deadline int64) error {
+		return p.send(r.timeout, []byte("REPLLOAD"), []byte(queue), []byte(strconv.FormatInt(deadline, 10)), data)
+	})
+	if err != nil {
+		return err
+	}
+	if reply, err = r.sendInstall(p, term, [][]byte{[]byte("RAFTINSTALLED"), uintArg(index), uintArg(indexTerm)}); err != nil || reply == nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.role == raftLeader && r.term == term && index > r.match[p.id] {
+		r.match[p.id] = index
+		r.next[p.id] = index + 1
+		r.contact[p.id] = time.Now()
+	}
+	return nil
+}
+
+// sendInstall sends a command of RAFTINSTALL to p and returns the reply, nil
+// if the peer refused it. The caller holds the lock of p.
+func (r *Raft) sendInstall(p *nodeConn, term uint64, args [][]byte) (*rp.Command, error) {
+	if err := p.send(r.timeout, args...); err != nil {
+		return nil, err
+	}
+	reply, err := p.reply(r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if replyTerm := parseUint(reply.Get(0)); replyTerm > r.term {
+		r.stepDown(replyTerm, "")
+	}
+	if string(reply.Get(1)) != "1" || r.role != raftLeader || r.term != term {
+		return nil, nil
+	}
+	return reply, nil
+}
+
+// applyLoop applies the committed entries to the queues until the node
+// closes.
+func (r *Raft) applyLoop() {
+	defer r.wg.Done()
+	for {
+		r.lock.Lock()
+		for r.applied >= r.commit && !r.closed {
+			r.cond.Wait()
+		}
+		r.lock.Unlock()
+		r.applyLock.Lock()
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			r.applyLock.Unlock()
+			return
+		}
+		from := r.applied + 1
+		entries := append([]raftEntry{}, r.log[from-r.base-1:r.commit-r.base]...)
+		r.lock.Unlock()
+		for i, e := range entries {
+			res := r.qMan.applyRaft(e.data)
+			res.term = e.term
+			r.lock.Lock()
+			r.applied = from + uint64(i)
+			if ch, ok := r.waiters[r.applied]; ok {
+				delete(r.waiters, r.applied)
+				ch <- res
+			}
+			r.lock.Unlock()
+		}
+		r.lock.Lock()
+		close(r.changed)
+		r.changed = make(chan struct{})
+		index, indexTerm := r.applied, r.termAt(r.applied)
+		full := index-r.base > raftCompactAfter
+		r.lock.Unlock()
+		if full {
+			if err := r.compact(index, indexTerm); err != nil {
+				log.WithError(err).Error("failed to compact the raft log")
+			}
+		}
+		r.applyLock.Unlock()
+	}
+}
+
+// propose appends op to the log if the node leads, and returns the result
+// of applying it once a majority has it.
+func (r *Raft) propose(op raftOp) (raftResult, error) {
+	r.lock.Lock()
+	if r.role != raftLeader || r.closed {
+		r.lock.Unlock()
+		return raftResult{}, NoLeader
+	}
+	term := r.term
+	if err := r.appendLocal(raftEntry{term: term, data: op.encode()}); err != nil {
+		r.lock.Unlock()
+		return raftResult{}, err
+	}
+	ch := make(chan raftResult, 1)
+	r.waiters[r.lastIndex()] = ch
+	r.lock.Unlock()
+	res := <-ch
+	if res.err == nil && res.term != term {
+		// another leader replaced the entry
+		res.err = LeadershipLost
+	}
+	return res, res.err
+}
+
+// handleVote answers RAFTVOTE.
+func (r *Raft) handleVote(term uint64, candidate string, lastIndex, lastTerm uint64) (uint64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if term < r.term {
+		return r.term, false
+	}
+	if term > r.term {
+		r.stepDown(term, "")
+	}
+	upToDate := lastTerm > r.lastTerm() || lastTerm == r.lastTerm() && lastIndex >= r.lastIndex()
+	if !upToDate || r.votedFor != "" && r.votedFor != candidate {
+		return r.term, false
+	}
+	voted := r.votedFor
+	r.votedFor = candidate
+	if err := r.saveState(); err != nil {
+		// a vote which is not on disk could be given again after a restart
+		r.votedFor = voted
+		log.WithError(err).Error("failed to save the raft state, refused the vote")
+		return r.term, false
+	}
+	r.resetTimer()
+	return r.term, true
+}
+
+// handleAppend answers RAFTAPPEND, it returns the term, whether the entries
+// were appended and the last entry of the log.
+func (r *Raft) handleAppend(term uint64, leader string, prev, prevTerm, commit uint64, entries []raftEntry) (uint64, bool, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if term < r.term {
+		return r.term, false, r.lastIndex()
+	}
+	r.stepDown(term, leader)
+	r.resetTimer()
+	if prev > r.lastIndex() {
+		return r.term, false, r.lastIndex()
+	}
+	if prev >= r.base && r.termAt(prev) != prevTerm {
+		return r.term, false, prev - 1
+	}
+	// the entries up to base were applied already
+	for len(entries) > 0 && prev < r.base {
+		entries = entries[1:]
+		prev++
+	}
+	truncated := false
+	from := r.lastIndex() + 1
+	for i, e := range entries {
+		index := prev + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if r.termAt(index) == e.term {
+				continue
+			}
+			r.log = r.log[:index-r.base-1]
+			truncated = true
+		}
+		if index < from {
+			from = index
+		}
+		r.log = append(r.log, e)
+	}
+	var err error
+	if truncated {
+		err = r.rewriteLog()
+	} else if from <= r.lastIndex() {
+		err = r.writeEntries(from)
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to write the raft log")
+		return r.term, false, r.base
+	}
+	if last := prev + uint64(len(entries)); commit > r.commit && r.commit < last {
+		r.commit = commit
+		if r.commit > last {
+			r.commit = last
+		}
+		r.cond.Broadcast()
+	}
+	return r.term, true, r.lastIndex()
+}
+
+// beginInstall answers RAFTINSTALL, it empties the log and the queues which
+// the queues of the leader replace. The apply lock is held until
+// finishInstall or abortInstall.
+func (r *Raft) beginInstall(term uint64, leader string) (uint64, bool) {
+	r.lock.Lock()
+	if term < r.term {
+		defer r.lock.Unlock()
+		return r.term, false
+	}
+	r.stepDown(term, leader)
+	r.resetTimer()
+	r.lock.Unlock()
+
+	r.applyLock.Lock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// until the install completes the node starts from scratch
+	r.log, r.base, r.baseTerm, r.applied, r.commit = nil, 0, 0, 0, 0
+	err := r.rewriteLog()
+	if err == nil {
+		err = r.qMan.dropAll()
+	}
+	if err != nil {
+		log.WithError(err).Error("failed to install the queues of the leader")
+		r.applyLock.Unlock()
+		return r.term, false
+	}
+	return r.term, true
+}
+
+// finishInstall answers RAFTINSTALLED, the queues are those of the leader as
+// of the entry index of indexTerm.
+func (r *Raft) finishInstall(index, indexTerm uint64) (uint64, error) {
+	defer r.applyLock.Unlock()
+	err := r.saveSnapshot(index, indexTerm)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.base, r.baseTerm = index, indexTerm
+	r.applied, r.commit = index, index
+	r.resetTimer()
+	if err != nil {
+		return r.term, err
+	}
+	return r.term, r.rewriteLog()
+}
+
+func (r *Raft) abortInstall() {
+	r.applyLock.Unlock()
+}
+
+// changes returns a channel closed once entries are applied, the node stops
+// leading or closes.
+func (r *Raft) changes() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.changed
+}
+
+// isLeader tells whether the node leads, and returns the address of the
+// leader if it knows it.
+func (r *Raft) isLeader() (bool, string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.role == raftLeader, r.addrs[r.leader]
+}
+
+// info returns the raft section of INFO.
+func (r *Raft) info() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return fmt.Sprintf("# Raft\nraft_id:%s\nraft_role:%s\nraft_term:%d\nraft_leader:%s\nraft_leader_addr:%s\nraft_peers:%d\nraft_commit_index:%d\nraft_applied_index:%d\nraft_last_index:%d\nraft_log_base:%d\n",
+		r.id, r.role, r.term, r.leader, r.addrs[r.leader], len(r.peers), r.commit, r.applied, r.lastIndex(), r.base)
+}
+
+// applyRaft applies the entry data to the queues, in the same way on every
+// node.
+func (q *QueueMan) applyRaft(data []byte) raftResult {
+	op, err := decodeRaftOp(data)
+	if err != nil {
+		return raftResult{err: err}
+	}
+	var res raftResult
+	switch op.kind {
+	case raftPush:
+		var m *mqueue.CompositeQueue
+		if m, res.err = q.GetOrCreate(op.queue); res.err != nil {
+			break
+		}
+		for _, d := range op.data {
+			if res.err = m.Apply(mqueue.Op{Kind: mqueue.OpPut, Data: d, Deadline: op.at}); res.err != nil {
+				break
+			}
+		}
+	case raftPop:
+		var m *mqueue.CompositeQueue
+		if m, res.err = q.GetOrCreate(op.queue); res.err != nil {
+			break
+		}
+		at := time.Unix(0, op.at)
+		for len(res.data) < op.count {
+			d, err := m.PopAt(nil, at)
+			if err != nil {
+				if err != mqueue.ErrEmpty {
+					res.err = err
+				}
+				break
+			}
+			res.data = append(res.data, d)
+		}
+	case raftDel:
+		res.err = q.Delete(op.queue)
+	case raftMove:
+		if len(op.data) != 1 {
+			res.err = errBadRaftOp
+			break
+		}
+		var src, dst *mqueue.CompositeQueue
+		if src, res.err = q.GetOrCreate(op.queue); res.err != nil {
+			break
+		}
+		if dst, res.err = q.GetOrCreate(string(op.data[0])); res.err != nil {
+			break
+		}
+		d, err := src.MoveToAt(dst, time.Unix(0, op.at))
+		if err == nil {
+			res.data = [][]byte{d}
+		} else if err != mqueue.ErrEmpty {
+			res.err = err
+		}
+	}
+	return res
+}
+
+// raftCommand routes a command in raft mode: a follower redirects the
+// commands naming a queue to the leader, the leader proposes the writes of
+// raftWrites and refuses the others with CommandNotInRaftMode. It returns
+// false if the command runs as usual.
+func (c *Client) raftCommand(action string, cmd *rp.Command) (bool, error) {
+	if serverCommands[action] {
+		return false, nil
+	}
+	leader, addr := c.qMan.raft.isLeader()
+	if !leader {
+		if addr == "" {
+			return true, c.redisWriter.WriteError(NoLeader.Error())
+		}
+		return true, c.redisWriter.WriteError(fmt.Sprintf("MOVED %d %s", keySlot(cmd.Get(1)), addr))
+	}
+	if handle, ok := raftWrites[action]; ok {
+		return true, handle(c, cmd)
+	}
+	if writeCommands[action] {
+		return true, c.redisWriter.WriteError(CommandNotInRaftMode.Error())
+	}
+	return false, nil
+}
+
+// raftWrites are the writes the raft leader proposes. They only use the
+// messages of the queue named, which the log and RAFTINSTALL carry; the
+// other writes, which use lanes, reservations, delayed messages or consumer
+// groups, are refused.
+var raftWrites = map[string]func(c *Client, cmd *rp.Command) error{
+	"LPUSH":      (*Client).handleRaftLPUSH,
+	"RPOP":       (*Client).handleRaftRPOP,
+	"BRPOP":      (*Client).handleRaftBRPOP,
+	"RPOPLPUSH":  (*Client).handleRaftRPOPLPUSH,
+	"BRPOPLPUSH": (*Client).handleRaftBRPOPLPUSH,
+	"LMOVE":      (*Client).handleRaftLMOVE,
+	"DEL":        (*Client).handleRaftDEL,
+}
+
+// serverCommands name no queue or are sent between nodes, a raft follower
+// and a cluster node run them without redirecting.
+var serverCommands = map[string]bool{
+	"PING": true, "QUIT": true, "ECHO": true, "INFO": true, "KEYS": true,
+	"BACKUP": true, "BGSAVE": true,
+	"PSYNC": true, "REPLCONF": true, "REPLICAOF": true, "SLAVEOF": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "PUBLISH": true,
+	"RAFTVOTE": true, "RAFTAPPEND": true, "RAFTINSTALL": true, "RAFTINSTALLED": true, "REPLLOAD": true,
+	"CLUSTER": true, "ASKING": true, "SLOTSTATE": true, "SLOTLOADED": true, "PEERAUTH": true,
+}
+
+// peerCommands are sent between raft or cluster nodes, they are refused on
+// connections which did not PEERAUTH.
+var peerCommands = map[string]bool{
+	"RAFTVOTE": true, "RAFTAPPEND": true, "RAFTINSTALL": true, "RAFTINSTALLED": true, "REPLLOAD": true,
+	"SLOTSTATE": true, "SLOTLOADED": true,
+}
+
+func uintArg(v uint64) []byte {
+	return []byte(strconv.FormatUint(v, 10))
+}
+
+func boolArg(v bool) []byte {
+	if v {
+		return []byte("1")
+	}
+	return []byte("0")
+}
+
+// parseUint parses an unsigned argument, 0 if it is malformed.
+func parseUint(b []byte) uint64 {
+	v, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return v
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// raftNode is a node of the test cluster.
+type raftNode struct {
+	id   string
+	addr string
+	dir  string
+	qMan *QueueMan
+	stop func()
+}
+
+func (n *raftNode) start(t *testing.T, peers map[string]string) {
+	n.qMan = NewQueueMan(&Config{DataDir: n.dir, FileBlockUnit: "4k", Cache: "1k", PeerSecret: "s3cret",
+		Raft: RaftConfig{ID: n.id, Peers: peers, ElectionTimeout: 300}})
+	n.qMan.Load()
+	if err := n.qMan.StartRaft(); err != nil {
+		t.Fatal(err)
+	}
+	n.addr, n.stop = serveQueueManAt(t, n.qMan, n.addr)
+}
+
+func (n *raftNode) close() {
+	n.stop()
+	n.qMan.CloseAll()
+	n.qMan = nil
+}
+
+// command sends a command to addr and returns the raw reply.
+func command(t *testing.T, addr string, args ...string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return roundTrip(t, conn, args...)
+}
+
+// roundTrip sends a command on conn and returns the raw reply.
+func roundTrip(t *testing.T, conn net.Conn, args ...string) string {
+	req := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		req += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 512)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply[:n])
+}
+
+// leaderOf returns the single leader of the running nodes, nil if there is
+// none yet.
+func leaderOf(nodes []*raftNode) *raftNode {
+	var leader *raftNode
+	for _, n := range nodes {
+		if n.qMan == nil {
+			continue
+		}
+		if ok, _ := n.qMan.raft.isLeader(); ok {
+			if leader != nil {
+				return nil
+			}
+			leader = n
+		}
+	}
+	return leader
+}
+
+func TestRaft(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peers := make(map[string]string)
+	var nodes []*raftNode
+	for _, id := range []string{"n1", "n2", "n3"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &raftNode{id: id, addr: listener.Addr().String(), dir: path.Join(dir, id)}
+		listener.Close()
+		if err = os.Mkdir(n.dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		peers[id] = n.addr
+		nodes = append(nodes, n)
+	}
+	for _, n := range nodes {
+		n.start(t, peers)
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n.qMan != nil {
+				n.close()
+			}
+		}
+	}()
+
+	var leader *raftNode
+	waitFor(t, "a leader", func() bool {
+		leader = leaderOf(nodes)
+		return leader != nil
+	})
+	// only nodes knowing the peer secret may vote or append
+	conn, err := net.Dial("tcp", leader.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := roundTrip(t, conn, "RAFTVOTE", "0", "n9", "0", "0"); !strings.HasPrefix(reply, "-NOPERM") {
+		t.Fatalf("Expect RAFTVOTE to be refused, got %q", reply)
+	}
+	if reply := roundTrip(t, conn, "PEERAUTH", "guess"); !strings.HasPrefix(reply, "-WRONGPASS") {
+		t.Fatalf("Expect a wrong secret to be refused, got %q", reply)
+	}
+	if reply := roundTrip(t, conn, "RAFTAPPEND", "0", "n9", "0", "0", "0"); !strings.HasPrefix(reply, "-NOPERM") {
+		t.Fatalf("Expect RAFTAPPEND to be refused, got %q", reply)
+	}
+	if reply := roundTrip(t, conn, "PEERAUTH", "s3cret"); reply != "*1\r\n$2\r\nOK\r\n" {
+		t.Fatalf("Expect PEERAUTH to succeed, got %q", reply)
+	}
+	if reply := roundTrip(t, conn, "RAFTVOTE", "0", "n9", "0", "0"); !strings.HasPrefix(reply, "*2") {
+		t.Fatalf("Expect RAFTVOTE to be answered, got %q", reply)
+	}
+	conn.Close()
+
+	for _, msg := range []string{"a", "b", "c"} {
+		if reply := command(t, leader.addr, "LPUSH", "jobs", msg); reply != ":1\r\n" {
+			t.Fatalf("Expect LPUSH to succeed, got %q", reply)
+		}
+	}
+	waitFor(t, "every node to apply the pushes", func() bool {
+		for _, n := range nodes {
+			if queueLen(n.qMan, "jobs") != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		// a follower knows the leader it applies entries from
+		reply := command(t, n.addr, "LPUSH", "jobs", "x")
+		if expected := fmt.Sprintf("-MOVED %d %s\r\n", keySlot([]byte("jobs")), leader.addr); reply != expected {
+			t.Fatalf("Expect %q, got %q", expected, reply)
+		}
+	}
+
+	// the other nodes elect a new leader, which has every acknowledged push
+	leader.close()
+	var next *raftNode
+	waitFor(t, "a new leader", func() bool {
+		next = leaderOf(nodes)
+		return next != nil
+	})
+	if reply := command(t, next.addr, "RPOP", "jobs"); reply != "$1\r\na\r\n" {
+		t.Fatalf("Expect RPOP to return the oldest message, got %q", reply)
+	}
+
+	// the former leader catches up from its log once it is back
+	leader.start(t, peers)
+	waitFor(t, "the former leader to catch up", func() bool {
+		for _, n := range nodes {
+			if queueLen(n.qMan, "jobs") != 2 {
+				return false
+			}
+		}
+		return true
+	})
+	if !strings.Contains(command(t, leader.addr, "INFO", "raft"), "raft_role:follower") {
+		t.Fatal("Expect the former leader to follow")
+	}
+
+	// moves and blocking pops go through the log as well
+	if reply := command(t, next.addr, "RPOPLPUSH", "jobs", "done"); reply != "$1\r\nb\r\n" {
+		t.Fatalf("Expect RPOPLPUSH to move b, got %q", reply)
+	}
+	waitFor(t, "every node to apply the move", func() bool {
+		for _, n := range nodes {
+			if queueLen(n.qMan, "jobs") != 1 || queueLen(n.qMan, "done") != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	conn, err = net.Dial("tcp", next.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("*3\r\n$5\r\nBRPOP\r\n$5\r\nlater\r\n$1\r\n5\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if reply := command(t, next.addr, "LPUSH", "later", "x"); reply != ":1\r\n" {
+		t.Fatalf("Expect LPUSH to succeed, got %q", reply)
+	}
+	if reply := roundTrip(t, conn, "PING"); !strings.HasPrefix(reply, "*2\r\n$5\r\nlater\r\n$1\r\nx\r\n") {
+		t.Fatalf("Expect BRPOP to return x, got %q", reply)
+	}
+	waitFor(t, "every node to apply the blocked pop", func() bool {
+		for _, n := range nodes {
+			if queueLen(n.qMan, "later") != 0 {
+				return false
+			}
+		}
+		return true
+	})
+	if reply := command(t, next.addr, "RESERVE", "jobs"); reply != "-"+CommandNotInRaftMode.Error()+"\r\n" {
+		t.Fatalf("Expect RESERVE to be refused, got %q", reply)
+	}
+
+	// a follower compacts its log, then pushes after the snapshot reach its
+	// queue files along with a message no entry put there
+	var follower *raftNode
+	for _, n := range nodes {
+		if n != next {
+			follower = n
+			break
+		}
+	}
+	r := follower.qMan.raft
+	r.applyLock.Lock()
+	r.lock.Lock()
+	index, indexTerm := r.applied, r.termAt(r.applied)
+	r.lock.Unlock()
+	err = r.compact(index, indexTerm)
+	r.applyLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := command(t, next.addr, "LPUSH", "done", "y"); reply != ":1\r\n" {
+		t.Fatalf("Expect LPUSH to succeed, got %q", reply)
+	}
+	waitFor(t, "the follower to apply the push", func() bool {
+		return queueLen(follower.qMan, "done") == 2
+	})
+	follower.close()
+	stray := NewQueueMan(&Config{DataDir: follower.dir, FileBlockUnit: "4k", Cache: "1k"})
+	stray.Load()
+	if m, err := stray.GetOrCreate("done"); err != nil || m.Put([]byte("z")) != nil {
+		t.Fatalf("Unexpected queue %v", err)
+	}
+	stray.CloseAll()
+
+	// the restart rebuilds the queues from the snapshot and the log
+	follower.start(t, peers)
+	if info := command(t, follower.addr, "INFO", "raft"); !strings.Contains(info, fmt.Sprintf("raft_log_base:%d\n", index)) {
+		t.Fatalf("Expect the log to start at the snapshot, got %q", info)
+	}
+	waitFor(t, "the follower to apply its log again", func() bool {
+		return queueLen(follower.qMan, "done") == 2
+	})
+	if queueLen(follower.qMan, "jobs") != 1 {
+		t.Fatalf("Unexpected length %d of jobs", queueLen(follower.qMan, "jobs"))
+	}
+	if reply := command(t, next.addr, "RPOP", "done"); reply != "$1\r\nb\r\n" {
+		t.Fatalf("Expect RPOP to return b, got %q", reply)
+	}
+	waitFor(t, "every node to apply the pop", func() bool {
+		for _, n := range nodes {
+			if queueLen(n.qMan, "done") != 1 {
+				return false
+			}
+		}
+		return true
+	})
+}
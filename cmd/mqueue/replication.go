@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	rp "github.com/secmask/go-redisproto"
+	"github.com/secmask/mqueue"
+)
+
+// A replica connects to its primary and sends "PSYNC replid offset". The
+// primary replies with "FULLRESYNC replid offset", the stored messages of
+// every queue as "REPLLOAD queue deadline data" and "REPLSYNCED", or with
+// "CONTINUE" when its backlog still has the ops from offset on. Then it sends
+// the ops as they happen:
+//
+//	REPLPUT queue deadline data
+//	REPLPOP queue
+//	REPLDEL queue
+//
+// Each op advances the offset by one. The replica applies them in order and
+// sends "REPLCONF ACK offset" every second. The in-flight, delayed and
+// consumer group state of the queues is not replicated, see mqueue.Op.
+
+var (
+	ReadOnlyReplica  = errors.New("READONLY You can't write against a read only replica.")
+	ReplicaOfReplica = errors.New("replica can not serve replicas")
+	ReplicaTooSlow   = errors.New("replica is behind the replication backlog")
+	ReplicaDetached  = errors.New("replica detached")
+)
+
+// writeCommands change queues, a replica refuses them. Popping is a change.
+var writeCommands = map[string]bool{
+	"LPUSH": true, "PPUSH": true, "LPUSHEX": true, "LPUSHDELAY": true, "LPUSHAT": true,
+	"RPOP": true, "BRPOP": true, "RPOPLPUSH": true, "BRPOPLPUSH": true, "LMOVE": true,
+	"DEL": true, "IMPORT": true,
+	"RESERVE": true, "BRESERVE": true, "ACK": true, "NACK": true,
+	"DLQREPLAY": true, "DLQPURGE": true,
+	"XADD": true, "XTRIM": true, "XGROUP": true, "XREADGROUP": true, "XACK": true,
+}
+
+// replOp is an op of the replication stream.
+type replOp struct {
+	cmd      string // REPLPUT, REPLPOP or REPLDEL
+	queue    string
+	deadline int64
+	data     []byte
+}
+
+// size is about what op takes in the backlog.
+func (op replOp) size() int {
+	return len(op.queue) + len(op.data) + 32
+}
+
+func (op replOp) write(w *rp.Writer) error {
+	if op.cmd == "REPLPUT" {
+		return w.WriteBulks([]byte(op.cmd), []byte(op.queue), []byte(strconv.FormatInt(op.deadline, 10)), op.data)
+	}
+	return w.WriteBulks([]byte(op.cmd), []byte(op.queue))
+}
+
+// replicaLink is a replica connected to this server.
+type replicaLink struct {
+	addr    string
+	sent    uint64        // offset of the next op to send
+	acked   uint64        // offset the replica acknowledged
+	ackTime time.Time     // when the replica last acknowledged
+	syncing bool          // true while the snapshot is sent, the backlog keeps the ops from sent on
+	stop    chan struct{} // closed when the replica is detached
+}
+
+// primaryLink is the primary this server replicates.
+type primaryLink struct {
+	addr  string
+	state string        // connect, sync while the snapshot is loaded, or connected
+	stop  chan struct{} // closed when the server stops replicating it
+}
+
+// replication is the replication state of a QueueMan. On a primary, offset
+// is the offset of the next op and the backlog has the last ops, to let a
+// replica which lost its link catch up. On a replica, id and offset are those
+// of the primary ops applied.
+type replication struct {
+	lock     sync.Mutex
+	id       string // replication ID, a new one starts a new history of ops
+	offset   uint64
+	start    uint64 // offset of backlog[0]
+	backlog  []replOp
+	size     int           // bytes of backlog
+	maxSize  int           // bytes of backlog kept
+	active   bool          // false until a replica connects, the ops are not kept before
+	fed      chan struct{} // closed when ops are added while feeders wait
+	feeders  int           // replicas waiting on fed
+	replicas map[*replicaLink]struct{}
+	primary  *primaryLink // nil unless this server is a replica
+}
+
+func newReplication(maxSize int) *replication {
+	return &replication{
+		id:       newReplID(),
+		maxSize:  maxSize,
+		fed:      make(chan struct{}),
+		replicas: make(map[*replicaLink]struct{}),
+	}
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// isReplica tells whether the server replicates a primary.
+func (r *replication) isReplica() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.primary != nil
+}
+
+// position returns the replication ID and offset.
+func (r *replication) position() (string, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.id, r.offset
+}
+
+// observe adds the op of the queue qName to the backlog, it is called under
+// the lock of the queue.
+func (r *replication) observe(qName string, op mqueue.Op) {
+	if op.Kind == mqueue.OpPut {
+		// the data is only valid during the call
+		r.add(replOp{cmd: "REPLPUT", queue: qName, deadline: op.Deadline, data: append([]byte{}, op.Data...)})
+	} else {
+		r.add(replOp{cmd: "REPLPOP", queue: qName})
+	}
+}
+
+func (r *replication) add(op replOp) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.active || r.primary != nil {
+		return
+	}
+	r.backlog = append(r.backlog, op)
+	r.offset++
+	r.size += op.size()
+	r.trim()
+	if r.feeders > 0 {
+		close(r.fed)
+		r.fed = make(chan struct{})
+	}
+}
+
+// trim drops the oldest ops beyond maxSize, except those a replica still
+// loading its snapshot needs.
+func (r *replication) trim() {
+	keep := r.offset
+	for link := range r.replicas {
+		if link.syncing && link.sent < keep {
+			keep = link.sent
+		}
+	}
+	for r.size > r.maxSize && r.start < keep {
+		r.size -= r.backlog[0].size()
+		r.backlog[0] = replOp{}
+		r.backlog = r.backlog[1:]
+		r.start++
+	}
+}
+
+// resume attaches link from offset if the backlog has the ops of id from
+// offset on, it returns false if the replica needs a full sync instead.
+func (r *replication) resume(link *replicaLink, id string, offset uint64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.active || id != r.id || offset < r.start || offset > r.offset {
+		return false
+	}
+	link.sent = offset
+	r.replicas[link] = struct{}{}
+	return true
+}
+
+// attach attaches link for a full sync from the current offset, which it
+// returns with the replication ID. It is called while the queues are
+// captured.
+func (r *replication) attach(link *replicaLink) (string, uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.active = true
+	link.sent = r.offset
+	link.syncing = true
+	r.replicas[link] = struct{}{}
+	return r.id, r.offset
+}
+
+// synced marks the snapshot of link as sent.
+func (r *replication) synced(link *replicaLink) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	link.syncing = false
+	r.trim()
+}
+
+// detach forgets link, its feeder stops.
+func (r *replication) detach(link *replicaLink) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.replicas[link]; ok {
+		delete(r.replicas, link)
+		close(link.stop)
+	}
+}
+
+// next waits for the ops link was not sent yet and returns them.
+func (r *replication) next(link *replicaLink) ([]replOp, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		select {
+		case <-link.stop:
+			return nil, ReplicaDetached
+		default:
+		}
+		if link.sent < r.start {
+			return nil, ReplicaTooSlow
+		}
+		if link.sent < r.offset {
+			ops := append([]replOp{}, r.backlog[link.sent-r.start:]...)
+			link.sent = r.offset
+			return ops, nil
+		}
+		fed := r.fed
+		r.feeders++
+		r.lock.Unlock()
+		select {
+		case <-fed:
+		case <-link.stop:
+		}
+		r.lock.Lock()
+		r.feeders--
+	}
+}
+
+func (r *replication) ack(link *replicaLink, offset uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	link.acked = offset
+	link.ackTime = time.Now()
+}
+
+// follow makes the server a replica of the primary at addr, or a primary if
+// addr is empty, and returns the link to replicate. The replicas are
+// detached.
+func (r *replication) follow(addr string) *primaryLink {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.primary != nil {
+		close(r.primary.stop)
+		r.primary = nil
+	}
+	for link := range r.replicas {
+		delete(r.replicas, link)
+		close(link.stop)
+	}
+	r.backlog = nil
+	r.size = 0
+	r.start = r.offset
+	if addr == "" {
+		// the replicas of the former primary may continue from here
+		r.active = true
+		return nil
+	}
+	r.primary = &primaryLink{addr: addr, state: "connect", stop: make(chan struct{})}
+	return r.primary
+}
+
+// resync starts the history of ops id at offset, from a full sync of the
+// primary of link.
+func (r *replication) resync(link *primaryLink, id string, offset uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.id = id
+	r.offset = offset
+	r.start = offset
+	link.state = "sync"
+}
+
+func (r *replication) setState(link *primaryLink, state string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	link.state = state
+}
+
+// applied advances the offset of a replica by one op.
+func (r *replication) applied() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.offset++
+}
+
+// info returns the replication section of INFO, in the format of Redis.
+func (r *replication) info() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var b strings.Builder
+	b.WriteString("# Replication\n")
+	if r.primary != nil {
+		host, port, _ := net.SplitHostPort(r.primary.addr)
+		linkStatus, syncing := "down", 0
+		switch r.primary.state {
+		case "connected":
+			linkStatus = "up"
+		case "sync":
+			syncing = 1
+		}
+		fmt.Fprintf(&b, "role:slave\nmaster_host:%s\nmaster_port:%s\nmaster_link_status:%s\nmaster_sync_in_progress:%d\nslave_repl_offset:%d\n",
+			host, port, linkStatus, syncing, r.offset)
+	} else {
+		fmt.Fprintf(&b, "role:master\nconnected_slaves:%d\n", len(r.replicas))
+		i := 0
+		for link := range r.replicas {
+			host, port, _ := net.SplitHostPort(link.addr)
+			state, lag := "online", int64(0)
+			if link.syncing {
+				state = "sync"
+			}
+			if !link.ackTime.IsZero() {
+				lag = int64(time.Since(link.ackTime) / time.Second)
+			}
+			fmt.Fprintf(&b, "slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\n", i, host, port, state, link.acked, lag)
+			i++
+		}
+	}
+	active := 0
+	if r.active {
+		active = 1
+	}
+	fmt.Fprintf(&b, "master_replid:%s\nmaster_repl_offset:%d\nrepl_backlog_active:%d\nrepl_backlog_size:%d\nrepl_backlog_first_offset:%d\nrepl_backlog_histlen:%d\n",
+		r.id, r.offset, active, r.maxSize, r.start, len(r.backlog))
+	return b.String()
+}
+
+// SyncReplica attaches the replica link which sent "PSYNC id offset" and
+// writes the start of its replication stream with write, the ops follow.
+func (q *QueueMan) SyncReplica(link *replicaLink, id string, offset uint64, write func(args ...[]byte) error) error {
+	if q.repl.isReplica() {
+		return ReplicaOfReplica
+	}
+	if q.repl.resume(link, id, offset) {
+		return write([]byte("CONTINUE"))
+	}
+	// the queues can not be created or deleted while they are captured, the
+	// ops of the queues captured come after offset
+	q.protector.Lock()
+	snap, err := mqueue.Capture(q.allLocked(), func() {
+		id, offset = q.repl.attach(link)
+	})
+	q.protector.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	defer q.repl.synced(link)
+	if err = write([]byte("FULLRESYNC"), []byte(id), []byte(strconv.FormatUint(offset, 10))); err != nil {
+		return err
+	}
+	err = snap.Each(func(queue string, data []byte, deadline int64) error {
+		return write([]byte("REPLLOAD"), []byte(queue), []byte(strconv.FormatInt(deadline, 10)), data)
+	})
+	if err != nil {
+		return err
+	}
+	return write([]byte("REPLSYNCED"))
+}
+
+// IsReplica tells whether the server replicates a primary.
+func (q *QueueMan) IsReplica() bool {
+	return q.repl.isReplica()
+}
+
+// ReplicaOf replicates the primary at addr, host:port, from then on. The
+// queues are replaced by those of the primary unless the server has the
+// history of the primary already. An empty addr stops replicating and makes
+// the server a primary, which the other replicas of the former primary may
+// continue from.
+func (q *QueueMan) ReplicaOf(addr string) {
+	link := q.repl.follow(addr)
+	if link == nil {
+		return
+	}
+	q.jobs.Add(1)
+	go q.replicate(link)
+}
+
+// replicate keeps the queues in sync with the primary of link, reconnecting
+// as needed, until the server stops replicating it or CloseAll is called.
+func (q *QueueMan) replicate(link *primaryLink) {
+	defer q.jobs.Done()
+	lf := log.Fields{
+		"func":    "QueueMan#replicate",
+		"primary": link.addr,
+	}
+	for {
+		err := q.syncFrom(link)
+		select {
+		case <-link.stop:
+			return
+		case <-q.done:
+			return
+		default:
+		}
+		q.repl.setState(link, "connect")
+		log.WithFields(lf).WithError(err).Warn("lost the link with the primary, reconnecting")
+		select {
+		case <-link.stop:
+			return
+		case <-q.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// syncFrom connects to the primary of link and applies its replication
+// stream until the connection fails.
+func (q *QueueMan) syncFrom(link *primaryLink) error {
+	conn, err := net.DialTimeout("tcp", link.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-link.stop:
+		case <-q.done:
+		case <-finished:
+		}
+		conn.Close()
+	}()
+
+	w := rp.NewWriter(bufio.NewWriter(conn))
+	id, offset := q.repl.position()
+	w.WriteBulks([]byte("PSYNC"), []byte(id), []byte(strconv.FormatUint(offset, 10)))
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	parser := rp.NewParser(conn)
+	cmd, err := parser.ReadCommand()
+	if err != nil {
+		return err
+	}
+	switch strings.ToUpper(string(cmd.Get(0))) {
+	case "FULLRESYNC":
+		if offset, err = strconv.ParseUint(string(cmd.Get(2)), 10, 64); err != nil {
+			return err
+		}
+		q.repl.setState(link, "sync")
+		if err = q.dropAll(); err != nil {
+			return err
+		}
+		q.repl.resync(link, string(cmd.Get(1)), offset)
+	case "CONTINUE":
+		q.repl.setState(link, "connected")
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %s", cmd.Get(0))
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+			}
+			_, offset := q.repl.position()
+			w.WriteBulks([]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatUint(offset, 10)))
+			w.Flush()
+		}
+	}()
+	for {
+		cmd, err := parser.ReadCommand()
+		if err != nil {
+			return err
+		}
+		if err = q.applyReplicated(link, cmd); err != nil {
+			// the queues diverged from the primary, start over
+			q.repl.resync(link, "?", 0)
+			return err
+		}
+	}
+}
+
+// applyReplicated applies a command of the replication stream.
+func (q *QueueMan) applyReplicated(link *primaryLink, cmd *rp.Command) error {
+	action := strings.ToUpper(string(cmd.Get(0)))
+	qName := string(cmd.Get(1))
+	var err error
+	switch action {
+	case "REPLSYNCED":
+		q.repl.setState(link, "connected")
+		return nil
+	case "REPLLOAD", "REPLPUT":
+		var deadline int64
+		if deadline, err = strconv.ParseInt(string(cmd.Get(2)), 10, 64); err != nil {
+			return err
+		}
+		err = q.applyOp(qName, mqueue.Op{Kind: mqueue.OpPut, Data: cmd.Get(3), Deadline: deadline})
+	case "REPLPOP":
+		err = q.applyOp(qName, mqueue.Op{Kind: mqueue.OpDiscard})
+	case "REPLDEL":
+		err = q.Delete(qName)
+	default:
+		return fmt.Errorf("unknown replication command %s", action)
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", action, qName, err)
+	}
+	if action != "REPLLOAD" {
+		q.repl.applied()
+	}
+	return nil
+}
+
+// applyOp applies op to the queue or lane qName, which is created if needed.
+func (q *QueueMan) applyOp(qName string, op mqueue.Op) error {
+	m, err := q.Lane(splitLane(qName))
+	if err != nil {
+		return err
+	}
+	return m.Apply(op)
+}
+
+// dropAll deletes every queue and lane, before a full sync.
+func (q *QueueMan) dropAll() error {
+	names := q.Queues()
+	q.protector.Lock()
+	for name := range q.lanes {
+		names = append(names, name)
+	}
+	q.protector.Unlock()
+	for _, name := range names {
+		if err := q.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
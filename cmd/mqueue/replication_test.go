@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveQueueMan serves qMan on a local port until the returned function is
+// called.
+func serveQueueMan(t *testing.T, qMan *QueueMan) (string, func()) {
+	return serveQueueManAt(t, qMan, "127.0.0.1:0")
+}
+
+// serveQueueManAt serves qMan on addr until the returned function is called.
+func serveQueueManAt(t *testing.T, qMan *QueueMan, addr string) (string, func()) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	ctx := ctxWithDone(context.Background(), done)
+	wg := &sync.WaitGroup{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go NewClient(conn, ctx, qMan).Run(wg)
+		}
+	}()
+	return listener.Addr().String(), func() {
+		listener.Close()
+		close(done)
+		wg.Wait()
+	}
+}
+
+// waitFor fails the test unless cond holds within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+// queueLen returns the length of the queue or lane qName, -1 if it does not exist.
+func queueLen(qMan *QueueMan, qName string) int {
+	m, ok := qMan.named()[qName]
+	if !ok {
+		return -1
+	}
+	return int(m.Len())
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"primary", "replica"} {
+		if err = os.Mkdir(path.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primary := NewQueueMan(&Config{DataDir: path.Join(dir, "primary"), FileBlockUnit: "4k", Cache: "1k"})
+	defer primary.CloseAll()
+	addr, stop := serveQueueMan(t, primary)
+	defer stop()
+	jobs, err := primary.GetOrCreate("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// spread the messages over several segments and the memory queue
+	for i := 0; i < 200; i++ {
+		if err = jobs.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lane, err := primary.Lane("jobs", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lane.Put([]byte("urgent")); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := NewQueueMan(&Config{DataDir: path.Join(dir, "replica"), FileBlockUnit: "4k", Cache: "1k"})
+	defer replica.CloseAll()
+	stale, err := replica.GetOrCreate("stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = stale.Put([]byte("dropped by the full sync")); err != nil {
+		t.Fatal(err)
+	}
+	replica.ReplicaOf(addr)
+	waitFor(t, "the full sync", func() bool {
+		return strings.Contains(replica.repl.info(), "master_link_status:up")
+	})
+	if queueLen(replica, "stale") != -1 {
+		t.Fatal("Expect the queues of the replica to be replaced")
+	}
+	if queueLen(replica, "jobs") != 200 || queueLen(replica, "jobs.p2") != 1 {
+		t.Fatalf("Unexpected lengths after the full sync %d, %d", queueLen(replica, "jobs"), queueLen(replica, "jobs.p2"))
+	}
+
+	// the live stream
+	for i := 0; i < 50; i++ {
+		if _, err = jobs.Pop(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = jobs.Put([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err = primary.Delete("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	other, err := primary.GetOrCreate("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Put([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	_, offset := primary.repl.position()
+	waitFor(t, "the ops", func() bool {
+		_, replicated := replica.repl.position()
+		return replicated == offset
+	})
+	if queueLen(replica, "jobs") != -1 || queueLen(replica, "jobs.p2") != -1 || queueLen(replica, "other") != 1 {
+		t.Fatal("Expect the replica to follow the deletes and pushes of the primary")
+	}
+	waitFor(t, "the replica to acknowledge", func() bool {
+		return strings.Contains(primary.repl.info(), "offset="+strconv.FormatUint(offset, 10)+",")
+	})
+
+	// a replica refuses writes
+	replicaAddr, stopReplica := serveQueueMan(t, replica)
+	defer stopReplica()
+	conn, err := net.Dial("tcp", replicaAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("*3\r\n$5\r\nLPUSH\r\n$5\r\nother\r\n$1\r\nx\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 128)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(reply[:n]), "-READONLY") {
+		t.Fatalf("Expect a READONLY error, got %q", reply[:n])
+	}
+
+	// a replica which reconnects continues from its offset
+	before := replica.named()["other"]
+	replica.ReplicaOf(addr)
+	waitFor(t, "the partial sync", func() bool {
+		return strings.Contains(replica.repl.info(), "master_link_status:up")
+	})
+	if replica.named()["other"] != before {
+		t.Fatal("Expect a partial sync to keep the queues")
+	}
+
+	// a promoted replica takes writes and keeps the history of the primary
+	replica.ReplicaOf("")
+	if replica.IsReplica() {
+		t.Fatal("Expect the replica to be promoted")
+	}
+	id, promoted := replica.repl.position()
+	primaryID, _ := primary.repl.position()
+	if id != primaryID || promoted != offset {
+		t.Fatalf("Unexpected position %s %d after the promotion", id, promoted)
+	}
+	if _, err = conn.Write([]byte("*3\r\n$5\r\nLPUSH\r\n$5\r\nother\r\n$1\r\nx\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = conn.Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply[:n]) != ":1\r\n" {
+		t.Fatalf("Expect LPUSH to succeed, got %q", reply[:n])
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "bytes"
+
+// slotCount is the number of hash slots of Redis Cluster.
+const slotCount = 16384
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum Redis Cluster hashes keys with.
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keySlot returns the hash slot of key like Redis Cluster does: if key has a
+// non empty hash tag, the part between the first { and the next }, only the
+// tag is hashed.
+func keySlot(key []byte) int {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % slotCount
+}
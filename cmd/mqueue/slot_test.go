@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestKeySlot(t *testing.T) {
+	for key, slot := range map[string]int{
+		"123456789":     12739,
+		"foo":           12182,
+		"bar":           5061,
+		"{foo}.jobs":    12182,
+		"x{foo}{bar}":   12182,
+		"foo{}{bar}":    int(crc16([]byte("foo{}{bar}"))) % slotCount,
+		"{}":            int(crc16([]byte("{}"))) % slotCount,
+		"{{foo}}.queue": int(crc16([]byte("{foo"))) % slotCount,
+	} {
+		if got := keySlot([]byte(key)); got != slot {
+			t.Fatalf("Expect slot %d for %s, got %d", slot, key, got)
+		}
+	}
+}
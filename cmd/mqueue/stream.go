@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secmask/mqueue"
+)
+
+// streamEntryVersion is the first byte of the messages added by XADD, the
+// version of their encoding.
+const streamEntryVersion = 1
+
+var (
+	InvalidStreamID  = errors.New("Invalid stream ID specified as stream command argument")
+	StreamIDTooSmall = errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
+	NotStream        = errors.New("The queue is not a stream, XADD needs mode stream")
+	StreamOnlyXADD   = errors.New("The queue is a stream, only XADD adds to it")
+	NotStreamEntry   = errors.New("The queue has messages not added by XADD")
+)
+
+// streamID is the ID of a stream entry, the milliseconds it was added at and
+// a sequence number among the entries added in the same millisecond.
+type streamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || id.ms == o.ms && id.seq < o.seq
+}
+
+// next returns the smallest ID greater than id.
+func (id streamID) next() streamID {
+	if id.seq == math.MaxUint64 {
+		return streamID{id.ms + 1, 0}
+	}
+	return streamID{id.ms, id.seq + 1}
+}
+
+// prev returns the greatest ID smaller than id.
+func (id streamID) prev() streamID {
+	if id.seq == 0 {
+		return streamID{id.ms - 1, math.MaxUint64}
+	}
+	return streamID{id.ms, id.seq - 1}
+}
+
+// parseStreamID parses "ms-seq", or "ms" which means "ms-seq".
+func parseStreamID(s string, seq uint64) (streamID, error) {
+	var id streamID
+	var err error
+	ms := s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		ms = s[:i]
+		if id.seq, err = strconv.ParseUint(s[i+1:], 10, 64); err != nil {
+			return id, InvalidStreamID
+		}
+	} else {
+		id.seq = seq
+	}
+	if id.ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, InvalidStreamID
+	}
+	return id, nil
+}
+
+// parseRangeID parses a bound of XRANGE: - and + are the ends of the stream,
+// an ID prefixed with ( is excluded and "ms" means "ms-seq".
+func parseRangeID(s string, seq uint64) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+	if !strings.HasPrefix(s, "(") {
+		return parseStreamID(s, seq)
+	}
+	id, err := parseStreamID(s[1:], seq)
+	if err != nil {
+		return id, err
+	}
+	if seq == 0 {
+		if id == maxStreamID {
+			return id, InvalidStreamID
+		}
+		return id.next(), nil
+	}
+	if id == (streamID{}) {
+		return id, InvalidStreamID
+	}
+	return id.prev(), nil
+}
+
+// encodeStreamEntry returns the message stored for an entry added by XADD:
+// the version, the ID on 16 bytes, the number of fields on 4 bytes, then
+// each field and value with its 4 bytes length.
+func encodeStreamEntry(id streamID, fields [][]byte) []byte {
+	n := 21
+	for _, f := range fields {
+		n += 4 + len(f)
+	}
+	buff := make([]byte, 21, n)
+	buff[0] = streamEntryVersion
+	binary.LittleEndian.PutUint64(buff[1:], id.ms)
+	binary.LittleEndian.PutUint64(buff[9:], id.seq)
+	binary.LittleEndian.PutUint32(buff[17:], uint32(len(fields)))
+	for _, f := range fields {
+		buff = append(buff, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buff[len(buff)-4:], uint32(len(f)))
+		buff = append(buff, f...)
+	}
+	return buff
+}
+
+// decode returns the ID and the fields of an entry. The messages of a queue
+// in log mode, pushed by LPUSH, have the ID "position-0", position counting
+// from 1, and a single field named data. Those of a stream are all added by
+// XADD, a message which does not decode is shown like those of a log.
+func (s *stream) decode(e mqueue.Entry) (streamID, [][]byte) {
+	if s.entries {
+		if id, fields, ok := decodeStreamEntry(e.Data); ok {
+			return id, fields
+		}
+	}
+	return streamID{e.Offset + 1, 0}, [][]byte{[]byte("data"), e.Data}
+}
+
+func decodeStreamEntry(data []byte) (streamID, [][]byte, bool) {
+	var id streamID
+	if len(data) < 21 || data[0] != streamEntryVersion {
+		return id, nil, false
+	}
+	id.ms = binary.LittleEndian.Uint64(data[1:])
+	id.seq = binary.LittleEndian.Uint64(data[9:])
+	n := binary.LittleEndian.Uint32(data[17:])
+	if n%2 != 0 || uint64(n)*4 > uint64(len(data)) {
+		return id, nil, false
+	}
+	fields := make([][]byte, n)
+	rest := data[21:]
+	for i := range fields {
+		if len(rest) < 4 {
+			return id, nil, false
+		}
+		size := uint64(binary.LittleEndian.Uint32(rest))
+		if uint64(len(rest)-4) < size {
+			return id, nil, false
+		}
+		fields[i] = rest[4 : 4+size]
+		rest = rest[4+size:]
+	}
+	return id, fields, len(rest) == 0
+}
+
+// reply formats entries like redis streams do.
+func (s *stream) reply(entries []mqueue.Entry) []interface{} {
+	res := make([]interface{}, len(entries))
+	for i, e := range entries {
+		id, fields := s.decode(e)
+		values := make([]interface{}, len(fields))
+		for j, f := range fields {
+			values[j] = f
+		}
+		res[i] = []interface{}{id.String(), values}
+	}
+	return res
+}
+
+// offsetAfter returns the offset of the first entry of m whose ID is greater
+// than id.
+func (s *stream) offsetAfter(m *mqueue.CompositeQueue, id streamID) (uint64, error) {
+	return m.Search(func(e mqueue.Entry) bool {
+		eid, _ := s.decode(e)
+		return id.less(eid)
+	})
+}
+
+// offsetFrom returns the offset of the first entry of m whose ID is id or
+// greater.
+func (s *stream) offsetFrom(m *mqueue.CompositeQueue, id streamID) (uint64, error) {
+	return m.Search(func(e mqueue.Entry) bool {
+		eid, _ := s.decode(e)
+		return !eid.less(id)
+	})
+}
+
+// offsetOf returns the offset of the entry id of m, false if there is none.
+func (s *stream) offsetOf(m *mqueue.CompositeQueue, id streamID) (uint64, bool, error) {
+	offset, err := s.offsetFrom(m, id)
+	if err != nil {
+		return 0, false, err
+	}
+	entries, err := m.ReadFrom(offset, 1)
+	if err != nil || len(entries) == 0 || entries[0].Offset != offset {
+		return 0, false, err
+	}
+	eid, _ := s.decode(entries[0])
+	return offset, eid == id, nil
+}
+
+// stream gives the IDs of the messages of a queue in log mode, and orders
+// the XADD of a queue in stream mode so that IDs are increasing. A queue is
+// either one or the other, so that IDs of both kinds never mix.
+type stream struct {
+	lock    sync.Mutex
+	entries bool     // true in stream mode, every message is added by XADD
+	last    streamID // ID of the newest entry
+	loaded  bool     // true once last was read from the queue
+}
+
+// stream returns the stream of the queue qName.
+func (q *QueueMan) stream(qName string) *stream {
+	q.protector.Lock()
+	defer q.protector.Unlock()
+	s, ok := q.streams[qName]
+	if !ok {
+		s = &stream{entries: q.conf.QueueConfig(qName).Stream()}
+		q.streams[qName] = s
+	}
+	return s
+}
+
+// checkPush refuses the messages put in qName otherwise than by XADD, if it
+// is a stream.
+func (q *QueueMan) checkPush(qName string) error {
+	if q.conf.QueueConfig(qName).Stream() {
+		return StreamOnlyXADD
+	}
+	return nil
+}
+
+// add puts an entry with fields in m and returns its ID, id is either * to
+// generate it, "ms-*" to generate the sequence number or a whole ID.
+func (s *stream) add(m *mqueue.CompositeQueue, id string, fields [][]byte) (streamID, error) {
+	if !s.entries {
+		return streamID{}, NotStream
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.loaded {
+		first, end, err := m.Bounds()
+		if err != nil {
+			return streamID{}, err
+		}
+		if end > first {
+			entries, err := m.ReadFrom(end-1, 1)
+			if err != nil {
+				return streamID{}, err
+			}
+			if len(entries) > 0 {
+				var ok bool
+				if s.last, _, ok = decodeStreamEntry(entries[0].Data); !ok {
+					// the queue was in log mode before
+					return streamID{}, NotStreamEntry
+				}
+			}
+		}
+		s.loaded = true
+	}
+	var next streamID
+	switch {
+	case id == "*":
+		next = streamID{uint64(time.Now().UnixNano() / int64(time.Millisecond)), 0}
+		if !s.last.less(next) {
+			next = s.last.next()
+		}
+	case strings.HasSuffix(id, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
+		if err != nil {
+			return next, InvalidStreamID
+		}
+		next = streamID{ms, 0}
+		if ms == s.last.ms {
+			next = s.last.next()
+		}
+	default:
+		var err error
+		if next, err = parseStreamID(id, 0); err != nil {
+			return next, err
+		}
+	}
+	if next == (streamID{}) {
+		return next, errors.New("The ID specified in XADD must be greater than 0-0")
+	}
+	if !s.last.less(next) {
+		return next, StreamIDTooSmall
+	}
+	if err := m.Put(encodeStreamEntry(next, fields)); err != nil {
+		return next, err
+	}
+	s.last = next
+	return next, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/secmask/mqueue"
+)
+
+func TestStreamEntryEncoding(t *testing.T) {
+	id := streamID{1526919030474, 55}
+	data := encodeStreamEntry(id, [][]byte{[]byte("name"), []byte("Sara"), []byte("age"), []byte{}})
+	res, fields := (&stream{entries: true}).decode(mqueue.Entry{Offset: 7, Data: data})
+	if res != id || len(fields) != 4 || string(fields[1]) != "Sara" || len(fields[3]) != 0 {
+		t.Fatalf("Unexpected entry %v, %q", res, fields)
+	}
+	// a message of a log is an entry with a single field, whatever it holds
+	res, fields = (&stream{}).decode(mqueue.Entry{Offset: 7, Data: data})
+	if res != (streamID{8, 0}) || len(fields) != 2 || string(fields[0]) != "data" {
+		t.Fatalf("Unexpected entry %v, %q", res, fields)
+	}
+	for s, want := range map[string]streamID{"-": {}, "+": maxStreamID, "5": {5, 0}, "5-3": {5, 3}, "(5-3": {5, 4}} {
+		if id, err := parseRangeID(s, 0); err != nil || id != want {
+			t.Errorf("Unexpected start %s: %v, %v", s, id, err)
+		}
+	}
+	if id, err := parseRangeID("(5-0", maxStreamID.seq); err != nil || id != (streamID{4, maxStreamID.seq}) {
+		t.Errorf("Unexpected end: %v, %v", id, err)
+	}
+	if _, err := parseStreamID("5-x", 0); err != InvalidStreamID {
+		t.Errorf("Expect InvalidStreamID, got %v", err)
+	}
+}
+
+func TestStreamAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k", QueueDefaults: QueueConfig{Mode: "stream"},
+		Queues: map[string]QueueConfig{"log": {Mode: "log"}}}
+	qMan := NewQueueMan(conf)
+	q, err := qMan.GetOrCreate("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := [][]byte{[]byte("k"), []byte("v")}
+	// IDs of both kinds never mix, a stream only takes XADD and a log no XADD
+	if err = qMan.checkPush("events"); err != StreamOnlyXADD {
+		t.Fatalf("Expect StreamOnlyXADD, got %v", err)
+	}
+	logQ, err := qMan.GetOrCreate("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qMan.stream("log").add(logQ, "*", fields); err != NotStream {
+		t.Fatalf("Expect NotStream, got %v", err)
+	}
+	if _, err = qMan.stream("events").add(q, "10-1", fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qMan.stream("events").add(q, "10-1", fields); err != StreamIDTooSmall {
+		t.Fatalf("Expect StreamIDTooSmall, got %v", err)
+	}
+	if id, err := qMan.stream("events").add(q, "10-*", fields); err != nil || id != (streamID{10, 2}) {
+		t.Fatalf("Unexpected id %v, %v", id, err)
+	}
+	qMan.CloseAll()
+
+	// the last ID is read back from the queue
+	qMan = NewQueueMan(conf)
+	defer qMan.CloseAll()
+	if q, err = qMan.GetOrCreate("events"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = qMan.stream("events").add(q, "10-2", fields); err != StreamIDTooSmall {
+		t.Fatalf("Expect StreamIDTooSmall, got %v", err)
+	}
+	last, err := qMan.stream("events").add(q, "*", fields)
+	if err != nil || !(streamID{10, 2}).less(last) {
+		t.Fatalf("Unexpected id %v, %v", last, err)
+	}
+	if offset, ok, err := qMan.stream("events").offsetOf(q, streamID{10, 2}); !ok || offset != 1 || err != nil {
+		t.Fatalf("Unexpected offset %d, %v, %v", offset, ok, err)
+	}
+	if offset, err := qMan.stream("events").offsetAfter(q, streamID{10, 2}); offset != 2 || err != nil {
+		t.Fatalf("Unexpected offset %d, %v", offset, err)
+	}
+}
+
+func TestStreamReadMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	qMan := NewQueueMan(&Config{DataDir: dir, FileBlockUnit: "64k", Cache: "1k", QueueDefaults: QueueConfig{Mode: "stream"}})
+	defer qMan.CloseAll()
+	addr, stop := serveQueueMan(t, qMan)
+	defer stop()
+	// like Redis, reads of a missing stream find it empty and leave it missing
+	for _, c := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"XLEN", "missing"}, ":0\r\n"},
+		{[]string{"XRANGE", "missing", "-", "+"}, "*0\r\n"},
+		{[]string{"XREAD", "STREAMS", "missing", "0"}, "$-1\r\n"},
+		{[]string{"XTRIM", "missing", "MAXLEN", "1"}, ":0\r\n"},
+	} {
+		if reply := command(t, addr, c.args...); reply != c.reply {
+			t.Errorf("Expect %q to %v, got %q", c.reply, c.args, reply)
+		}
+	}
+	if qMan.ExistingQueue("missing") != nil {
+		t.Fatal("Expect the reads not to create the stream")
+	}
+	if _, err = os.Stat(path.Join(dir, "missing.mq")); !os.IsNotExist(err) {
+		t.Fatalf("Expect no file for the stream, got %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/secmask/mqueue"
+)
+
+const toolUsage = `usage: mqueue inspect|verify|dump|repair [options] <file>
+       mqueue [-c config.yml] export [-format jsonl|binary] [-o file] <queue>
+       mqueue [-c config.yml] import [-format jsonl|binary] <queue> <file>`
+
+// tools are the subcommands which look into a queue file while no server has
+// it open, they return the exit code of the process.
+var tools = map[string]func(args []string, out io.Writer) int{
+	"inspect": inspectTool,
+	"verify":  verifyTool,
+	"dump":    dumpTool,
+	"repair":  repairTool,
+	"export":  exportTool,
+	"import":  importTool,
+}
+
+// runTool runs the subcommand args[0] with the rest of args.
+func runTool(args []string, out io.Writer) int {
+	tool, ok := tools[args[0]]
+	if !ok {
+		fmt.Fprintln(out, toolUsage)
+		return 2
+	}
+	return tool(args[1:], out)
+}
+
+// toolFlags parses the options of a subcommand, which takes a single file,
+// and returns the file.
+func toolFlags(fs *flag.FlagSet, args []string, out io.Writer) (string, bool) {
+	fs.SetOutput(out)
+	if err := fs.Parse(args); err != nil {
+		return "", false
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(out, toolUsage)
+		return "", false
+	}
+	return fs.Arg(0), true
+}
+
+// formatOf returns the format version of the queue file at path.
+func formatOf(path string) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, 64) // larger than the header of any format
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return mqueue.FormatOf(header[:n], uint64(stat.Size()))
+}
+
+// openCurrent maps the queue file at path read only, it fails unless the file
+// is in the current format with a header which can be walked.
+func openCurrent(path string, out io.Writer) (*mqueue.QueueFile, bool) {
+	version, err := formatOf(path)
+	if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return nil, false
+	}
+	if version != mqueue.FormatVersion {
+		fmt.Fprintf(out, "%s: format v%d is older than v%d, repair upgrades it\n", path, version, mqueue.FormatVersion)
+		return nil, false
+	}
+	f, err := mqueue.OpenQueueFile(path, false)
+	if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return nil, false
+	}
+	if err = f.CheckHeader(); err != nil {
+		fmt.Fprintf(out, "%s: bad header: %v\n", path, err)
+		f.Close()
+		return nil, false
+	}
+	return f, true
+}
+
+// inspectTool handles "inspect <file>", it prints the header of the file.
+func inspectTool(args []string, out io.Writer) int {
+	path, ok := toolFlags(flag.NewFlagSet("inspect", flag.ContinueOnError), args, out)
+	if !ok {
+		return 2
+	}
+	version, err := formatOf(path)
+	if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	fmt.Fprintf(out, "file: %s\nformat: v%d\n", path, version)
+	if version != mqueue.FormatVersion {
+		fmt.Fprintf(out, "older than v%d, repair upgrades it\n", mqueue.FormatVersion)
+		return 0
+	}
+	f, err := mqueue.OpenQueueFile(path, false)
+	if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	defer f.Close()
+	fmt.Fprintf(out, "flags: %#04x\nsize: %d\ncapacity: %d\nread position: %d\nwrite position: %d\nread count: %d\nwrite count: %d\nlength: %d\nunread bytes: %d\n",
+		f.Flags(), len(f.MQueue), f.Capacity(), f.ReadPosition(), f.WritePosition(), f.ReadCount(), f.WriteCount(),
+		int64(f.WriteCount()-f.ReadCount()), int64(f.WritePosition()-f.ReadPosition()))
+	return 0
+}
+
+// verifyTool handles "verify <file>", it walks every unread record and
+// reports what does not match the header. It fails if anything is wrong.
+func verifyTool(args []string, out io.Writer) int {
+	path, ok := toolFlags(flag.NewFlagSet("verify", flag.ContinueOnError), args, out)
+	if !ok {
+		return 2
+	}
+	f, ok := openCurrent(path, out)
+	if !ok {
+		return 1
+	}
+	defer f.Close()
+	var records, bad, expired uint64
+	now := time.Now().UnixNano()
+	end := f.Walk(func(r mqueue.Record) bool {
+		records++
+		if !r.Valid {
+			bad++
+			fmt.Fprintf(out, "bad checksum: record %d at position %d\n", records-1, r.Pos)
+		}
+		if r.Deadline != 0 && r.Deadline <= now {
+			expired++
+		}
+		return true
+	})
+	corrupted := bad > 0
+	if end < f.WritePosition() {
+		corrupted = true
+		fmt.Fprintf(out, "torn record: at position %d, %d bytes can not be framed\n", end, f.WritePosition()-end)
+	}
+	if length := int64(f.WriteCount() - f.ReadCount()); length != int64(records) {
+		corrupted = true
+		fmt.Fprintf(out, "count mismatch: write count - read count is %d, found %d records\n", length, records)
+	}
+	fmt.Fprintf(out, "records: %d, bad: %d, expired: %d\n", records, bad, expired)
+	if corrupted {
+		fmt.Fprintf(out, "%s: CORRUPTED\n", path)
+		return 1
+	}
+	fmt.Fprintf(out, "%s: OK\n", path)
+	return 0
+}
+
+// dumpTool handles "dump [-hex] <file>", it prints the index, position,
+// deadline, checksum status and payload of every unread record.
+func dumpTool(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	hexPayload := fs.Bool("hex", false, "print payloads in hexadecimal instead of quoted")
+	path, ok := toolFlags(fs, args, out)
+	if !ok {
+		return 2
+	}
+	f, ok := openCurrent(path, out)
+	if !ok {
+		return 1
+	}
+	defer f.Close()
+	i := 0
+	f.Walk(func(r mqueue.Record) bool {
+		deadline := "-"
+		if r.Deadline != 0 {
+			deadline = time.Unix(0, r.Deadline).UTC().Format(time.RFC3339Nano)
+		}
+		status := "ok"
+		if !r.Valid {
+			status = "bad"
+		}
+		payload := strconv.Quote(string(r.Data))
+		if *hexPayload {
+			payload = hex.EncodeToString(r.Data)
+		}
+		fmt.Fprintf(out, "%d\t%d\t%s\t%s\t%s\n", i, r.Pos, deadline, status, payload)
+		i++
+		return true
+	})
+	return 0
+}
+
+// repairTool handles "repair [-policy skip|truncate] <file>", it upgrades a
+// file of an older format and drops the corrupted records. The file is
+// upgraded and repaired on a copy which is renamed over the original, the
+// original is locked meanwhile.
+func repairTool(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	policyName := fs.String("policy", "skip", "skip drops bad records only, truncate drops everything from the first one")
+	path, ok := toolFlags(fs, args, out)
+	if !ok {
+		return 2
+	}
+	policy, err := mqueue.ParseRecoveryPolicy(*policyName)
+	if err != nil || policy == mqueue.RecoverRefuse {
+		fmt.Fprintf(out, "unknown repair policy %q\n", *policyName)
+		return 2
+	}
+	original, err := os.Open(path)
+	if err == nil {
+		defer original.Close()
+		err = mqueue.LockFile(original, false)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	tmpPath := path + ".repair"
+	if err = copyFile(path, tmpPath); err != nil {
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	version, err := mqueue.UpgradeFile(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	upgraded := version != mqueue.FormatVersion
+	report, err := recoverFile(tmpPath, policy)
+	if err != nil {
+		os.Remove(tmpPath)
+		fmt.Fprintf(out, "%s: can not repair: %v\n", path, err)
+		return 1
+	}
+	if !report.Corrupted() && !upgraded {
+		os.Remove(tmpPath)
+		fmt.Fprintf(out, "%s: nothing to repair, %d records\n", path, report.Records)
+		return 0
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		fmt.Fprintf(out, "%s: %v\n", path, err)
+		return 1
+	}
+	if upgraded {
+		fmt.Fprintf(out, "upgraded from format v%d to v%d\n", version, mqueue.FormatVersion)
+	}
+	if report.Corrupted() {
+		fmt.Fprintf(out, "%s: repaired, kept %d records, dropped %d bad records and %d bytes, count fixed: %t\n",
+			path, report.Records, report.BadRecords, report.DroppedBytes, report.CountFixed)
+	}
+	return 0
+}
+
+// recoverFile repairs the queue file at path in place with policy.
+func recoverFile(path string, policy mqueue.RecoveryPolicy) (mqueue.RecoveryReport, error) {
+	f, err := mqueue.OpenQueueFile(path, true)
+	if err != nil {
+		return mqueue.RecoveryReport{}, err
+	}
+	if err = f.CheckHeader(); err != nil {
+		f.Close()
+		return mqueue.RecoveryReport{}, err
+	}
+	report, err := f.Recover(policy)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return report, err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/secmask/mqueue"
+)
+
+func TestToolsRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := make(mqueue.MQueue, 1024)
+	if err = mqueue.InitMQueue(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"first", "second", "third"} {
+		if err = m.Put([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// flip a byte of "second"
+	m[bytes.Index(m, []byte("second"))] = 'S'
+	file := path.Join(dir, "jobs.mq")
+	if err = ioutil.WriteFile(file, m, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if code := runTool([]string{"verify", file}, out); code != 1 || !strings.Contains(out.String(), "bad checksum: record 1") {
+		t.Fatalf("Unexpected verify %d:\n%s", code, out)
+	}
+	out.Reset()
+	if code := runTool([]string{"repair", file}, out); code != 0 || !strings.Contains(out.String(), "kept 2 records") {
+		t.Fatalf("Unexpected repair %d:\n%s", code, out)
+	}
+	out.Reset()
+	if code := runTool([]string{"verify", file}, out); code != 0 {
+		t.Fatalf("Unexpected verify after repair %d:\n%s", code, out)
+	}
+	out.Reset()
+	if code := runTool([]string{"dump", file}, out); code != 0 || out.String() != "0\t48\t-\tok\t\"first\"\n1\t69\t-\tok\t\"third\"\n" {
+		t.Fatalf("Unexpected dump %d:\n%s", code, out)
+	}
+	out.Reset()
+	if code := runTool([]string{"inspect", file}, out); code != 0 || !strings.Contains(out.String(), "length: 2\n") {
+		t.Fatalf("Unexpected inspect %d:\n%s", code, out)
+	}
+	if code := runTool([]string{"fix", file}, out); code != 2 {
+		t.Fatalf("Expect usage error for unknown tool, got %d", code)
+	}
+
+	// the tools refuse a file a queue has open
+	q, err := mqueue.OpenCompositionQueue(mqueue.CompositeQueueOption{
+		Name:          "jobs",
+		FileBlockUnit: 1024,
+		CacheSize:     128,
+		BackFile:      file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, tool := range []string{"verify", "repair"} {
+		out.Reset()
+		if code := runTool([]string{tool, file}, out); code != 1 || !strings.Contains(out.String(), mqueue.ErrLocked.Error()) {
+			t.Fatalf("Unexpected %s of a locked file %d:\n%s", tool, code, out)
+		}
+	}
+}
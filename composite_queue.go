@@ -1,32 +1,83 @@
 package mqueue
 
 import (
+	"bytes"
+	"context"
 	"os"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/edsrzf/mmap-go"
 )
 
 type CompositeQueueOption struct {
-	Name          string
-	CacheSize     uint64
-	BackFile      string
-	FileBlockUnit uint64
+	Name           string
+	CacheSize      uint64
+	BackFile       string // base name of the segment files, see SegmentPath
+	FileBlockUnit  uint64 // size of each segment file
+	Journal        bool   // if true, records in the memory queue are journaled to survive a crash
+	Fsync          FsyncPolicy
+	Recovery       RecoveryPolicy // what to do with corrupted records found on open
+	MaxMessageSize uint64         // largest message accepted by Put, 0 means MaxElementLength
+	MaxLength      uint64         // most messages the queue holds, 0 means unbounded
+	MaxBytes       uint64         // most bytes the queue holds, 0 means unbounded
+	Overflow       OverflowPolicy // what Put does when MaxLength or MaxBytes is reached
+	BlockTimeout   time.Duration  // how long Put waits for room with OverflowBlock, 0 means forever
+	// how long a message delivered by Reserve waits for Ack before it is
+	// delivered again, 0 means DefaultVisibilityTimeout
+	VisibilityTimeout time.Duration
+	TTL               time.Duration // how long messages live unless Put with a TTL, 0 means forever
+	KeepExpired       bool          // if true, expired messages are kept for TakeExpired
+	// how many times a message is delivered by Reserve before it is dead,
+	// 0 means no limit
+	MaxDeliveries int
+	KeepDead      bool // if true, dead messages are kept for TakeDead
+	// if true, the queue is a log read by consumer groups, see CreateGroup.
+	// Messages are kept until every group acknowledged them and can not be
+	// consumed otherwise.
+	Retain bool
+	// if set, called under the lock with every change of the stored messages,
+	// see Op. It must not call the queue.
+	Observer func(op Op)
+}
+
+// DeadLetter is a message which failed MaxDeliveries deliveries.
+type DeadLetter struct {
+	Data       []byte
+	Deliveries int
+	Reason     string // why the last delivery failed
 }
 
 // CompositeQueue is combine of a memory queue and memory map queue,
-// when the memory queue is full, it transfer to memory map queue
+// when the memory queue is full, it transfer to memory map queue.
+// The memory map queue is a sequence of fixed size segment files,
+// writes go to the last segment and fully consumed segments are removed.
 type CompositeQueue struct {
-	cacheQueue     MQueue               // memory queue
-	mapQueue       MQueue               // memory map file queue
-	mapFile        mmap.MMap            // memory map file correspond to memory map queue
-	option         CompositeQueueOption // options for this composite queue
-	readFromFile   bool                 // if true, pop operation should be go with memory map queue
-	backFileHandle *os.File             // file handle to memory map
-	lock           sync.Locker          // lock guard to protect concurrent access to this composite queue
-	dataChan       chan []byte          // a chan object help us implement "BRPOP" command.
-	deleted        bool
+	cacheQueue   MQueue               // memory queue
+	segments     []*segment           // memory map file segments, oldest first
+	journal      *journal             // write-ahead log of cacheQueue, nil unless option.Journal
+	inflight     *inflight            // messages delivered by Reserve and not acknowledged
+	delayed      *delayed             // messages put with PutAt which are not due yet
+	groups       *groups              // consumer groups, nil unless option.Retain
+	option       CompositeQueueOption // options for this composite queue
+	readFromFile bool                 // if true, pop operation should be go with memory map queue
+	lock         sync.Locker          // lock guard to protect concurrent access to this composite queue
+	dataChan     chan []byte          // a chan object help us implement "BRPOP" command.
+	deleted      bool
+	closed       bool          // producers do not wait for room anymore, see Interrupt
+	lastSync     time.Time     // when segments and journal were last synced
+	syncLatency  time.Duration // how long the last sync took
+	spaceChan    chan struct{} // closed when a message is consumed while producers wait for room
+	spaceWaiters int           // producers blocked on spaceChan
+	putChan      chan struct{} // closed when a message is put while consumers wait for one
+	putWaiters   int           // consumers blocked on putChan
+	evicted      uint64        // messages dropped by OverflowDropOldest
+	expired      uint64        // messages skipped because their TTL elapsed
+	expiredMsgs  [][]byte      // expired messages not taken yet, with option.KeepExpired
+	dead         uint64        // messages dropped after option.MaxDeliveries deliveries
+	deadLetters  []DeadLetter  // dead messages not taken yet, with option.KeepDead
 }
 
 func OpenCompositionQueue(option CompositeQueueOption) (*CompositeQueue, error) {
@@ -36,175 +87,1939 @@ func OpenCompositionQueue(option CompositeQueueOption) (*CompositeQueue, error)
 		readFromFile: false,
 		lock:         &sync.Mutex{},
 		dataChan:     make(chan []byte),
+		spaceChan:    make(chan struct{}),
+		putChan:      make(chan struct{}),
 	}
 	err := InitMQueue(m.cacheQueue)
 	if err != nil {
 		return nil, err
 	}
-	if err = m.mapBackFile(); err != nil {
+	if err = m.loadSegments(); err != nil {
+		return nil, err
+	}
+	if option.Journal {
+		if err = m.recoverJournal(); err != nil {
+			m.closeSegments()
+			return nil, err
+		}
+	}
+	if m.inflight, err = openInflight(InflightPath(option.BackFile)); err != nil {
+		log.WithFields(log.Fields{
+			"func":   "OpenCompositionQueue",
+			"option": option,
+		}).WithError(err).Error("failed to open in-flight log")
+		m.closeSink()
+		return nil, err
+	}
+	if m.delayed, err = openDelayed(DelayedPath(option.BackFile)); err != nil {
+		log.WithFields(log.Fields{
+			"func":   "OpenCompositionQueue",
+			"option": option,
+		}).WithError(err).Error("failed to open delayed messages log")
+		m.closeSink()
 		return nil, err
 	}
+	if option.Retain {
+		if m.groups, err = openGroups(GroupsPath(option.BackFile)); err != nil {
+			log.WithFields(log.Fields{
+				"func":   "OpenCompositionQueue",
+				"option": option,
+			}).WithError(err).Error("failed to open consumer groups log")
+			m.closeSink()
+			return nil, err
+		}
+	}
 	return m, nil
 }
 
+// recoverJournal opens the journal and brings back the memory queue it
+// describes, the recovered records are then moved to the segments.
+func (m *CompositeQueue) recoverJournal() error {
+	lf := log.Fields{
+		"func":   "CompositeQueue#recoverJournal",
+		"option": m.option,
+	}
+	j, err := openJournal(JournalPath(m.option.BackFile))
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to open journal")
+		return err
+	}
+	// m.journal is only set once replayed, so transferToDisk does not reset it
+	var recovered uint64
+	spilled := false
+	err = j.replay(func(data []byte, deadline int64) error {
+		recovered++
+		need := prefixSize + uint64(len(data))
+		if m.cacheQueue.freeSpace() < need {
+			spilled = true
+			if err := m.transferToDisk(); err != nil {
+				return err
+			}
+			if m.cacheQueue.freeSpace() < need {
+				return m.putToDisk(data, deadline)
+			}
+		}
+		return m.cacheQueue.PutDeadline(data, deadline)
+	}, func() {
+		if m.cacheQueue.Len() > 0 {
+			recovered--
+			m.cacheQueue.discard()
+		}
+	}, func(seq, count uint64) {
+		// the oldest records are in the segments already, unless some were
+		// spilled above, then they are kept twice rather than risk a loss
+		for n := m.writtenSince(seq, count); n > 0 && !spilled && m.cacheQueue.Len() > 0; n-- {
+			recovered--
+			m.cacheQueue.discard()
+		}
+	})
+	if err == nil {
+		err = m.transferToDisk()
+	}
+	if err == nil {
+		err = j.reset()
+	}
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to replay journal")
+		j.close()
+		return err
+	}
+	if recovered > 0 {
+		log.WithFields(lf).Infof("recovered %d records from journal", recovered)
+	}
+	m.journal = j
+	return nil
+}
+
+// writtenSince returns how many records were written to the segments after
+// the seq-th one had count records written.
+func (m *CompositeQueue) writtenSince(seq, count uint64) uint64 {
+	var n uint64
+	for _, s := range m.segments {
+		if s.seq == seq && s.queue.WriteCount() > count {
+			n += s.queue.WriteCount() - count
+		} else if s.seq > seq {
+			n += s.queue.WriteCount()
+		}
+	}
+	return n
+}
+
 func (m *CompositeQueue) Chan() <-chan []byte {
 	return m.dataChan
 }
 
-func (m *CompositeQueue) mapBackFile() (err error) {
+// loadSegments maps every existing segment of this queue, or creates the
+// first one for a new queue.
+func (m *CompositeQueue) loadSegments() error {
 	lf := log.Fields{
-		"func":   "CompositeQueue#mapBackFile",
+		"func":   "CompositeQueue#loadSegments",
 		"option": m.option,
 	}
-	m.backFileHandle, err = os.OpenFile(m.option.BackFile, os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		log.WithFields(lf).WithError(err).Error("failed to open file")
-		return
-	}
-	stat, err := m.backFileHandle.Stat()
+	seqs, err := listSegments(m.option.BackFile)
 	if err != nil {
-		log.WithFields(lf).WithError(err).Error("failed to stat file")
+		log.WithFields(lf).WithError(err).Error("failed to list segments")
 		return err
 	}
-	loadSize := stat.Size()
-	if loadSize == 0 {
-		if err = m.backFileHandle.Truncate(int64(m.option.FileBlockUnit)); err != nil {
-			log.WithFields(lf).WithError(err).Error("failed to truncate file")
+	var records uint64
+	for _, seq := range seqs {
+		path := SegmentPath(m.option.BackFile, seq)
+		if seq == 0 {
+			path = m.option.BackFile
+		}
+		version, err := UpgradeFile(path)
+		if err != nil {
+			log.WithFields(lf).WithError(err).Errorf("failed to check format of segment %s", path)
+			m.closeSegments()
+			return err
+		}
+		if version != FormatVersion {
+			log.WithFields(lf).Infof("upgraded segment %s from format v%d to v%d", path, version, FormatVersion)
+		}
+		s, err := openSegment(path, seq, m.option.FileBlockUnit)
+		if err != nil {
+			log.WithFields(lf).WithError(err).Errorf("failed to open segment %s", path)
+			m.closeSegments()
+			return err
+		}
+		m.segments = append(m.segments, s)
+		report, err := s.queue.Recover(m.option.Recovery)
+		if report.Corrupted() {
+			log.WithFields(lf).WithFields(log.Fields{
+				"segment":      path,
+				"policy":       m.option.Recovery,
+				"records":      report.Records,
+				"badRecords":   report.BadRecords,
+				"droppedBytes": report.DroppedBytes,
+				"countFixed":   report.CountFixed,
+			}).Warn("corrupted segment")
+		}
+		if err != nil {
+			log.WithFields(lf).WithError(err).Errorf("refused to open segment %s", path)
+			m.closeSegments()
+			return err
+		}
+		s.dirty = report.Corrupted()
+		records += report.Records
+		if s.queue.Len() > 0 {
+			m.readFromFile = true
+		}
+	}
+	if len(seqs) > 0 {
+		log.WithFields(lf).Infof("verified %d records in %d segments", records, len(seqs))
+	}
+	if len(m.segments) == 0 {
+		if _, err = m.appendSegment(m.option.FileBlockUnit); err != nil {
+			log.WithFields(lf).WithError(err).Error("failed to create segment")
 			return err
 		}
 	}
-	m.mapFile, err = mmap.Map(m.backFileHandle, mmap.RDWR, 0)
+	m.dropConsumedSegments()
+	return nil
+}
+
+// appendSegment creates a new segment of size bytes after the last one.
+func (m *CompositeQueue) appendSegment(size uint64) (*segment, error) {
+	var seq uint64 = 1
+	if n := len(m.segments); n > 0 {
+		seq = m.segments[n-1].seq + 1
+	}
+	s, err := openSegment(SegmentPath(m.option.BackFile, seq), seq, size)
 	if err != nil {
-		return
+		return nil, err
 	}
+	m.segments = append(m.segments, s)
+	return s, nil
+}
 
-	m.mapQueue = []byte(m.mapFile)
-	if loadSize == 0 {
-		err = InitMQueue(m.mapQueue)
-	} else {
-		m.readFromFile = true
+// tail returns the last segment, which takes the writes. A segment drained
+// and reset since a snapshot captured it is replaced by a new file first:
+// the snapshot still reads the former one, which the writes would overwrite.
+func (m *CompositeQueue) tail() (*segment, error) {
+	s := m.segments[len(m.segments)-1]
+	if s.queue.WritePosition() >= s.capture {
+		return s, nil
+	}
+	fresh, err := createSegment(s.path, s.seq, m.option.FileBlockUnit)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.close(); err != nil {
+		log.Printf("Failed to close segment %s: %v\n", s.path, err)
 	}
+	m.segments[len(m.segments)-1] = fresh
+	return fresh, nil
+}
 
-	return
+// dropConsumedSegments removes the leading segments whose records have all
+// been read, the last segment is kept for new writes.
+func (m *CompositeQueue) dropConsumedSegments() {
+	for len(m.segments) > 1 && m.segments[0].queue.Len() == 0 {
+		s := m.segments[0]
+		if err := s.remove(); err != nil {
+			log.Printf("Failed to remove segment %s: %v\n", s.path, err)
+			return
+		}
+		m.segments[0] = nil
+		m.segments = m.segments[1:]
+	}
 }
 
+// Get copies the oldest message into buff and consumes it. If buff is too
+// small, ErrBufferTooSmall is returned and the message stays in the queue.
 func (m *CompositeQueue) Get(buff []byte) (int, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.deleted {
 		return 0, ErrEmpty
 	}
-	if m.readFromFile {
-		n, err := m.mapQueue.Get(buff)
-		if err == ErrEmpty {
-			m.readFromFile = false
-			return m.cacheQueue.Get(buff)
-		}
-		return n, err
+	if m.groups != nil {
+		return 0, ErrRetained
 	}
-	return m.cacheQueue.Get(buff)
+	data, err := m.front()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > len(buff) {
+		return 0, ErrBufferTooSmall
+	}
+	n := copy(buff, data)
+	m.discardFront()
+	m.commitOrLog()
+	return n, nil
 }
 
-func (m *CompositeQueue) Put(data []byte) error {
+// Pop consumes the oldest message and returns it appended to buff[:0],
+// buff is grown when the message does not fit.
+func (m *CompositeQueue) Pop(buff []byte) ([]byte, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.deleted {
-		return ErrNoSpace
+		return buff[:0], ErrEmpty
 	}
-	if !m.readFromFile {
-		select {
-		case m.dataChan <- data:
+	if m.groups != nil {
+		return buff[:0], ErrRetained
+	}
+	data, err := m.front()
+	if err != nil {
+		return buff[:0], err
+	}
+	buff = append(buff[:0], data...)
+	m.discardFront()
+	m.commitOrLog()
+	return buff, nil
+}
+
+// Peek returns the oldest message appended to buff[:0] without consuming it.
+func (m *CompositeQueue) Peek(buff []byte) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return buff[:0], ErrEmpty
+	}
+	data, err := m.front()
+	if err != nil {
+		return buff[:0], err
+	}
+	return append(buff[:0], data...), nil
+}
+
+// Index returns a copy of the message at index i, 0 is the oldest message
+// and negative indexes count from the newest, -1 being the newest.
+// ErrEmpty is returned if there is no such message.
+func (m *CompositeQueue) Index(i int64) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return nil, ErrEmpty
+	}
+	n := int64(m.length())
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return nil, ErrEmpty
+	}
+	var res []byte
+	err := m.walk(uint64(i), uint64(i), func(data []byte) bool {
+		res = append([]byte{}, data...)
+		return false
+	})
+	return res, err
+}
+
+// Range returns copies of the messages from index start to stop, both
+// included, oldest first. Indexes are those of Index, out of range indexes
+// are clamped to the queue like LRANGE does.
+func (m *CompositeQueue) Range(start, stop int64) ([][]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return nil, nil
+	}
+	n := int64(m.length())
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return nil, nil
+	}
+	res := make([][]byte, 0, stop-start+1)
+	err := m.walk(uint64(start), uint64(stop), func(data []byte) bool {
+		res = append(res, append([]byte{}, data...))
+		return true
+	})
+	return res, err
+}
+
+// walk calls fn with the messages from index start to stop, oldest first,
+// going through the segments and then the memory queue.
+func (m *CompositeQueue) walk(start, stop uint64, fn func(data []byte) bool) error {
+	// released messages come first, they are delivered again before the others
+	ready := uint64(len(m.inflight.ready))
+	for i := start; i < ready && i <= stop; i++ {
+		if !fn(m.inflight.ready[i].data) {
 			return nil
-		default:
-			break
 		}
 	}
-
-	err := m.cacheQueue.Put(data)
-	if err == nil {
+	if stop < ready {
 		return nil
 	}
-	if err == ErrNoSpace {
-		if err = m.transferToDisk(); err == nil {
-			return m.cacheQueue.Put(data)
+	queues := make([]MQueue, 0, len(m.segments)+1)
+	if m.readFromFile {
+		for _, s := range m.segments {
+			queues = append(queues, s.queue)
 		}
 	}
-	return err
+	queues = append(queues, m.cacheQueue)
+	base := ready
+	for _, q := range queues {
+		n := q.Len()
+		if base+n <= start {
+			base += n
+			continue
+		}
+		more := true
+		from := uint64(0)
+		if start > base {
+			from = start - base
+		}
+		err := q.Range(from, stop-base, func(data []byte) bool {
+			more = fn(data)
+			return more
+		})
+		if err != nil || !more {
+			return err
+		}
+		base += n
+		if base > stop {
+			return nil
+		}
+	}
+	return nil
 }
 
-func (m *CompositeQueue) transferToDisk() (err error) {
-	if m.mapQueue.freeSpace() < m.cacheQueue.ReadableBytes() {
-		newSize := m.mapQueue.Capacity() + m.option.FileBlockUnit
-		log.Printf("Try to expand %s to %d\n", m.option.BackFile, newSize)
-		if err = m.backFileHandle.Truncate(int64(newSize)); err != nil {
-			return
-		}
-		err = m.mapFile.Flush()
-		err = m.mapFile.Unmap()
-		m.mapFile, err = mmap.Map(m.backFileHandle, mmap.RDWR, 0)
+// front returns the oldest message which did not expire, the expired messages
+// before it are consumed and counted.
+func (m *CompositeQueue) front() ([]byte, error) {
+	return m.frontAt(0)
+}
+
+// frontAt is front at the time now in unix nanoseconds, 0 means the current
+// time.
+func (m *CompositeQueue) frontAt(now int64) ([]byte, error) {
+	for {
+		data, err := m.head()
 		if err != nil {
-			return
+			return nil, err
+		}
+		deadline := m.frontDeadline()
+		if deadline == 0 {
+			return data, nil
+		}
+		if now == 0 {
+			now = time.Now().UnixNano()
+		}
+		if deadline > now {
+			return data, nil
+		}
+		m.expired++
+		if m.option.KeepExpired {
+			m.expiredMsgs = append(m.expiredMsgs, append([]byte{}, data...))
 		}
-		m.mapQueue = []byte(m.mapFile)
-		m.mapQueue.setCapacity(newSize)
+		m.discardFront()
 	}
+}
 
-	if err = m.cacheQueue.WriteTo(m.mapQueue); err == nil {
-		m.readFromFile = true
+// frontDeadline returns the expiry time of the message returned by head.
+func (m *CompositeQueue) frontDeadline() int64 {
+	if len(m.inflight.ready) > 0 {
+		return 0
+	}
+	if m.readFromFile {
+		return m.segments[0].queue.frontDeadline()
 	}
-	return
+	return m.cacheQueue.frontDeadline()
 }
 
-func (m *CompositeQueue) Len() uint64 {
+// head returns the oldest message. Released messages come first, then the
+// segments if any of them has records and the memory queue otherwise.
+func (m *CompositeQueue) head() ([]byte, error) {
+	if len(m.inflight.ready) > 0 {
+		return m.inflight.ready[0].data, nil
+	}
+	if m.readFromFile {
+		data, err := m.segments[0].queue.front()
+		if err != ErrEmpty {
+			return data, err
+		}
+		m.readFromFile = false
+	}
+	return m.cacheQueue.front()
+}
+
+// discardFront consumes the message returned by front.
+func (m *CompositeQueue) discardFront() {
+	if m.groups != nil {
+		m.groups.base++
+	}
+	if len(m.inflight.ready) > 0 {
+		m.inflight.popReady()
+	} else if m.readFromFile {
+		m.observe(Op{Kind: OpDiscard})
+		m.segments[0].queue.discard()
+		m.segments[0].dirty = true
+		m.dropConsumedSegments()
+	} else {
+		m.observe(Op{Kind: OpDiscard})
+		m.cacheQueue.discard()
+		if m.journal != nil {
+			if m.cacheQueue.Len() == 0 {
+				if err := m.journal.reset(); err != nil {
+					log.Printf("Failed to reset journal %s: %v\n", m.option.Name, err)
+				}
+			} else {
+				m.journal.get()
+			}
+		}
+	}
+	m.signalSpace()
+}
+
+// Reserve consumes the oldest message like Pop, but keeps it in flight until
+// Ack is called with the returned id. If the visibility timeout elapses
+// first, RequeueExpired delivers the message again ahead of the queue.
+func (m *CompositeQueue) Reserve(buff []byte) (uint64, []byte, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	if m.deleted {
-		return 0
+		return 0, buff[:0], ErrEmpty
 	}
-	if m.readFromFile {
-		return m.cacheQueue.Len() + m.mapQueue.Len()
+	if m.groups != nil {
+		return 0, buff[:0], ErrRetained
+	}
+	data, err := m.front()
+	if err != nil {
+		return 0, buff[:0], err
+	}
+	buff = append(buff[:0], data...)
+	deadline := time.Now().Add(m.visibilityTimeout())
+	var p *pending
+	if len(m.inflight.ready) > 0 {
+		p = m.inflight.renew(deadline)
+		m.signalSpace()
+	} else {
+		p = m.inflight.lease(buff, deadline)
+		m.discardFront()
 	}
-	return m.cacheQueue.Len()
+	m.commitOrLog()
+	return p.id, buff, nil
 }
 
-func (m *CompositeQueue) closeSink() error {
+// Track keeps data in flight as if it was returned by Reserve, it is meant
+// for messages received from Chan.
+func (m *CompositeQueue) Track(data []byte) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return 0, ErrDeleted
+	}
+	p := m.inflight.lease(data, time.Now().Add(m.visibilityTimeout()))
+	return p.id, m.commit()
+}
 
-	err := m.transferToDisk()
-	if err != nil {
-		log.Printf("Failed to transfer to disk %s: %v\n", m.option.Name, err)
+// Ack removes the message id from the in-flight set, it returns false if
+// no such message is in flight, e.g. its lease expired.
+func (m *CompositeQueue) Ack(id uint64) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted || !m.inflight.done(id) {
+		return false, nil
 	}
-	if err = m.mapFile.Unmap(); err != nil {
-		log.Printf("Failed to Unmap %s: %v\n", m.option.Name, err)
+	return true, m.commit()
+}
+
+// Release delivers the message id again right away, e.g. because its
+// consumer went away. It returns false if no such message is in flight.
+func (m *CompositeQueue) Release(id uint64) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted || !m.redeliver(id) {
+		return false, nil
 	}
-	if err = m.backFileHandle.Close(); err != nil {
-		log.Printf("Failed to close file %s: %v\n", m.option.Name, err)
+	return true, m.commit()
+}
+
+// Nack reports that the message id could not be processed, for reason. The
+// message is delivered again, unless it was delivered option.MaxDeliveries
+// times already in which case it is dead. It returns false if no such message
+// is in flight.
+func (m *CompositeQueue) Nack(id uint64, reason string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted || !m.retry(id, reason) {
+		return false, nil
 	}
-	return err
+	return true, m.commit()
 }
 
-func (m *CompositeQueue) Close() error {
+// RequeueExpired delivers again the messages whose lease expired before now,
+// and returns how many there were. Like Nack, it counts as a failed delivery.
+func (m *CompositeQueue) RequeueExpired(now time.Time) int {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	return m.closeSink()
+	if m.deleted {
+		return 0
+	}
+	ids := m.inflight.expired(now)
+	for _, id := range ids {
+		m.retry(id, "visibility timeout expired")
+	}
+	if len(ids) > 0 {
+		m.commitOrLog()
+	}
+	return len(ids)
 }
 
-func (m *CompositeQueue) Delete() error {
+// InFlight returns how many messages are reserved and not acknowledged.
+func (m *CompositeQueue) InFlight() int {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	lf := log.Fields{
-		"func":     "CompositeQueue#Delete()",
-		"backFile": m.option.BackFile,
-		"name":     m.option.Name,
+	if m.deleted {
+		return 0
+	}
+	return len(m.inflight.leased)
+}
+
+// Dead returns how many messages were dropped after too many deliveries.
+func (m *CompositeQueue) Dead() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.dead
+}
+
+// KeptDead returns how many dead messages wait for TakeDead or MoveDead.
+func (m *CompositeQueue) KeptDead() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.deadLetters)
+}
+
+// TakeDead returns the dead messages dropped since the last call, they are
+// only kept with option.KeepDead.
+func (m *CompositeQueue) TakeDead() []DeadLetter {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := m.deadLetters
+	m.deadLetters = nil
+	return res
+}
+
+// retry delivers the leased message id again, or drops it if it reached
+// option.MaxDeliveries.
+func (m *CompositeQueue) retry(id uint64, reason string) bool {
+	p, ok := m.inflight.leased[id]
+	if !ok {
+		return false
+	}
+	if m.option.MaxDeliveries <= 0 || int(p.deliveries) < m.option.MaxDeliveries {
+		return m.redeliver(id)
+	}
+	m.dead++
+	if m.option.KeepDead {
+		m.deadLetters = append(m.deadLetters, DeadLetter{
+			Data:       p.data,
+			Deliveries: int(p.deliveries),
+			Reason:     reason,
+		})
+	}
+	return m.inflight.done(id)
+}
+
+// redeliver puts the leased message id back at the head of the queue, or
+// hands it to a blocked consumer if the queue is empty.
+func (m *CompositeQueue) redeliver(id uint64) bool {
+	p, ok := m.inflight.leased[id]
+	if !ok {
+		return false
+	}
+	if m.length() == 0 {
+		select {
+		case m.dataChan <- p.data:
+			return m.inflight.done(id)
+		default:
+		}
+	}
+	m.signalPut()
+	return m.inflight.release(id)
+}
+
+func (m *CompositeQueue) visibilityTimeout() time.Duration {
+	if m.option.VisibilityTimeout > 0 {
+		return m.option.VisibilityTimeout
+	}
+	return DefaultVisibilityTimeout
+}
+
+// signalSpace wakes up the producers waiting for room.
+func (m *CompositeQueue) signalSpace() {
+	if m.spaceWaiters > 0 {
+		close(m.spaceChan)
+		m.spaceChan = make(chan struct{})
+	}
+}
+
+// signalPut wakes up the consumers waiting for a message.
+func (m *CompositeQueue) signalPut() {
+	if m.putWaiters > 0 {
+		close(m.putChan)
+		m.putChan = make(chan struct{})
 	}
-	err := m.closeSink()
+}
+
+// MoveTo consumes the oldest message and puts it in dst as a single step,
+// no other operation on either queue sees the message in both or in none.
+// If dst refuses the message, e.g. with ErrQueueFull, it stays in m. A dst
+// with OverflowBlock does not wait for room, ErrQueueFull is returned.
+// The message is made durable in dst before it is consumed from m, so a
+// crash in between may leave it in both queues but never in none.
+func (m *CompositeQueue) MoveTo(dst *CompositeQueue) ([]byte, error) {
+	unlock := lockPair(m, dst)
+	defer unlock()
+	if err := m.checkMove(dst); err != nil {
+		return nil, err
+	}
+	front, err := m.front()
 	if err != nil {
-		log.WithFields(lf).WithError(err).Error("failed to close queue")
+		return nil, err
+	}
+	// front points into m, which is overwritten once consumed
+	data := append([]byte{}, front...)
+	return data, m.moveFront(dst, data, time.Now())
+}
+
+// MoveFront is MoveTo putting data in dst in place of the oldest message,
+// which must still be front, ErrChanged is returned otherwise.
+func (m *CompositeQueue) MoveFront(dst *CompositeQueue, front, data []byte) error {
+	unlock := lockPair(m, dst)
+	defer unlock()
+	if err := m.checkMove(dst); err != nil {
+		return err
 	}
-	err = os.Remove(m.option.BackFile)
+	cur, err := m.front()
 	if err != nil {
-		log.WithFields(lf).WithError(err).Error("failed to delete file")
+		return err
+	}
+	if !bytes.Equal(cur, front) {
+		return ErrChanged
+	}
+	return m.moveFront(dst, append([]byte{}, data...), time.Now())
+}
+
+// MoveDead puts the dead messages kept since the last call in dst, encoded
+// by encode, as a single step and returns how many were moved. The messages
+// dst refuses stay in m for the next call.
+func (m *CompositeQueue) MoveDead(dst *CompositeQueue, encode func(d DeadLetter) []byte) (int, error) {
+	unlock := lockPair(m, dst)
+	defer unlock()
+	if len(m.deadLetters) == 0 {
+		return 0, nil
+	}
+	if dst.deleted {
+		return 0, ErrDeleted
+	}
+	n := 0
+	var err error
+	for _, d := range m.deadLetters {
+		data := encode(d)
+		if dst.option.Overflow == OverflowBlock && dst.overflows(len(data)) {
+			// waiting for room would hold the lock of m
+			err = ErrQueueFull
+			break
+		}
+		if err = dst.put(data, dst.deadline(0)); err != nil {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		if cErr := dst.commit(); err == nil {
+			err = cErr
+		}
+	}
+	m.deadLetters = m.deadLetters[n:]
+	if len(m.deadLetters) == 0 {
+		m.deadLetters = nil
+	}
+	return n, err
+}
+
+// checkMove tells whether the oldest message of m may move to dst, the
+// caller holds the locks of both.
+func (m *CompositeQueue) checkMove(dst *CompositeQueue) error {
+	if m.deleted {
+		return ErrEmpty
+	}
+	if m.groups != nil {
+		return ErrRetained
+	}
+	if dst.deleted {
+		return ErrDeleted
+	}
+	return nil
+}
+
+// moveFront consumes the oldest message of m and puts data, a copy of it
+// or what replaces it, in dst, expiring after the TTL of dst from now if it
+// had no expiry. The caller holds the locks of both.
+func (m *CompositeQueue) moveFront(dst *CompositeQueue, data []byte, now time.Time) error {
+	deadline := m.frontDeadline()
+	if m == dst {
+		// the message only changes its place, the copy is stored past the
+		// limits so a full queue can still rotate, and the message is only
+		// consumed once the copy is stored
+		if err := m.store(data, deadline); err != nil {
+			return err
+		}
+		m.discardFront()
+		return m.commit()
+	}
+	if dst.option.Overflow == OverflowBlock && dst.overflows(len(data)) {
+		// waiting for room would hold the lock of m
+		return ErrQueueFull
+	}
+	if deadline == 0 {
+		deadline = dst.deadlineAt(0, now)
+	}
+	if err := dst.put(data, deadline); err != nil {
+		return err
+	}
+	err := dst.commit()
+	m.discardFront()
+	m.commitOrLog()
+	return err
+}
+
+// WaitMoveTo is MoveTo, waiting for a message until ctx is done, in which
+// case ErrEmpty is returned.
+func (m *CompositeQueue) WaitMoveTo(ctx context.Context, dst *CompositeQueue) ([]byte, error) {
+	return WaitMoveFirst(ctx, []*CompositeQueue{m}, dst)
+}
+
+// MoveFirst is MoveTo from the first queue of srcs which has a message.
+func MoveFirst(srcs []*CompositeQueue, dst *CompositeQueue) ([]byte, error) {
+	for _, src := range srcs {
+		data, err := src.MoveTo(dst)
+		if err != ErrEmpty {
+			return data, err
+		}
+	}
+	return nil, ErrEmpty
+}
+
+// WaitMoveFirst is MoveFirst, waiting for a message in any of srcs until ctx
+// is done, in which case ErrEmpty is returned.
+func WaitMoveFirst(ctx context.Context, srcs []*CompositeQueue, dst *CompositeQueue) ([]byte, error) {
+	for {
+		data, err := MoveFirst(srcs, dst)
+		if err != ErrEmpty {
+			return data, err
+		}
+		err = nil
+		cases := make([]reflect.SelectCase, 0, len(srcs)+1)
+		waiting := make([]*CompositeQueue, 0, len(srcs))
+		arrived := false
+		for _, src := range srcs {
+			src.lock.Lock()
+			if src.deleted {
+				src.lock.Unlock()
+				continue
+			}
+			if src.length() > 0 {
+				// a message came in since MoveFirst
+				src.lock.Unlock()
+				arrived = true
+				break
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(src.putChan)})
+			src.putWaiters++
+			src.lock.Unlock()
+			waiting = append(waiting, src)
+		}
+		if !arrived && len(waiting) == 0 {
+			return nil, ErrEmpty
+		}
+		if !arrived {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+			chosen, _, _ := reflect.Select(cases)
+			if chosen == len(waiting) {
+				err = ErrEmpty
+			}
+		}
+		for _, src := range waiting {
+			src.lock.Lock()
+			src.putWaiters--
+			src.lock.Unlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lockPair locks a and b, always in the same order so two moves in opposite
+// directions do not deadlock, and returns the function unlocking them.
+func lockPair(a, b *CompositeQueue) func() {
+	if a == b {
+		a.lock.Lock()
+		return a.lock.Unlock
+	}
+	if b.option.BackFile < a.option.BackFile {
+		a, b = b, a
+	}
+	a.lock.Lock()
+	b.lock.Lock()
+	return func() {
+		b.lock.Unlock()
+		a.lock.Unlock()
+	}
+}
+
+// overflows tells whether adding a message of n bytes exceeds the limits.
+func (m *CompositeQueue) overflows(n int) bool {
+	if m.option.MaxLength > 0 && m.length()+1 > m.option.MaxLength {
+		return true
+	}
+	return m.option.MaxBytes > 0 && m.size()+prefixSize+uint64(n) > m.option.MaxBytes
+}
+
+// makeRoom applies the overflow policy until a message of n bytes fits,
+// it may release the lock while waiting for consumers.
+func (m *CompositeQueue) makeRoom(n int) error {
+	if m.option.MaxBytes > 0 && prefixSize+uint64(n) > m.option.MaxBytes {
+		return ErrQueueFull
+	}
+	var timeout <-chan time.Time
+	if m.option.Overflow == OverflowBlock && m.option.BlockTimeout > 0 {
+		timer := time.NewTimer(m.option.BlockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for m.overflows(n) {
+		switch m.option.Overflow {
+		case OverflowDropOldest:
+			if _, err := m.front(); err != nil {
+				return err
+			}
+			m.discardFront()
+			m.evicted++
+		case OverflowBlock:
+			if m.closed {
+				return ErrClosed
+			}
+			space := m.spaceChan
+			m.spaceWaiters++
+			m.lock.Unlock()
+			timedOut := false
+			select {
+			case <-space:
+			case <-timeout:
+				timedOut = true
+			}
+			m.lock.Lock()
+			m.spaceWaiters--
+			if m.deleted {
+				return ErrDeleted
+			}
+			if m.closed {
+				return ErrClosed
+			}
+			if timedOut {
+				return ErrQueueFull
+			}
+		default:
+			return ErrQueueFull
+		}
+	}
+	return nil
+}
+
+func (m *CompositeQueue) Put(data []byte) error {
+	return m.PutTTL(data, 0)
+}
+
+// PutTTL puts data which expires after ttl, 0 means option.TTL. Get and the
+// other consuming methods skip and count expired messages.
+func (m *CompositeQueue) PutTTL(data []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return ErrDeleted
+	}
+	if err := m.put(data, m.deadline(ttl)); err != nil {
+		return err
+	}
+	return m.commit()
+}
+
+// deadline returns the expiry time of a message put now with ttl, 0 means
+// option.TTL, in unix nanoseconds. It is 0 if the message never expires.
+func (m *CompositeQueue) deadline(ttl time.Duration) int64 {
+	return m.deadlineAt(ttl, time.Now())
+}
+
+// deadlineAt is deadline for a message put at the time now.
+func (m *CompositeQueue) deadlineAt(ttl time.Duration, now time.Time) int64 {
+	if ttl == 0 {
+		ttl = m.option.TTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
+
+// Expired returns how many messages were skipped because they expired.
+func (m *CompositeQueue) Expired() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.expired
+}
+
+// TakeExpired returns the expired messages skipped since the last call, they
+// are only kept with option.KeepExpired.
+func (m *CompositeQueue) TakeExpired() [][]byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := m.expiredMsgs
+	m.expiredMsgs = nil
+	return res
+}
+
+// PutAt puts data in the queue once at is reached, until then the message is
+// kept aside and is not visible to Get, Len or Range. DeliverDue does the put.
+func (m *CompositeQueue) PutAt(data []byte, at time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return ErrDeleted
+	}
+	if !at.After(time.Now()) {
+		if err := m.put(data, m.deadline(0)); err != nil {
+			return err
+		}
+		return m.commit()
+	}
+	if uint64(len(data)) > m.maxMessageSize() {
+		return ErrPacketTooLarge
+	}
+	m.delayed.add(data, at)
+	return m.commit()
+}
+
+// DeliverDue puts in the queue the delayed messages due at now, and returns
+// how many there were. A message which does not fit in the limits of the
+// queue, unless they drop the oldest messages, waits for the next call.
+func (m *CompositeQueue) DeliverDue(now time.Time) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return 0
+	}
+	n := 0
+	for t := m.delayed.next(); t != nil && !t.due.After(now); t = m.delayed.next() {
+		if m.overflows(int(t.length)) && m.option.Overflow != OverflowDropOldest {
+			break
+		}
+		data, err := m.delayed.message(t)
+		if err == nil {
+			err = m.put(data, m.deadline(0))
+		}
+		if err != nil {
+			log.Printf("Failed to deliver delayed message %s: %v\n", m.option.Name, err)
+			break
+		}
+		m.delayed.pop()
+		n++
+	}
+	if n > 0 {
+		m.commitOrLog()
+	}
+	return n
+}
+
+// Delayed returns how many messages put with PutAt are not due yet.
+func (m *CompositeQueue) Delayed() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return 0
+	}
+	return len(m.delayed.timers)
+}
+
+// CreateGroup adds the consumer group name to a queue in log mode, the group
+// reads the messages from offset on. An offset before the oldest message kept
+// starts at that message, one past the newest message, e.g. math.MaxUint64,
+// starts with the next message put.
+func (m *CompositeQueue) CreateGroup(name string, offset uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return err
+	}
+	if _, ok := m.groups.groups[name]; ok {
+		return ErrGroupExists
+	}
+	if offset < m.groups.base {
+		offset = m.groups.base
+	}
+	if end := m.groups.base + m.length(); offset > end {
+		offset = end
+	}
+	m.groups.create(name, offset)
+	return m.commit()
+}
+
+// DestroyGroup drops the consumer group name, it returns false if there is
+// no such group.
+func (m *CompositeQueue) DestroyGroup(name string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return false, err
+	}
+	if _, ok := m.groups.groups[name]; !ok {
+		return false, nil
+	}
+	m.groups.destroy(name)
+	m.truncate()
+	return true, m.commit()
+}
+
+// ReadGroup returns up to max messages the consumer group name did not read
+// yet, oldest first. They are pending until AckGroup is called with their
+// offset, or acknowledged right away if noAck is true. The pending messages
+// are read again once the queue is reopened.
+func (m *CompositeQueue) ReadGroup(name string, max int, noAck bool) ([]Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return nil, err
+	}
+	gr, ok := m.groups.groups[name]
+	if !ok {
+		return nil, ErrNoGroup
+	}
+	entries, err := m.readFrom(gr.next, max)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	gr.next = entries[len(entries)-1].Offset + 1
+	if noAck {
+		m.groups.commit(name)
+		m.truncate()
+	} else {
+		for _, e := range entries {
+			gr.pending[e.Offset] = struct{}{}
+		}
+	}
+	return entries, m.commit()
+}
+
+// WaitReadGroup is ReadGroup which waits for a message when the group read
+// them all, until ctx is done.
+func (m *CompositeQueue) WaitReadGroup(ctx context.Context, name string, max int, noAck bool) ([]Entry, error) {
+	for {
+		entries, err := m.ReadGroup(name, max, noAck)
+		if err != nil || len(entries) > 0 {
+			return entries, err
+		}
+		m.lock.Lock()
+		if m.deleted {
+			m.lock.Unlock()
+			return nil, nil
+		}
+		if gr, ok := m.groups.groups[name]; !ok || gr.next < m.groups.base+m.length() {
+			// a message came in, or the group is gone, since ReadGroup
+			m.lock.Unlock()
+			continue
+		}
+		put := m.putChan
+		m.putWaiters++
+		m.lock.Unlock()
+		done := false
+		select {
+		case <-put:
+		case <-ctx.Done():
+			done = true
+		}
+		m.lock.Lock()
+		m.putWaiters--
+		m.lock.Unlock()
+		if done {
+			return nil, nil
+		}
+	}
+}
+
+// PendingGroup returns up to max of the messages from offset from on which the
+// consumer group name read and did not acknowledge, oldest first.
+func (m *CompositeQueue) PendingGroup(name string, from uint64, max int) ([]Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return nil, err
+	}
+	gr, ok := m.groups.groups[name]
+	if !ok {
+		return nil, ErrNoGroup
+	}
+	offsets := make([]uint64, 0, len(gr.pending))
+	for offset := range gr.pending {
+		if offset >= from && offset >= m.groups.base {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	var entries []Entry
+	for _, offset := range offsets {
+		if len(entries) >= max {
+			break
+		}
+		i := offset - m.groups.base
+		err := m.walk(i, i, func(data []byte) bool {
+			entries = append(entries, Entry{Offset: offset, Data: append([]byte{}, data...)})
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// AckGroup acknowledges the messages at offsets read by the consumer group
+// name, and returns how many were pending. The messages every group
+// acknowledged are dropped.
+func (m *CompositeQueue) AckGroup(name string, offsets ...uint64) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return 0, err
+	}
+	if _, ok := m.groups.groups[name]; !ok {
+		return 0, ErrNoGroup
+	}
+	n := 0
+	for _, offset := range offsets {
+		if m.groups.ack(name, offset) {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	m.truncate()
+	return n, m.commit()
+}
+
+// Groups returns the names of the consumer groups, sorted.
+func (m *CompositeQueue) Groups() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted || m.groups == nil {
+		return nil
+	}
+	return m.groups.names()
+}
+
+// Bounds returns the offset of the oldest message of a queue in log mode and
+// the offset the next message put gets.
+func (m *CompositeQueue) Bounds() (uint64, uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return 0, 0, err
+	}
+	return m.groups.base, m.groups.base + m.length(), nil
+}
+
+// ReadFrom returns copies of up to max messages of a queue in log mode from
+// offset on, oldest first. An offset before the oldest message starts at it.
+func (m *CompositeQueue) ReadFrom(offset uint64, max int) ([]Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return nil, err
+	}
+	return m.readFrom(offset, max)
+}
+
+func (m *CompositeQueue) readFrom(offset uint64, max int) ([]Entry, error) {
+	base := m.groups.base
+	if offset < base {
+		// the messages were dropped before they were read
+		offset = base
+	}
+	end := base + m.length()
+	if offset >= end || max <= 0 {
+		return nil, nil
+	}
+	stop := offset + uint64(max) - 1
+	if stop >= end {
+		stop = end - 1
+	}
+	entries := make([]Entry, 0, stop-offset+1)
+	err := m.walk(offset-base, stop-base, func(data []byte) bool {
+		entries = append(entries, Entry{Offset: offset, Data: append([]byte{}, data...)})
+		offset++
+		return true
+	})
+	return entries, err
+}
+
+// Search returns the offset of the first message of a queue in log mode for
+// which fn is true, or the offset the next message put gets if there is none.
+// Like sort.Search, fn must be false then true over the queue. The data of the
+// entry is only valid during the call.
+func (m *CompositeQueue) Search(fn func(e Entry) bool) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return 0, err
+	}
+	base := m.groups.base
+	var err error
+	i := sort.Search(int(m.length()), func(i int) bool {
+		found := true
+		if wErr := m.walk(uint64(i), uint64(i), func(data []byte) bool {
+			found = fn(Entry{Offset: base + uint64(i), Data: data})
+			return false
+		}); wErr != nil && err == nil {
+			err = wErr
+		}
+		return found
+	})
+	return base + uint64(i), err
+}
+
+// Trim drops the oldest messages of a queue in log mode until at most maxLen
+// are left, and returns how many were dropped. The consumer groups which did
+// not read them skip them.
+func (m *CompositeQueue) Trim(maxLen uint64) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.checkRetained(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for m.length() > maxLen {
+		if _, err := m.head(); err != nil {
+			return n, err
+		}
+		m.discardFront()
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, m.commit()
+}
+
+// WaitFor waits until a queue in log mode has a message at offset, and
+// returns false if ctx is done first.
+func (m *CompositeQueue) WaitFor(ctx context.Context, offset uint64) bool {
+	for {
+		m.lock.Lock()
+		if m.checkRetained() != nil {
+			m.lock.Unlock()
+			return false
+		}
+		if offset < m.groups.base+m.length() {
+			m.lock.Unlock()
+			return true
+		}
+		put := m.putChan
+		m.putWaiters++
+		m.lock.Unlock()
+		done := false
+		select {
+		case <-put:
+		case <-ctx.Done():
+			done = true
+		}
+		m.lock.Lock()
+		m.putWaiters--
+		m.lock.Unlock()
+		if done {
+			return false
+		}
+	}
+}
+
+func (m *CompositeQueue) checkRetained() error {
+	if m.deleted {
+		return ErrDeleted
+	}
+	if m.groups == nil {
+		return ErrNotRetained
+	}
+	return nil
+}
+
+// truncate drops the messages every consumer group acknowledged, the
+// segments go once all of their messages are dropped.
+func (m *CompositeQueue) truncate() {
+	committed, ok := m.groups.committed()
+	if !ok {
+		return
+	}
+	for m.groups.base < committed {
+		if _, err := m.head(); err != nil {
+			return
+		}
+		m.discardFront()
+	}
+}
+
+// PutBatch puts every message of data under a single lock acquisition and
+// a single journal write, and returns how many were put before an error.
+// Unless the queue has limits, which every message may have to make room
+// for, the messages are written with a single header update per segment.
+func (m *CompositeQueue) PutBatch(data [][]byte) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return 0, ErrDeleted
+	}
+	deadline := m.deadline(0)
+	n := 0
+	var err error
+	if m.option.MaxLength > 0 || m.option.MaxBytes > 0 {
+		for ; n < len(data); n++ {
+			if err = m.put(data[n], deadline); err != nil {
+				break
+			}
+		}
+	} else {
+		for n < len(data) && uint64(len(data[n])) <= m.maxMessageSize() && m.handOff(data[n]) {
+			n++
+		}
+		end := n
+		for end < len(data) && uint64(len(data[end])) <= m.maxMessageSize() {
+			end++
+		}
+		if end > n {
+			var stored int
+			stored, err = m.storeBatch(data[n:end], deadline)
+			n += stored
+		}
+		if err == nil && end < len(data) {
+			err = ErrPacketTooLarge
+		}
+	}
+	if cErr := m.commit(); cErr != nil {
+		return n, cErr
+	}
+	return n, err
+}
+
+// GetBatch consumes up to max messages, oldest first, under a single lock
+// acquisition. ErrEmpty is returned if the queue has no message. The messages
+// of a segment or of the memory queue are read with a single header update.
+func (m *CompositeQueue) GetBatch(max int) ([][]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return nil, ErrEmpty
+	}
+	if m.groups != nil {
+		return nil, ErrRetained
+	}
+	now := time.Now().UnixNano()
+	var res [][]byte
+	for len(res) < max {
+		// skips the expired messages and tells where the next one is
+		data, err := m.frontAt(now)
+		if err == nil && len(m.inflight.ready) > 0 {
+			res = append(res, append([]byte{}, data...))
+			m.discardFront()
+			continue
+		}
+		var batch [][]byte
+		if err == nil {
+			batch, err = m.takeBatch(max-len(res), now)
+		}
+		if err != nil {
+			if err != ErrEmpty && len(res) == 0 {
+				return nil, err
+			}
+			break
+		}
+		res = append(res, batch...)
+	}
+	if len(res) == 0 {
+		return nil, ErrEmpty
+	}
+	m.commitOrLog()
+	return res, nil
+}
+
+// takeBatch consumes up to max stored messages which did not expire at now
+// from the segment or memory queue read first, it is the batch counterpart
+// of discardFront. The caller makes sure the next message is stored there.
+func (m *CompositeQueue) takeBatch(max int, now int64) ([][]byte, error) {
+	if m.readFromFile {
+		s := m.segments[0]
+		batch, err := s.queue.GetBatchAt(max, now)
+		if err != nil {
+			return nil, err
+		}
+		s.dirty = true
+		m.dropConsumedSegments()
+		m.observeDiscards(len(batch))
+		return batch, nil
+	}
+	batch, err := m.cacheQueue.GetBatchAt(max, now)
+	if err != nil {
+		return nil, err
+	}
+	if m.journal != nil {
+		if m.cacheQueue.Len() == 0 {
+			if err := m.journal.reset(); err != nil {
+				log.Printf("Failed to reset journal %s: %v\n", m.option.Name, err)
+			}
+		} else {
+			for range batch {
+				m.journal.get()
+			}
+		}
+	}
+	m.observeDiscards(len(batch))
+	return batch, nil
+}
+
+func (m *CompositeQueue) observeDiscards(n int) {
+	for i := 0; i < n; i++ {
+		m.observe(Op{Kind: OpDiscard})
+	}
+	if n > 0 {
+		m.signalSpace()
+	}
+}
+
+// put adds one message, it is the body of Put and PutBatch, the caller
+// holds the lock and calls commit.
+func (m *CompositeQueue) put(data []byte, deadline int64) error {
+	if uint64(len(data)) > m.maxMessageSize() {
+		return ErrPacketTooLarge
+	}
+	if m.overflows(len(data)) {
+		if err := m.makeRoom(len(data)); err != nil {
+			return err
+		}
+	}
+	if m.handOff(data) {
+		return nil
+	}
+	return m.store(data, deadline)
+}
+
+// handOff gives data to a consumer waiting on Chan, unless a stored message
+// has to be consumed first.
+func (m *CompositeQueue) handOff(data []byte) bool {
+	if m.readFromFile || len(m.inflight.ready) > 0 || m.groups != nil {
+		return false
+	}
+	select {
+	case m.dataChan <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// storeBatch stores data at the tail, it is the batch counterpart of store.
+func (m *CompositeQueue) storeBatch(data [][]byte, deadline int64) (int, error) {
+	var total uint64
+	for _, d := range data {
+		total += prefixSize + uint64(len(d))
+	}
+	if m.cacheQueue.freeSpace() < total {
+		if err := m.transferToDisk(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if m.cacheQueue.freeSpace() >= total {
+		n, err = m.cacheQueue.PutBatchDeadline(data, deadline)
+		if m.journal != nil {
+			for _, d := range data[:n] {
+				m.journal.put(d, deadline)
+			}
+		}
+	} else {
+		// larger than the whole memory queue, write it to the segments
+		n, err = m.putBatchToDisk(data, deadline)
+	}
+	for _, d := range data[:n] {
+		m.observe(Op{Kind: OpPut, Data: d, Deadline: deadline})
+	}
+	if n > 0 {
+		m.signalPut()
+	}
+	return n, err
+}
+
+// putBatchToDisk is putToDisk for several messages, a segment is appended
+// whenever the last one is full.
+func (m *CompositeQueue) putBatchToDisk(data [][]byte, deadline int64) (int, error) {
+	n := 0
+	for n < len(data) {
+		tail, err := m.tail()
+		if err != nil {
+			return n, err
+		}
+		put, err := tail.queue.PutBatchDeadline(data[n:], deadline)
+		if put > 0 {
+			tail.dirty = true
+			m.readFromFile = true
+			n += put
+		}
+		if err == ErrNoSpace && put == 0 {
+			size := m.option.FileBlockUnit
+			if need := headerSize + prefixSize + uint64(len(data[n])); need > size {
+				size = need
+			}
+			if _, err = m.appendSegment(size); err != nil {
+				return n, err
+			}
+		} else if err != nil && err != ErrNoSpace {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// store adds data at the tail of the memory queue, or of the segments if it
+// does not fit, the caller holds the lock and calls commit.
+func (m *CompositeQueue) store(data []byte, deadline int64) error {
+	need := prefixSize + uint64(len(data))
+	if m.cacheQueue.freeSpace() < need {
+		if err := m.transferToDisk(); err != nil {
+			return err
+		}
+		if m.cacheQueue.freeSpace() < need {
+			// larger than the whole memory queue, write it to the segments
+			if err := m.putToDisk(data, deadline); err != nil {
+				return err
+			}
+			m.observe(Op{Kind: OpPut, Data: data, Deadline: deadline})
+			return nil
+		}
+	}
+	if err := m.cacheQueue.PutDeadline(data, deadline); err != nil {
+		return err
+	}
+	if m.journal != nil {
+		m.journal.put(data, deadline)
+	}
+	m.observe(Op{Kind: OpPut, Data: data, Deadline: deadline})
+	m.signalPut()
+	return nil
+}
+
+// commit makes the operations done under the lock durable as configured,
+// it writes the buffered journal operations and syncs with FsyncAlways.
+func (m *CompositeQueue) commit() error {
+	// the in-flight log goes first, a crash may deliver a message twice but
+	// does not lose it
+	if err := m.inflight.flush(); err != nil {
+		return err
+	}
+	if m.journal != nil {
+		if err := m.journal.flush(); err != nil {
+			return err
+		}
+	}
+	// after the journal, a due message is dropped once it is in the queue
+	if err := m.delayed.flush(); err != nil {
+		return err
+	}
+	if m.groups != nil {
+		m.groups.saveBase()
+		if err := m.groups.flush(); err != nil {
+			return err
+		}
+	}
+	if m.option.Fsync == FsyncAlways {
+		return m.sync()
+	}
+	return nil
+}
+
+// commitOrLog commits for operations which have nothing to report an error to.
+func (m *CompositeQueue) commitOrLog() {
+	if err := m.commit(); err != nil {
+		log.Printf("Failed to commit %s: %v\n", m.option.Name, err)
+	}
+}
+
+func (m *CompositeQueue) maxMessageSize() uint64 {
+	if m.option.MaxMessageSize > 0 {
+		return m.option.MaxMessageSize
+	}
+	return uint64(MaxElementLength)
+}
+
+// putToDisk appends data to the last segment, the memory queue must be empty
+// so the order of messages is kept.
+func (m *CompositeQueue) putToDisk(data []byte, deadline int64) error {
+	tail, err := m.tail()
+	if err != nil {
+		return err
+	}
+	err = tail.queue.PutDeadline(data, deadline)
+	if err == ErrNoSpace {
+		size := m.option.FileBlockUnit
+		if need := headerSize + prefixSize + uint64(len(data)); need > size {
+			size = need
+		}
+		if tail, err = m.appendSegment(size); err != nil {
+			return err
+		}
+		err = tail.queue.PutDeadline(data, deadline)
+	}
+	if err != nil {
+		return err
+	}
+	tail.dirty = true
+	m.readFromFile = true
+	m.signalPut()
+	return nil
+}
+
+// Sync forces the segments and the journal to the storage device.
+func (m *CompositeQueue) Sync() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return nil
+	}
+	return m.sync()
+}
+
+// SyncStats returns the time and the duration of the last successful sync.
+func (m *CompositeQueue) SyncStats() (time.Time, time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastSync, m.syncLatency
+}
+
+func (m *CompositeQueue) sync() error {
+	start := time.Now()
+	for _, s := range m.segments {
+		if !s.dirty {
+			continue
+		}
+		if err := s.mapFile.Flush(); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+	if m.journal != nil {
+		if err := m.journal.sync(); err != nil {
+			return err
+		}
+	}
+	if err := m.inflight.sync(); err != nil {
+		return err
+	}
+	if err := m.delayed.sync(); err != nil {
+		return err
+	}
+	if m.groups != nil {
+		m.groups.saveBase()
+		if err := m.groups.sync(); err != nil {
+			return err
+		}
+	}
+	m.lastSync = time.Now()
+	m.syncLatency = m.lastSync.Sub(start)
+	return nil
+}
+
+// transferToDisk moves every record of the memory queue to the segments,
+// starting a new segment whenever the last one is full.
+func (m *CompositeQueue) transferToDisk() error {
+	if m.cacheQueue.Len() == 0 {
+		return nil
+	}
+	tail, err := m.tail()
+	if err != nil {
+		return err
+	}
+	if m.journal != nil {
+		if err := m.journal.transfer(tail.seq, tail.queue.WriteCount()); err != nil {
+			return err
+		}
+	}
+	for m.cacheQueue.Len() > 0 {
+		tail = m.segments[len(m.segments)-1]
+		if m.cacheQueue.MoveTo(tail.queue) > 0 {
+			tail.dirty = true
+		} else {
+			// a record larger than a block gets a segment of its own size
+			size := m.option.FileBlockUnit
+			if need := headerSize + m.cacheQueue.frontSize(); need > size {
+				size = need
+			}
+			if _, err := m.appendSegment(size); err != nil {
+				return err
+			}
+		}
+	}
+	m.readFromFile = true
+	if m.journal != nil {
+		return m.journal.reset()
+	}
+	return nil
+}
+
+func (m *CompositeQueue) Len() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return 0
+	}
+	return m.length()
+}
+
+// Evicted returns how many messages were dropped by OverflowDropOldest.
+func (m *CompositeQueue) Evicted() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.evicted
+}
+
+func (m *CompositeQueue) length() uint64 {
+	n := m.cacheQueue.Len() + uint64(len(m.inflight.ready))
+	if m.readFromFile {
+		for _, s := range m.segments {
+			n += s.queue.Len()
+		}
+	}
+	return n
+}
+
+// size returns the bytes of all messages, record headers included.
+func (m *CompositeQueue) size() uint64 {
+	n := m.cacheQueue.ReadableBytes() + m.inflight.readyBytes()
+	if m.readFromFile {
+		for _, s := range m.segments {
+			n += s.queue.ReadableBytes()
+		}
+	}
+	return n
+}
+
+func (m *CompositeQueue) closeSegments() error {
+	var err error
+	for _, s := range m.segments {
+		if cErr := s.close(); cErr != nil {
+			log.Printf("Failed to close segment %s: %v\n", s.path, cErr)
+			err = cErr
+		}
+	}
+	return err
+}
+
+func (m *CompositeQueue) closeSink() error {
+	tErr := m.transferToDisk()
+	if tErr != nil {
+		log.Printf("Failed to transfer to disk %s: %v\n", m.option.Name, tErr)
+	}
+	err := m.closeSegments()
+	if m.inflight != nil {
+		if iErr := m.inflight.close(); iErr != nil {
+			log.Printf("Failed to close in-flight log %s: %v\n", m.option.Name, iErr)
+		}
+	}
+	if m.delayed != nil {
+		if dErr := m.delayed.close(); dErr != nil {
+			log.Printf("Failed to close delayed messages log %s: %v\n", m.option.Name, dErr)
+		}
+	}
+	if m.groups != nil {
+		m.groups.saveBase()
+		if gErr := m.groups.close(); gErr != nil {
+			log.Printf("Failed to close consumer groups log %s: %v\n", m.option.Name, gErr)
+		}
+	}
+	if m.journal != nil {
+		if tErr != nil {
+			// keep the journal, the memory queue did not make it to disk
+			m.journal.close()
+		} else if jErr := m.journal.remove(); jErr != nil {
+			log.Printf("Failed to remove journal %s: %v\n", m.option.Name, jErr)
+		}
+	}
+	if err == nil {
+		err = tErr
+	}
+	return err
+}
+
+// Interrupt wakes up the producers waiting for room with ErrClosed, later
+// puts on a full queue fail with ErrClosed instead of waiting. It lets the
+// clients blocked in a put finish before the queue is closed.
+func (m *CompositeQueue) Interrupt() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	m.signalSpace()
+}
+
+func (m *CompositeQueue) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	m.signalSpace()
+	return m.closeSink()
+}
+
+func (m *CompositeQueue) Delete() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	lf := log.Fields{
+		"func":     "CompositeQueue#Delete()",
+		"backFile": m.option.BackFile,
+		"name":     m.option.Name,
+	}
+	err := m.closeSegments()
+	if err != nil {
+		log.WithFields(lf).WithError(err).Error("failed to close queue")
+	}
+	for _, s := range m.segments {
+		if rErr := os.Remove(s.path); rErr != nil {
+			log.WithFields(lf).WithError(rErr).Errorf("failed to delete segment %s", s.path)
+			err = rErr
+		}
+	}
+	if m.journal != nil {
+		if jErr := m.journal.remove(); jErr != nil {
+			log.WithFields(lf).WithError(jErr).Error("failed to delete journal")
+			err = jErr
+		}
+	}
+	if iErr := m.inflight.remove(); iErr != nil {
+		log.WithFields(lf).WithError(iErr).Error("failed to delete in-flight log")
+		err = iErr
+	}
+	if dErr := m.delayed.remove(); dErr != nil {
+		log.WithFields(lf).WithError(dErr).Error("failed to delete delayed messages log")
+		err = dErr
+	}
+	if m.groups != nil {
+		if gErr := m.groups.remove(); gErr != nil {
+			log.WithFields(lf).WithError(gErr).Error("failed to delete consumer groups log")
+			err = gErr
+		}
 	}
 	m.deleted = true
-	m.mapQueue = nil
+	m.segments = nil
+	m.signalSpace()
+	m.signalPut()
 	return err
 }
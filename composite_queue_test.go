@@ -1,7 +1,18 @@
 package mqueue
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestOpenCompositionQueue(t *testing.T) {
@@ -25,3 +36,1411 @@ func TestOpenCompositionQueue(t *testing.T) {
 		}
 	}
 }
+
+func TestCompositeQueueReclaim(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip pushing hundreds of MB in short mode")
+	}
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const (
+		unit      = 1 << 20
+		total     = 256 << 20
+		backlog   = 4096
+		msgLength = 1024
+	)
+	opt := CompositeQueueOption{
+		FileBlockUnit: unit,
+		Name:          "reclaim",
+		CacheSize:     64 << 10,
+		BackFile:      filepath.Join(dir, "reclaim.mq"),
+	}
+	q, err := OpenCompositionQueue(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	data := make([]byte, msgLength)
+	buff := make([]byte, msgLength)
+	var written, read uint64
+	put := func() {
+		binary.LittleEndian.PutUint64(data, written)
+		if err := q.Put(data); err != nil {
+			t.Fatal(err)
+		}
+		written++
+	}
+	for i := 0; i < backlog; i++ {
+		put()
+	}
+	var maxSize int64
+	for i := 0; i < total/msgLength; i++ {
+		put()
+		n, err := q.Get(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != msgLength || binary.LittleEndian.Uint64(buff) != read {
+			t.Fatalf("Unexpected message %d, want %d", binary.LittleEndian.Uint64(buff), read)
+		}
+		read++
+		if i%1024 == 0 {
+			if size := dirSize(t, dir); size > maxSize {
+				maxSize = size
+			}
+		}
+	}
+	if q.Len() != backlog {
+		t.Fatalf("Unexpected length %d", q.Len())
+	}
+	// the live backlog is 4MB, allow room for the partly consumed head segment
+	if maxSize > 6*unit {
+		t.Fatalf("Segments grew to %d bytes", maxSize)
+	}
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	return size
+}
+
+func TestCompositeQueueReopenSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opt := CompositeQueueOption{
+		FileBlockUnit: 4096,
+		Name:          "segments",
+		CacheSize:     512,
+		BackFile:      filepath.Join(dir, "segments.mq"),
+	}
+	q, err := OpenCompositionQueue(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	for i := uint64(0); i < 1000; i++ {
+		binary.LittleEndian.PutUint64(data, i)
+		if err = q.Put(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	seqs, err := listSegments(opt.BackFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) < 2 {
+		t.Fatalf("Expect several segments, got %v", seqs)
+	}
+
+	if q, err = OpenCompositionQueue(opt); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 1000 {
+		t.Fatalf("Unexpected length %d", q.Len())
+	}
+	buff := make([]byte, 100)
+	for i := uint64(0); i < 1000; i++ {
+		if _, err = q.Get(buff); err != nil {
+			t.Fatal(err)
+		}
+		if binary.LittleEndian.Uint64(buff) != i {
+			t.Fatalf("Unexpected message %d, want %d", binary.LittleEndian.Uint64(buff), i)
+		}
+	}
+	if seqs, _ = listSegments(opt.BackFile); len(seqs) != 1 {
+		t.Fatalf("Consumed segments are not removed: %v", seqs)
+	}
+}
+
+// TestCompositeQueueJournalCrash runs itself in a child process which pushes
+// messages until it is killed, every acknowledged message must survive.
+func TestCompositeQueueJournalCrash(t *testing.T) {
+	opt := CompositeQueueOption{
+		FileBlockUnit: 1 << 20,
+		Name:          "crash",
+		CacheSize:     256 << 10,
+		Journal:       true,
+	}
+	if dir := os.Getenv("MQUEUE_CRASH_DIR"); dir != "" {
+		opt.BackFile = filepath.Join(dir, "crash.mq")
+		q, err := OpenCompositionQueue(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 100)
+		for i := uint64(0); ; i++ {
+			binary.LittleEndian.PutUint64(data, i)
+			if err = q.Put(data); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Println(i)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opt.BackFile = filepath.Join(dir, "crash.mq")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCompositeQueueJournalCrash$")
+	cmd.Env = append(os.Environ(), "MQUEUE_CRASH_DIR="+dir)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(out)
+	var acked int64 = -1
+	for scanner.Scan() {
+		if acked, err = strconv.ParseInt(scanner.Text(), 10, 64); err != nil {
+			t.Fatal(scanner.Text())
+		}
+		if acked == 20000 {
+			break
+		}
+	}
+	cmd.Process.Kill()
+	// drain what the child acknowledged before it died
+	for scanner.Scan() {
+		if v, err := strconv.ParseInt(scanner.Text(), 10, 64); err == nil {
+			acked = v
+		}
+	}
+	cmd.Wait()
+	if acked < 20000 {
+		t.Fatalf("Child stopped early at %d", acked)
+	}
+
+	q, err := OpenCompositionQueue(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() < uint64(acked+1) {
+		t.Fatalf("Lost messages, got %d, acknowledged %d", q.Len(), acked+1)
+	}
+	buff := make([]byte, 100)
+	for i := uint64(0); i <= uint64(acked); i++ {
+		if _, err = q.Get(buff); err != nil {
+			t.Fatal(err)
+		}
+		if binary.LittleEndian.Uint64(buff) != i {
+			t.Fatalf("Unexpected message %d, want %d", binary.LittleEndian.Uint64(buff), i)
+		}
+	}
+}
+
+func TestCompositeQueueLargeMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 256 << 10,
+		Name:          "large",
+		CacheSize:     64 << 10,
+		BackFile:      filepath.Join(dir, "large.mq"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	small := []byte("small")
+	large := make([]byte, 3<<20)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	for _, data := range [][]byte{small, large, small} {
+		if err = q.Put(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buff := make([]byte, 16)
+	if n, err := q.Get(buff); err != nil || string(buff[:n]) != "small" {
+		t.Fatalf("Unexpected first message %q, %v", buff[:n], err)
+	}
+	if _, err = q.Get(buff); err != ErrBufferTooSmall {
+		t.Fatalf("Expect ErrBufferTooSmall, got %v", err)
+	}
+	if buff, err = q.Pop(buff); err != nil || !bytes.Equal(buff, large) {
+		t.Fatalf("Unexpected large message of %d bytes, %v", len(buff), err)
+	}
+	if buff, err = q.Pop(buff); err != nil || string(buff) != "small" {
+		t.Fatalf("Unexpected last message %q, %v", buff, err)
+	}
+}
+
+func TestCompositeQueueOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(name string, policy OverflowPolicy) *CompositeQueue {
+		q, err := OpenCompositionQueue(CompositeQueueOption{
+			FileBlockUnit: 4096,
+			Name:          name,
+			CacheSize:     128,
+			BackFile:      filepath.Join(dir, name+".mq"),
+			MaxLength:     3,
+			Overflow:      policy,
+			BlockTimeout:  50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{"a", "b", "c"} {
+			if err = q.Put([]byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return q
+	}
+	buff := make([]byte, 16)
+
+	q := open("reject", OverflowReject)
+	if err = q.Put([]byte("d")); err != ErrQueueFull {
+		t.Fatalf("Expect ErrQueueFull, got %v", err)
+	}
+	q.Close()
+
+	q = open("drop", OverflowDropOldest)
+	if err = q.Put([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := q.Get(buff); string(buff[:n]) != "b" || q.Evicted() != 1 {
+		t.Fatalf("Unexpected head %q after eviction of %d", buff[:n], q.Evicted())
+	}
+	q.Close()
+
+	q = open("block", OverflowBlock)
+	if err = q.Put([]byte("d")); err != ErrQueueFull {
+		t.Fatalf("Expect ErrQueueFull on timeout, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Get(make([]byte, 16))
+	}()
+	if err = q.Put([]byte("d")); err != nil {
+		t.Fatalf("Expect blocked put to succeed, got %v", err)
+	}
+	if q.Len() != 3 {
+		t.Fatalf("Unexpected length %d", q.Len())
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Interrupt()
+	}()
+	if err = q.Put([]byte("e")); err != ErrClosed {
+		t.Fatalf("Expect ErrClosed once interrupted, got %v", err)
+	}
+	q.Close()
+}
+
+func TestCompositeQueueRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 256,
+		Name:          "range",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "range.mq"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// enough messages to spread over several segments and the memory queue
+	for i := 0; i < 40; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := q.Range(18, 22)
+	if err != nil || len(items) != 5 {
+		t.Fatalf("Unexpected range %q, %v", items, err)
+	}
+	for i, item := range items {
+		if string(item) != strconv.Itoa(18+i) {
+			t.Fatalf("Unexpected item %d: %q", i, item)
+		}
+	}
+	if items, _ = q.Range(-3, 100); len(items) != 3 || string(items[2]) != "39" {
+		t.Fatalf("Unexpected tail range %q", items)
+	}
+	if data, err := q.Index(-1); err != nil || string(data) != "39" {
+		t.Fatalf("Unexpected newest %q, %v", data, err)
+	}
+	if _, err = q.Index(40); err != ErrEmpty {
+		t.Fatalf("Expect ErrEmpty out of range, got %v", err)
+	}
+	if data, err := q.Peek(nil); err != nil || string(data) != "0" || q.Len() != 40 {
+		t.Fatalf("Unexpected peek %q, %v, len %d", data, err, q.Len())
+	}
+}
+
+func TestCompositeQueueBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 256,
+		Name:          "batch",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "batch.mq"),
+		Journal:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	batch := make([][]byte, 0, 50)
+	for i := 0; i < 50; i++ {
+		batch = append(batch, []byte(strconv.Itoa(i)))
+	}
+	for round := 0; round < 2; round++ {
+		if n, err := q.PutBatch(batch); err != nil || n != 50 {
+			t.Fatalf("Unexpected batch put %d, %v", n, err)
+		}
+	}
+	for got := 0; got < 100; {
+		items, err := q.GetBatch(30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range items {
+			if string(item) != strconv.Itoa(got%50) {
+				t.Fatalf("Unexpected item %q, want %d", item, got%50)
+			}
+			got++
+		}
+	}
+	if _, err = q.GetBatch(1); err != ErrEmpty {
+		t.Fatalf("Expect ErrEmpty, got %v", err)
+	}
+
+	// an expired message in the middle of a batch is skipped
+	q.PutBatch(batch[:2])
+	q.PutTTL([]byte("gone"), time.Millisecond)
+	q.PutBatch(batch[2:4])
+	time.Sleep(5 * time.Millisecond)
+	items, err := q.GetBatch(10)
+	if err != nil || len(items) != 4 || string(items[2]) != "2" || q.Expired() != 1 {
+		t.Fatalf("Unexpected batch %q, %v after %d expired", items, err, q.Expired())
+	}
+}
+
+func TestCompositeQueueInflightCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backFile := filepath.Join(dir, "busy.mq")
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit:     1 << 16,
+		Name:              "busy",
+		CacheSize:         1 << 12,
+		BackFile:          backFile,
+		VisibilityTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// one message stays in flight, so the log is never empty
+	payload := make([]byte, 1024)
+	q.Put(payload)
+	if _, _, err = q.Reserve(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4096; i++ {
+		q.Put(payload)
+		id, _, err := q.Reserve(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Ack(id)
+	}
+	stat, err := os.Stat(InflightPath(backFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 2*sideLogCompactSize+2048 {
+		t.Fatalf("Expect the in-flight log to be compacted, it has %d bytes", stat.Size())
+	}
+}
+
+func TestCompositeQueueReserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	option := CompositeQueueOption{
+		FileBlockUnit:     256,
+		Name:              "reserve",
+		CacheSize:         128,
+		BackFile:          filepath.Join(dir, "reserve.mq"),
+		VisibilityTimeout: time.Minute,
+	}
+	q, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make([]uint64, 3)
+	for i := range ids {
+		var data []byte
+		if ids[i], data, err = q.Reserve(nil); err != nil || string(data) != strconv.Itoa(i) {
+			t.Fatalf("Unexpected reserve %q, %v", data, err)
+		}
+	}
+	if q.Len() != 0 || q.InFlight() != 3 {
+		t.Fatalf("Unexpected len %d, in flight %d", q.Len(), q.InFlight())
+	}
+	if ok, err := q.Ack(ids[0]); !ok || err != nil {
+		t.Fatalf("Unexpected ack %v, %v", ok, err)
+	}
+	if ok, _ := q.Ack(ids[0]); ok {
+		t.Fatal("Expect a second ack to fail")
+	}
+	if err = q.Put([]byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	// the released message is delivered before the rest of the queue
+	if ok, _ := q.Release(ids[2]); !ok {
+		t.Fatal("Expect release to succeed")
+	}
+	if data, err := q.Peek(nil); err != nil || string(data) != "2" || q.Len() != 2 {
+		t.Fatalf("Unexpected head %q, %v, len %d", data, err, q.Len())
+	}
+	if q.Close() != nil {
+		t.Fatal("Failed to close queue")
+	}
+
+	// message 1 is still leased and message 2 still released after a restart
+	q, err = OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Len() != 2 || q.InFlight() != 1 {
+		t.Fatalf("Unexpected len %d, in flight %d after reopen", q.Len(), q.InFlight())
+	}
+	if n := q.RequeueExpired(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Fatalf("Expect 1 expired lease, got %d", n)
+	}
+	if ok, _ := q.Ack(ids[1]); ok {
+		t.Fatal("Expect ack of an expired lease to fail")
+	}
+	for _, want := range []string{"2", "1", "3"} {
+		data, err := q.Pop(nil)
+		if err != nil || string(data) != want {
+			t.Fatalf("Unexpected pop %q, %v, want %s", data, err, want)
+		}
+	}
+	if _, err = os.Stat(InflightPath(option.BackFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expect the in-flight log to be removed, got %v", err)
+	}
+}
+
+func TestCompositeQueueDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit:     256,
+		Name:              "dead",
+		CacheSize:         128,
+		BackFile:          filepath.Join(dir, "dead.mq"),
+		VisibilityTimeout: time.Minute,
+		MaxDeliveries:     2,
+		KeepDead:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, data := range []string{"a", "b"} {
+		if err = q.Put([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is refused twice, b is not acknowledged in time twice
+	for i := 0; i < 2; i++ {
+		id, data, err := q.Reserve(nil)
+		if err != nil || string(data) != "a" {
+			t.Fatalf("Unexpected reserve %q, %v", data, err)
+		}
+		if ok, err := q.Nack(id, "failed "+strconv.Itoa(i)); !ok || err != nil {
+			t.Fatalf("Unexpected nack %v, %v", ok, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, data, err := q.Reserve(nil); err != nil || string(data) != "b" {
+			t.Fatalf("Unexpected reserve %q, %v", data, err)
+		}
+		q.RequeueExpired(time.Now().Add(2 * time.Minute))
+	}
+	if q.Len() != 0 || q.InFlight() != 0 || q.Dead() != 2 {
+		t.Fatalf("Unexpected len %d, in flight %d, dead %d", q.Len(), q.InFlight(), q.Dead())
+	}
+	dead := q.TakeDead()
+	if len(dead) != 2 || string(dead[0].Data) != "a" || dead[0].Deliveries != 2 || dead[0].Reason != "failed 1" ||
+		string(dead[1].Data) != "b" || dead[1].Reason != "visibility timeout expired" {
+		t.Fatalf("Unexpected dead letters %+v", dead)
+	}
+	if len(q.TakeDead()) != 0 {
+		t.Fatal("Expect dead letters to be taken once")
+	}
+}
+
+func TestCompositeQueueGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	option := CompositeQueueOption{
+		FileBlockUnit: 256,
+		Name:          "log",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "log.mq"),
+		Retain:        true,
+	}
+	q, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.Pop(nil); err != ErrRetained {
+		t.Fatalf("Expect ErrRetained, got %v", err)
+	}
+	for _, name := range []string{"billing", "analytics"} {
+		if err = q.CreateGroup(name, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = q.CreateGroup("billing", 0); err != ErrGroupExists {
+		t.Fatalf("Expect ErrGroupExists, got %v", err)
+	}
+	// each group reads every message
+	billing, err := q.ReadGroup("billing", 15, false)
+	if err != nil || len(billing) != 15 || billing[14].Offset != 14 || string(billing[14].Data) != "14" {
+		t.Fatalf("Unexpected billing read %v, %v", billing, err)
+	}
+	analytics, err := q.ReadGroup("analytics", 5, false)
+	if err != nil || len(analytics) != 5 || string(analytics[0].Data) != "0" {
+		t.Fatalf("Unexpected analytics read %v, %v", analytics, err)
+	}
+	offsets := make([]uint64, 0, len(billing))
+	for _, e := range billing {
+		offsets = append(offsets, e.Offset)
+	}
+	if n, err := q.AckGroup("billing", offsets...); n != 15 || err != nil {
+		t.Fatalf("Unexpected ack %d, %v", n, err)
+	}
+	// analytics still has to acknowledge them
+	if q.Len() != 20 {
+		t.Fatalf("Expect every message to be kept, len %d", q.Len())
+	}
+	if n, _ := q.AckGroup("analytics", 0, 1, 3); n != 3 || q.Len() != 18 {
+		t.Fatalf("Unexpected ack %d, len %d", n, q.Len())
+	}
+	if q.Close() != nil {
+		t.Fatal("Failed to close queue")
+	}
+
+	// analytics reads again from its oldest pending message
+	q, err = OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if groups := q.Groups(); len(groups) != 2 || groups[0] != "analytics" {
+		t.Fatalf("Unexpected groups %v", groups)
+	}
+	analytics, err = q.ReadGroup("analytics", 1, true)
+	if err != nil || len(analytics) != 1 || analytics[0].Offset != 2 || string(analytics[0].Data) != "2" {
+		t.Fatalf("Unexpected analytics read %v, %v", analytics, err)
+	}
+	billing, err = q.ReadGroup("billing", 10, true)
+	if err != nil || len(billing) != 5 || billing[0].Offset != 15 {
+		t.Fatalf("Unexpected billing read %v, %v", billing, err)
+	}
+	if ok, _ := q.DestroyGroup("analytics"); !ok || q.Len() != 0 {
+		t.Fatalf("Expect messages to be dropped with the last group, len %d", q.Len())
+	}
+	// new messages get the next offsets
+	if err = q.Put([]byte("20")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	billing, err = q.WaitReadGroup(ctx, "billing", 10, true)
+	if err != nil || len(billing) != 1 || billing[0].Offset != 20 {
+		t.Fatalf("Unexpected billing read %v, %v", billing, err)
+	}
+}
+
+func TestCompositeQueueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 256,
+		Name:          "log",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "log.mq"),
+		Retain:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 20; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i * 2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := q.Trim(15); n != 5 || err != nil {
+		t.Fatalf("Unexpected trim %d, %v", n, err)
+	}
+	if first, end, err := q.Bounds(); first != 5 || end != 20 || err != nil {
+		t.Fatalf("Unexpected bounds %d, %d, %v", first, end, err)
+	}
+	// messages are read again from any offset, dropped ones are skipped
+	entries, err := q.ReadFrom(0, 3)
+	if err != nil || len(entries) != 3 || entries[0].Offset != 5 || string(entries[2].Data) != "14" {
+		t.Fatalf("Unexpected read %v, %v", entries, err)
+	}
+	offset, err := q.Search(func(e Entry) bool {
+		n, _ := strconv.Atoi(string(e.Data))
+		return n >= 25
+	})
+	if err != nil || offset != 13 {
+		t.Fatalf("Unexpected search %d, %v", offset, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if q.WaitFor(ctx, 20) {
+		t.Fatal("Expect wait to time out")
+	}
+	go q.Put([]byte("40"))
+	if !q.WaitFor(context.Background(), 20) {
+		t.Fatal("Expect wait to see the new message")
+	}
+}
+
+func TestCompositeQueueMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(name string, maxLength uint64) *CompositeQueue {
+		q, err := OpenCompositionQueue(CompositeQueueOption{
+			FileBlockUnit: 256,
+			Name:          name,
+			CacheSize:     128,
+			BackFile:      filepath.Join(dir, name+".mq"),
+			Journal:       true,
+			MaxLength:     maxLength,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	src, dst := open("src", 0), open("dst", 30)
+	defer src.Close()
+	defer dst.Close()
+	// the source spills to the segments and the destination has to as well
+	for i := 0; i < 40; i++ {
+		if err = src.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		data, err := src.MoveTo(dst)
+		if err != nil || string(data) != strconv.Itoa(i) {
+			t.Fatalf("Unexpected move %q, %v", data, err)
+		}
+	}
+	if _, err = src.MoveTo(dst); err != ErrQueueFull {
+		t.Fatalf("Expect ErrQueueFull, got %v", err)
+	}
+	if src.Len() != 10 || dst.Len() != 30 {
+		t.Fatalf("Unexpected lengths %d and %d", src.Len(), dst.Len())
+	}
+	for i := 0; i < 30; i++ {
+		data, err := dst.Pop(nil)
+		if err != nil || string(data) != strconv.Itoa(i) {
+			t.Fatalf("Unexpected pop %q, %v", data, err)
+		}
+	}
+	// moving to itself rotates the queue
+	if data, err := src.MoveTo(src); err != nil || string(data) != "30" {
+		t.Fatalf("Unexpected rotate %q, %v", data, err)
+	}
+	if data, _ := src.Index(-1); string(data) != "30" || src.Len() != 10 {
+		t.Fatalf("Unexpected tail %q, len %d", data, src.Len())
+	}
+
+	// a full queue keeps its message if the copy can not be stored, the
+	// segment holds two messages and the next one can not be created
+	full, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 512,
+		Name:          "full",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "full.mq"),
+		MaxLength:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.Close()
+	large := make([]byte, 200)
+	for i := byte(0); i < 2; i++ {
+		large[0] = i
+		if err = full.Put(large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Mkdir(SegmentPath(filepath.Join(dir, "full.mq"), 2), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = full.MoveTo(full); err == nil {
+		t.Fatal("Expect the rotation to fail")
+	}
+	if data, _ := full.Index(0); full.Len() != 2 || len(data) != 200 || data[0] != 0 {
+		t.Fatalf("Expect the message to stay in front, len %d", full.Len())
+	}
+
+	empty := open("empty", 0)
+	defer empty.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = empty.WaitMoveTo(ctx, dst); err != ErrEmpty {
+		t.Fatalf("Expect ErrEmpty on timeout, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		empty.Put([]byte("late"))
+	}()
+	if data, err := empty.WaitMoveTo(context.Background(), dst); err != nil || string(data) != "late" {
+		t.Fatalf("Unexpected wait move %q, %v", data, err)
+	}
+	if dst.Len() != 1 || empty.Len() != 0 {
+		t.Fatalf("Unexpected lengths %d and %d", dst.Len(), empty.Len())
+	}
+}
+
+func TestCompositeQueueDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	option := CompositeQueueOption{
+		FileBlockUnit: 256,
+		Name:          "delay",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "delay.mq"),
+	}
+	q, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, delay := range []time.Duration{3 * time.Minute, time.Minute, 2 * time.Minute} {
+		if err = q.PutAt([]byte(strconv.Itoa(i)), now.Add(delay)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = q.PutAt([]byte("now"), now); err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 1 || q.Delayed() != 3 || q.DeliverDue(now) != 0 {
+		t.Fatalf("Unexpected len %d, delayed %d", q.Len(), q.Delayed())
+	}
+	if q.Close() != nil {
+		t.Fatal("Failed to close queue")
+	}
+
+	// the delayed messages survive a restart
+	q, err = OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Delayed() != 3 {
+		t.Fatalf("Unexpected delayed %d after reopen", q.Delayed())
+	}
+	if n := q.DeliverDue(now.Add(2 * time.Minute)); n != 2 {
+		t.Fatalf("Expect 2 due messages, got %d", n)
+	}
+	for _, want := range []string{"now", "1", "2"} {
+		data, err := q.Pop(nil)
+		if err != nil || string(data) != want {
+			t.Fatalf("Unexpected pop %q, %v, want %s", data, err, want)
+		}
+	}
+	// a consumer blocked on an empty queue gets the message when it is due
+	received := make(chan []byte)
+	go func() {
+		received <- <-q.Chan()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if n := q.DeliverDue(now.Add(time.Hour)); n != 1 {
+		t.Fatalf("Expect 1 due message, got %d", n)
+	}
+	if data := <-received; string(data) != "0" {
+		t.Fatalf("Unexpected handed off message %q", data)
+	}
+	if _, err = os.Stat(DelayedPath(option.BackFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expect the delayed messages log to be removed, got %v", err)
+	}
+}
+
+func TestCompositeQueueDelayedCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	option := CompositeQueueOption{
+		FileBlockUnit: 1 << 16,
+		Name:          "later",
+		CacheSize:     1 << 12,
+		BackFile:      filepath.Join(dir, "later.mq"),
+	}
+	q, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one message stays delayed, so the log is never empty
+	now := time.Now()
+	if err = q.PutAt([]byte("last"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	q.PutAt([]byte("first"), now.Add(time.Hour/2))
+	payload := make([]byte, 1024)
+	for i := 0; i < 4096; i++ {
+		q.PutAt(payload, now.Add(time.Minute))
+		if q.DeliverDue(now.Add(time.Minute)) != 1 {
+			t.Fatal("Expect the message to be due")
+		}
+		q.Pop(nil)
+	}
+	stat, err := os.Stat(DelayedPath(option.BackFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 2*sideLogCompactSize+2048 {
+		t.Fatalf("Expect the delayed messages log to be compacted, it has %d bytes", stat.Size())
+	}
+	if q.DeliverDue(now.Add(time.Hour/2)) != 1 {
+		t.Fatal("Expect the first message to be due")
+	}
+	if data, err := q.Pop(nil); err != nil || string(data) != "first" {
+		t.Fatalf("Unexpected pop %q, %v", data, err)
+	}
+	q.Close()
+
+	// the message is read back from the compacted log
+	if q, err = OpenCompositionQueue(option); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// a message which can not be read aborts the compaction
+	path := DelayedPath(option.BackFile)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := q.delayed.timers[0].off
+	if err = os.Truncate(path, off); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.delayed.compact(); err == nil {
+		t.Fatal("Expect the compaction to fail")
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != off || q.delayed.timers[0].off != off {
+		t.Fatalf("Expect the log and the offsets to stay, got %v, %v", stat, err)
+	}
+	if err = ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if q.DeliverDue(now.Add(time.Hour)) != 1 {
+		t.Fatal("Expect the last message to be due")
+	}
+	if data, err := q.Pop(nil); err != nil || string(data) != "last" {
+		t.Fatalf("Unexpected pop %q, %v", data, err)
+	}
+}
+
+func TestCompositeQueueTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	option := CompositeQueueOption{
+		FileBlockUnit: 256,
+		Name:          "ttl",
+		CacheSize:     128,
+		BackFile:      filepath.Join(dir, "ttl.mq"),
+		Journal:       true,
+		TTL:           50 * time.Millisecond,
+		KeepExpired:   true,
+	}
+	q, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough messages to reach the segments, every other one with the default TTL
+	for i := 0; i < 20; i++ {
+		ttl := time.Duration(0)
+		if i%2 == 1 {
+			ttl = time.Hour
+		}
+		if err = q.PutTTL([]byte(strconv.Itoa(i)), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the deadlines are kept in the segments and in the journal
+	q.Close()
+	if q, err = OpenCompositionQueue(option); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	time.Sleep(60 * time.Millisecond)
+	for i := 1; i < 20; i += 2 {
+		data, err := q.Pop(nil)
+		if err != nil || string(data) != strconv.Itoa(i) {
+			t.Fatalf("Unexpected pop %q, %v, want %d", data, err, i)
+		}
+	}
+	if _, err = q.Pop(nil); err != ErrEmpty {
+		t.Fatalf("Expect ErrEmpty, got %v", err)
+	}
+	// Close reopened the queue, the counter only covers this instance
+	expired := q.TakeExpired()
+	if q.Expired() != 10 || len(expired) != 10 || string(expired[9]) != "18" {
+		t.Fatalf("Unexpected expired %d, %q", q.Expired(), expired)
+	}
+	if len(q.TakeExpired()) != 0 {
+		t.Fatal("Expect expired messages to be taken once")
+	}
+}
+
+func TestCompositeQueueBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	option := CompositeQueueOption{
+		FileBlockUnit: 1024,
+		Name:          "backup",
+		CacheSize:     256,
+		BackFile:      filepath.Join(dir, "live", "backup.mq"),
+	}
+	if err = os.Mkdir(filepath.Join(dir, "live"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	// spread the messages over several segments and the memory queue
+	for i := 0; i < 100; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err = q.Reserve(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = q.PutAt([]byte("later"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	backupDir := filepath.Join(dir, "backup")
+	if err = Backup(backupDir, q); err != nil {
+		t.Fatal(err)
+	}
+	if err = Backup(backupDir, q); err == nil {
+		t.Fatal("Expect a backup over an existing directory to fail")
+	}
+	// the live queue moves on, the backup does not
+	for i := 0; i < 50; i++ {
+		if _, err = q.Pop(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Put([]byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	option.BackFile = filepath.Join(dir, "restored", "backup.mq")
+	if err = Restore(backupDir, filepath.Dir(option.BackFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err = Restore(backupDir, filepath.Dir(option.BackFile)); err == nil {
+		t.Fatal("Expect a restore over existing files to fail")
+	}
+	r, err := OpenCompositionQueue(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Len() != 99 || r.InFlight() != 1 || r.Delayed() != 1 {
+		t.Fatalf("Unexpected len %d, in flight %d, delayed %d", r.Len(), r.InFlight(), r.Delayed())
+	}
+	for i := 1; i < 100; i++ {
+		data, err := r.Pop(nil)
+		if err != nil || string(data) != strconv.Itoa(i) {
+			t.Fatalf("Unexpected pop %q, %v, want %d", data, err, i)
+		}
+	}
+
+	// captures write on after the records of the last segment
+	for {
+		if _, err = q.Pop(nil); err == ErrEmpty {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			if err = q.Put([]byte(strconv.Itoa(round*100 + i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		snap, err := Capture([]*CompositeQueue{q}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snap.Close()
+	}
+	if len(q.segments) > 3 {
+		t.Fatalf("Expect the captures to share segments, got %d", len(q.segments))
+	}
+
+	// a capture still reads the last segment once the queue drained and wrote
+	// over it again
+	snap, err := Capture([]*CompositeQueue{q}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	for i := 0; i < 100; i++ {
+		if _, err = q.Pop(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if err = q.Put([]byte("over")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	err = snap.Each(func(queue string, data []byte, deadline int64) error {
+		if expected := strconv.Itoa(n/20*100 + n%20); string(data) != expected {
+			return fmt.Errorf("got %q instead of %s", data, expected)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 100 {
+		t.Fatalf("Unexpected snapshot of %d messages, %v", n, err)
+	}
+}
+
+func TestCompositeQueueApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ops []Op
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 1024,
+		Name:          "primary",
+		CacheSize:     256,
+		BackFile:      filepath.Join(dir, "primary.mq"),
+		Observer: func(op Op) {
+			op.Data = append([]byte{}, op.Data...)
+			ops = append(ops, op)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	r, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 1024,
+		Name:          "replica",
+		CacheSize:     256,
+		BackFile:      filepath.Join(dir, "replica.mq"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := 0; i < 100; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, err = q.Pop(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var from int
+	s, err := Capture([]*CompositeQueue{q}, func() { from = len(ops) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the primary moves on while the snapshot is read
+	for i := 0; i < 50; i++ {
+		if _, err = q.Pop(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = q.PutTTL([]byte("new"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Each(func(queue string, data []byte, deadline int64) error {
+		if queue != "primary" {
+			t.Fatalf("Expect messages of primary, got %s", queue)
+		}
+		return r.Apply(Op{Kind: OpPut, Data: data, Deadline: deadline})
+	})
+	s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 90 {
+		t.Fatalf("Expect 90 messages captured, got %d", r.Len())
+	}
+	for _, op := range ops[from:] {
+		if err = r.Apply(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := q.Range(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Range(0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expect %d messages on the replica, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("Expect %q at %d, got %q", want[i], i, got[i])
+		}
+	}
+}
+
+func TestCompositeQueueDetach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 1024,
+		Name:          "jobs",
+		CacheSize:     256,
+		BackFile:      filepath.Join(dir, "jobs.mq"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err = q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, _, err := q.Reserve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Detach([]*CompositeQueue{q}); err != ErrPending {
+		t.Fatalf("Expect ErrPending with a message in flight, got %v", err)
+	}
+	if _, err = q.Release(id); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Detach([]*CompositeQueue{q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = q.Put([]byte("late")); err != ErrDeleted {
+		t.Fatalf("Expect a detached queue to refuse messages, got %v", err)
+	}
+	if err = q.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	err = s.EachMessage(func(queue string, data []byte, deadline int64) error {
+		if queue != "jobs" || string(data) != strconv.Itoa(i) {
+			t.Fatalf("Expect message %d of jobs, got %q of %s", i, data, queue)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 100 {
+		t.Fatalf("Expect 100 messages, got %d", i)
+	}
+}
+
+func benchmarkQueue(b *testing.B, journal bool) (*CompositeQueue, func()) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		b.Fatal(err)
+	}
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		FileBlockUnit: 64 << 20,
+		Name:          "bench",
+		CacheSize:     10 << 20,
+		BackFile:      filepath.Join(dir, "bench.mq"),
+		Journal:       journal,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return q, func() {
+		q.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// the payload of the redis-benchmark run in README
+var benchmarkPayload = bytes.Repeat([]byte("a"), 76)
+
+func benchmarkPutGet(b *testing.B, journal bool) {
+	q, done := benchmarkQueue(b, journal)
+	defer done()
+	b.RunParallel(func(pb *testing.PB) {
+		buff := make([]byte, 128)
+		for pb.Next() {
+			q.Put(benchmarkPayload)
+			q.Get(buff)
+		}
+	})
+}
+
+// benchmarkPutGetBatch moves b.N messages in batches of 100, so ns/op is
+// comparable with benchmarkPutGet.
+func benchmarkPutGetBatch(b *testing.B, journal bool) {
+	q, done := benchmarkQueue(b, journal)
+	defer done()
+	const batchSize = 100
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = benchmarkPayload
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for {
+			for i := 0; i < batchSize; i++ {
+				if !pb.Next() {
+					return
+				}
+			}
+			q.PutBatch(batch)
+			q.GetBatch(batchSize)
+		}
+	})
+}
+
+func BenchmarkCompositeQueuePutGet(b *testing.B) {
+	benchmarkPutGet(b, false)
+}
+
+func BenchmarkCompositeQueuePutGetBatch(b *testing.B) {
+	benchmarkPutGetBatch(b, false)
+}
+
+func BenchmarkCompositeQueueJournalPutGet(b *testing.B) {
+	benchmarkPutGet(b, true)
+}
+
+func BenchmarkCompositeQueueJournalPutGetBatch(b *testing.B) {
+	benchmarkPutGetBatch(b, true)
+}
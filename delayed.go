@@ -0,0 +1,213 @@
+package mqueue
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	delayedAdd  byte = 1 // id, due time, a 4 bytes length and the message
+	delayedDone byte = 2 // id, the message was put in the queue
+
+	delayedAddSize = 21 // bytes of an add operation before the message
+)
+
+// timer is a message put with PutAt which is not due yet. Only the index is
+// kept in memory, the message is read back from the log when it is due.
+type timer struct {
+	id     uint64
+	due    time.Time
+	off    int64 // offset of the message in the log
+	length uint32
+}
+
+// timerHeap orders timers by due time, then by the order they were added.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].id < h[j].id
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h timerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(*timer)) }
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
+
+// delayed is the set of delayed messages of a CompositeQueue, backed by a
+// log so it survives restarts.
+type delayed struct {
+	sideLog
+	timers    timerHeap
+	lastID    uint64
+	relocated []int64 // offsets of the messages of timers in the log appendTimers buffered
+}
+
+// DelayedPath returns the delayed messages log of a queue whose back file is
+// backFile.
+func DelayedPath(backFile string) string {
+	return strings.TrimSuffix(backFile, ".mq") + ".delayed"
+}
+
+// openDelayed loads the delayed messages log at path, if any, and rewrites
+// it with only the messages not due yet.
+func openDelayed(path string) (*delayed, error) {
+	d := &delayed{sideLog: sideLog{path: path}}
+	d.isEmpty = d.empty
+	d.appendAll = d.appendTimers
+	d.rewritten = d.relocate
+	// the messages are read from the current log by the compaction
+	if err := d.loadOpen(d.replay); err != nil {
+		return nil, err
+	}
+	if err := d.compact(); err != nil {
+		d.close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// replay applies the operations read from r. A torn operation at the end of
+// the log, left by a crash, is ignored.
+func (d *delayed) replay(r *bufio.Reader) {
+	timers := make(map[uint64]*timer)
+	defer func() {
+		for _, t := range timers {
+			d.timers = append(d.timers, t)
+		}
+		heap.Init(&d.timers)
+	}()
+	var buff [20]byte
+	var pos int64
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch op {
+		case delayedAdd:
+			if _, err = io.ReadFull(r, buff[:20]); err != nil {
+				return
+			}
+			t := &timer{
+				id:     binary.LittleEndian.Uint64(buff[0:]),
+				due:    time.Unix(0, int64(binary.LittleEndian.Uint64(buff[8:]))),
+				off:    pos + delayedAddSize,
+				length: binary.LittleEndian.Uint32(buff[16:]),
+			}
+			if n, err := r.Discard(int(t.length)); err != nil || n != int(t.length) {
+				return
+			}
+			pos += delayedAddSize + int64(t.length)
+			timers[t.id] = t
+			if t.id > d.lastID {
+				d.lastID = t.id
+			}
+		case delayedDone:
+			if _, err = io.ReadFull(r, buff[:8]); err != nil {
+				return
+			}
+			pos += 9
+			delete(timers, binary.LittleEndian.Uint64(buff[0:]))
+		default:
+			return
+		}
+	}
+}
+
+// appendTimers buffers the operations which bring back the messages not due
+// yet, relocate makes the timers point at them once they replace the log. It
+// fails if a message can not be read, the timers keep the log they point at.
+func (d *delayed) appendTimers() error {
+	d.relocated = d.relocated[:0]
+	for _, t := range d.timers {
+		data, err := d.message(t)
+		if err != nil {
+			return fmt.Errorf("Failed to read delayed message from %s: %v", d.path, err)
+		}
+		d.relocated = append(d.relocated, int64(len(d.buff))+delayedAddSize)
+		d.appendAdd(t, data)
+	}
+	return nil
+}
+
+// relocate points the timers at their message in the log appendTimers
+// buffered, which replaced the former one.
+func (d *delayed) relocate() {
+	for i, t := range d.timers {
+		t.off = d.relocated[i]
+	}
+}
+
+func (d *delayed) empty() bool {
+	return len(d.timers) == 0
+}
+
+// add keeps data until due.
+func (d *delayed) add(data []byte, due time.Time) {
+	d.lastID++
+	t := &timer{
+		id:     d.lastID,
+		due:    due,
+		off:    d.size + int64(len(d.buff)) + delayedAddSize,
+		length: uint32(len(data)),
+	}
+	heap.Push(&d.timers, t)
+	d.appendAdd(t, data)
+}
+
+// next returns the message due first, nil if there is none.
+func (d *delayed) next() *timer {
+	if len(d.timers) == 0 {
+		return nil
+	}
+	return d.timers[0]
+}
+
+// message reads the message of t from the log, or from the operations not
+// written yet.
+func (d *delayed) message(t *timer) ([]byte, error) {
+	if t.off >= d.size {
+		start := t.off - d.size
+		return append([]byte{}, d.buff[start:start+int64(t.length)]...), nil
+	}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	data := make([]byte, t.length)
+	if _, err := d.file.ReadAt(data, t.off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pop drops the message returned by next, it was put in the queue.
+func (d *delayed) pop() {
+	t := heap.Pop(&d.timers).(*timer)
+	var buff [9]byte
+	buff[0] = delayedDone
+	binary.LittleEndian.PutUint64(buff[1:], t.id)
+	d.buff = append(d.buff, buff[:]...)
+}
+
+func (d *delayed) appendAdd(t *timer, data []byte) {
+	var buff [delayedAddSize]byte
+	buff[0] = delayedAdd
+	binary.LittleEndian.PutUint64(buff[1:], t.id)
+	binary.LittleEndian.PutUint64(buff[9:], uint64(t.due.UnixNano()))
+	binary.LittleEndian.PutUint32(buff[17:], t.length)
+	d.buff = append(d.buff, buff[:]...)
+	d.buff = append(d.buff, data...)
+}
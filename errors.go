@@ -8,4 +8,16 @@ var (
 	ErrNoSpace        = errors.New("No space left")
 	ErrPacketTooLarge = errors.New("Packet too large")
 	ErrEmpty          = errors.New("Empty")
+	ErrCorrupted      = errors.New("Corrupted data")
+	ErrBufferTooSmall = errors.New("Buffer too small")
+	ErrQueueFull      = errors.New("Queue full")
+	ErrDeleted        = errors.New("Queue deleted")
+	ErrRetained       = errors.New("Queue is read by consumer groups")
+	ErrNotRetained    = errors.New("Queue is not in log mode")
+	ErrNoGroup        = errors.New("No such consumer group")
+	ErrGroupExists    = errors.New("Consumer group already exists")
+	ErrPending        = errors.New("Queue has messages in flight or delayed")
+	ErrClosed         = errors.New("Queue closed")
+	ErrChanged        = errors.New("Oldest message changed")
+	ErrLocked         = errors.New("Queue file is used by another process")
 )
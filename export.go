@@ -0,0 +1,93 @@
+package mqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// Export calls fn with every message of the queue, oldest first, and its
+// expiry time in unix nanoseconds, 0 if it never expires, until fn returns
+// an error. The queue is captured like Backup does: it is only locked while
+// its segments are frozen, fn sees the messages of that instant and the
+// queue is not modified. data is only valid during the call.
+func (m *CompositeQueue) Export(fn func(data []byte, deadline int64) error) error {
+	m.lock.Lock()
+	if m.deleted {
+		m.lock.Unlock()
+		return ErrDeleted
+	}
+	s, err := m.snapshot()
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	return s.each(fn)
+}
+
+// each calls fn with the messages of the snapshot, oldest first.
+func (s *queueSnapshot) each(fn func(data []byte, deadline int64) error) error {
+	for _, data := range s.ready {
+		if err := fn(data, 0); err != nil {
+			return err
+		}
+	}
+	return s.eachStored(fn)
+}
+
+// eachStored calls fn with the stored messages of the snapshot, those of the
+// segments then those of the memory queue, without the released ones.
+func (s *queueSnapshot) eachStored(fn func(data []byte, deadline int64) error) error {
+	var buff []byte
+	var err error
+	for _, seg := range s.segments {
+		r := io.NewSectionReader(seg.file, int64(seg.from), int64(seg.to-seg.from))
+		if buff, err = eachRecord(r, seg.count, buff, fn); err != nil {
+			return err
+		}
+	}
+	_, err = eachRecord(bytes.NewReader(s.cache), s.cacheLen, buff, fn)
+	return err
+}
+
+// eachRecord calls fn with the count records read from r, they are read into
+// buff which is returned, grown to fit the largest one.
+func eachRecord(r io.Reader, count uint64, buff []byte, fn func(data []byte, deadline int64) error) ([]byte, error) {
+	br := bufio.NewReader(r)
+	for i := uint64(0); i < count; i++ {
+		var deadline int64
+		var err error
+		if buff, deadline, err = readRecord(br, buff); err != nil {
+			return buff, err
+		}
+		if err = fn(buff, deadline); err != nil {
+			return buff, err
+		}
+	}
+	return buff, nil
+}
+
+// readRecord reads the next record from r into buff[:0], which is grown if
+// the element does not fit, and returns the element and its deadline.
+func readRecord(r io.Reader, buff []byte) ([]byte, int64, error) {
+	var prefix [prefixSize]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return buff[:0], 0, err
+	}
+	length := binary.LittleEndian.Uint32(prefix[0:])
+	if uint64(cap(buff)) < uint64(length) {
+		buff = make([]byte, length)
+	}
+	buff = buff[:length]
+	if _, err := io.ReadFull(r, buff); err != nil {
+		return buff[:0], 0, err
+	}
+	sum := crc32.Checksum(prefix[lengthSize+checksumSize:], crcTable)
+	if crc32.Update(sum, crcTable, buff) != binary.LittleEndian.Uint32(prefix[lengthSize:]) {
+		return buff[:0], 0, ErrCorrupted
+	}
+	return buff, int64(binary.LittleEndian.Uint64(prefix[lengthSize+checksumSize:])), nil
+}
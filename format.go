@@ -0,0 +1,160 @@
+package mqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+const (
+	formatMagic          = "MQUE"
+	FormatVersion uint16 = 1 // version written by this release
+)
+
+var (
+	ErrBadFormat          = errors.New("Not a mqueue file")
+	ErrUnsupportedVersion = errors.New("Unsupported format version")
+)
+
+// A file of version 0, written by the releases without a format header, has
+// five bare uint64 fields, capacity first, and records framed by a 2 bytes
+// length without checksum nor deadline.
+const (
+	v0HeaderSize = 40
+	v0ReadPos    = 8
+	v0WritePos   = 16
+	v0LengthSize = 2
+)
+
+// FormatOf returns the format version of the queue file of size bytes that
+// starts with header. A file of version 0 has no magic, it is recognized by a
+// capacity matching its size and positions within its bounds.
+func FormatOf(header []byte, size uint64) (uint16, error) {
+	if len(header) >= headerSize && string(header[hMagic:hMagic+len(formatMagic)]) == formatMagic {
+		version := binary.LittleEndian.Uint16(header[hVersion:])
+		if version == 0 || version > FormatVersion {
+			return version, ErrUnsupportedVersion
+		}
+		return version, nil
+	}
+	if len(header) < v0HeaderSize || binary.LittleEndian.Uint64(header) != size {
+		return 0, ErrBadFormat
+	}
+	readPos := binary.LittleEndian.Uint64(header[v0ReadPos:])
+	writePos := binary.LittleEndian.Uint64(header[v0WritePos:])
+	if readPos < v0HeaderSize || readPos > writePos || writePos > size {
+		return 0, ErrBadFormat
+	}
+	return 0, nil
+}
+
+// UpgradeFile rewrites the queue file at path in the current format if it
+// has version 0, and returns the version it had. The new file is written
+// aside and renamed over the old one, so a crash during the upgrade leaves
+// the old file intact.
+func UpgradeFile(path string) (uint16, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err = LockFile(f, false); err != nil {
+		return 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() == 0 {
+		// created but never initialized, openSegment takes care of it
+		return FormatVersion, nil
+	}
+	header := make([]byte, headerSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	version, err := FormatOf(header[:n], uint64(stat.Size()))
+	if err != nil || version == FormatVersion {
+		return version, err
+	}
+
+	old, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		return version, err
+	}
+	defer old.Unmap()
+	records, size, err := v0Records(old)
+	if err != nil {
+		return version, err
+	}
+	if size < uint64(stat.Size()) {
+		size = uint64(stat.Size())
+	}
+
+	tmpPath := path + ".upgrade"
+	if err = writeQueueFile(tmpPath, size, records); err != nil {
+		os.Remove(tmpPath)
+		return version, err
+	}
+	return version, os.Rename(tmpPath, path)
+}
+
+// v0Records returns the unread records of a version 0 file, and the size of
+// a file holding them in the current format.
+func v0Records(m []byte) (records [][]byte, size uint64, err error) {
+	pos := binary.LittleEndian.Uint64(m[v0ReadPos:])
+	writePos := binary.LittleEndian.Uint64(m[v0WritePos:])
+	size = headerSize
+	for pos < writePos {
+		if pos+v0LengthSize > writePos {
+			return nil, 0, ErrCorrupted
+		}
+		length := uint64(binary.LittleEndian.Uint16(m[pos:]))
+		pos += v0LengthSize
+		if pos+length > writePos {
+			return nil, 0, ErrCorrupted
+		}
+		records = append(records, m[pos:pos+length])
+		size += prefixSize + length
+		pos += length
+	}
+	return records, size, nil
+}
+
+// writeQueueFile creates a queue file of size bytes holding records.
+func writeQueueFile(path string, size uint64, records [][]byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(int64(size)); err != nil {
+		return err
+	}
+	mapFile, err := mmap.Map(f, mmap.RDWR, 0)
+	if err != nil {
+		return err
+	}
+	q := MQueue(mapFile)
+	if err = InitMQueue(q); err == nil {
+		for _, r := range records {
+			if err = q.Put(r); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = mapFile.Flush()
+	}
+	if uErr := mapFile.Unmap(); err == nil {
+		err = uErr
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	return err
+}
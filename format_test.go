@@ -0,0 +1,104 @@
+package mqueue
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeV0File writes a queue file the way releases without a format header did.
+func writeV0File(t *testing.T, path string, records []string) {
+	m := make([]byte, 1024)
+	pos := uint64(40)
+	for _, r := range records {
+		binary.LittleEndian.PutUint16(m[pos:], uint16(len(r)))
+		pos += 2
+		pos += uint64(copy(m[pos:], r))
+	}
+	binary.LittleEndian.PutUint64(m[0:], uint64(len(m)))
+	binary.LittleEndian.PutUint64(m[8:], 40)
+	binary.LittleEndian.PutUint64(m[16:], pos)
+	binary.LittleEndian.PutUint64(m[32:], uint64(len(records)))
+	if err := ioutil.WriteFile(path, m, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpgradeV0File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backFile := filepath.Join(dir, "old.mq")
+	writeV0File(t, backFile, []string{"a", "bb", "ccc"})
+	q, err := OpenCompositionQueue(CompositeQueueOption{
+		Name:          "old",
+		BackFile:      backFile,
+		FileBlockUnit: 1024,
+		CacheSize:     128,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	buff := make([]byte, 16)
+	for _, want := range []string{"a", "bb", "ccc"} {
+		n, err := q.Get(buff)
+		if err != nil || string(buff[:n]) != want {
+			t.Fatalf("Unexpected record %q, %v, want %q", buff[:n], err, want)
+		}
+	}
+}
+
+func TestUpgradeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "v0.mq")
+	writeV0File(t, path, []string{"a", "bb"})
+	if version, err := UpgradeFile(path); err != nil || version != 0 {
+		t.Fatalf("Unexpected upgrade from %d, %v", version, err)
+	}
+	upgraded, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m MQueue = upgraded
+	if m.Version() != FormatVersion {
+		t.Fatalf("Unexpected version %d after upgrade", m.Version())
+	}
+	buff := make([]byte, 16)
+	for _, want := range []string{"a", "bb"} {
+		if m.frontDeadline() != 0 {
+			t.Fatal("Expect upgraded records to never expire")
+		}
+		n, err := m.Get(buff)
+		if err != nil || string(buff[:n]) != want {
+			t.Fatalf("Unexpected record %q, %v, want %q", buff[:n], err, want)
+		}
+	}
+	if version, err := UpgradeFile(path); err != nil || version != FormatVersion {
+		t.Fatalf("Expect a current file to be left as is, got %d, %v", version, err)
+	}
+}
+
+func TestFormatOfForeignFile(t *testing.T) {
+	header := make([]byte, headerSize)
+	copy(header, "not a queue at all")
+	if _, err := FormatOf(header, 4096); err != ErrBadFormat {
+		t.Fatalf("Expect ErrBadFormat, got %v", err)
+	}
+	var m MQueue = make([]byte, 128)
+	InitMQueue(m)
+	binary.LittleEndian.PutUint16(m[hVersion:], FormatVersion+1)
+	if _, err := FormatOf(m, 128); err != ErrUnsupportedVersion {
+		t.Fatalf("Expect ErrUnsupportedVersion, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package mqueue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FsyncPolicy tells when a CompositeQueue forces its data to the storage
+// device, the names follow the appendfsync setting of redis.
+type FsyncPolicy int
+
+const (
+	FsyncNo       FsyncPolicy = iota // leave it to the kernel writeback
+	FsyncEverySec                    // the owner of the queue calls Sync every second
+	FsyncAlways                      // sync after every Put and Get
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	default:
+		return "no"
+	}
+}
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	}
+	return FsyncNo, fmt.Errorf("Unknown fsync policy [%s]", s)
+}
@@ -0,0 +1,225 @@
+package mqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	groupsBase    byte = 1 // offset of the oldest message kept
+	groupsCreate  byte = 2 // offset, a 2 bytes length and the group name
+	groupsCommit  byte = 3 // offset, a 2 bytes length and the group name
+	groupsDestroy byte = 4 // a 2 bytes length and the group name
+)
+
+// Entry is a message read by a consumer group, with its offset in the queue.
+type Entry struct {
+	Offset uint64
+	Data   []byte
+}
+
+// group is a consumer group of a queue in log mode.
+type group struct {
+	next      uint64              // offset of the next message to deliver
+	committed uint64              // every message before it is acknowledged
+	pending   map[uint64]struct{} // offsets delivered and not acknowledged
+}
+
+// groups is the set of consumer groups of a CompositeQueue, backed by a log
+// so the offsets survive restarts. Only committed offsets are logged, the
+// messages pending when the queue is closed are delivered again.
+type groups struct {
+	sideLog
+	base      uint64 // offset of the oldest message of the queue
+	savedBase uint64 // base as last written to the log
+	groups    map[string]*group
+}
+
+// GroupsPath returns the consumer groups log of a queue whose back file is
+// backFile.
+func GroupsPath(backFile string) string {
+	return strings.TrimSuffix(backFile, ".mq") + ".groups"
+}
+
+// openGroups loads the consumer groups log at path, if any, and rewrites it
+// with only the current offsets.
+func openGroups(path string) (*groups, error) {
+	g := &groups{sideLog: sideLog{path: path}, groups: make(map[string]*group)}
+	g.isEmpty = g.empty
+	g.appendAll = g.appendOffsets
+	if err := g.load(g.replay); err != nil {
+		return nil, err
+	}
+	g.savedBase = g.base
+	if err := g.compact(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// replay applies the operations read from r. A torn operation at the end of
+// the log, left by a crash, is ignored.
+func (g *groups) replay(r *bufio.Reader) {
+	var buff [10]byte
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch op {
+		case groupsBase:
+			if _, err = io.ReadFull(r, buff[:8]); err != nil {
+				return
+			}
+			g.base = binary.LittleEndian.Uint64(buff[0:])
+		case groupsCreate, groupsCommit:
+			if _, err = io.ReadFull(r, buff[:10]); err != nil {
+				return
+			}
+			name := make([]byte, binary.LittleEndian.Uint16(buff[8:]))
+			if _, err = io.ReadFull(r, name); err != nil {
+				return
+			}
+			offset := binary.LittleEndian.Uint64(buff[0:])
+			if gr, ok := g.groups[string(name)]; ok {
+				gr.committed = offset
+				gr.next = offset
+			} else if op == groupsCreate {
+				g.groups[string(name)] = newGroup(offset)
+			}
+		case groupsDestroy:
+			if _, err = io.ReadFull(r, buff[:2]); err != nil {
+				return
+			}
+			name := make([]byte, binary.LittleEndian.Uint16(buff[0:]))
+			if _, err = io.ReadFull(r, name); err != nil {
+				return
+			}
+			delete(g.groups, string(name))
+		default:
+			return
+		}
+	}
+}
+
+func newGroup(offset uint64) *group {
+	return &group{next: offset, committed: offset, pending: make(map[uint64]struct{})}
+}
+
+// appendOffsets buffers the operations which bring back the base and the
+// committed offsets.
+func (g *groups) appendOffsets() error {
+	g.appendOffset(groupsBase, g.base)
+	for _, name := range g.names() {
+		g.appendGroup(groupsCreate, g.groups[name].committed, name)
+	}
+	return nil
+}
+
+// names returns the names of the groups, sorted.
+func (g *groups) names() []string {
+	names := make([]string, 0, len(g.groups))
+	for name := range g.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *groups) empty() bool {
+	return len(g.groups) == 0 && g.base == 0
+}
+
+// create adds the group name, which reads from offset.
+func (g *groups) create(name string, offset uint64) {
+	g.groups[name] = newGroup(offset)
+	g.appendGroup(groupsCreate, offset, name)
+}
+
+// destroy drops the group name.
+func (g *groups) destroy(name string) {
+	delete(g.groups, name)
+	var buff [3]byte
+	buff[0] = groupsDestroy
+	binary.LittleEndian.PutUint16(buff[1:], uint16(len(name)))
+	g.buff = append(append(g.buff, buff[:]...), name...)
+}
+
+// ack removes offset from the messages pending in the group name, and
+// returns false if it was not pending.
+func (g *groups) ack(name string, offset uint64) bool {
+	gr := g.groups[name]
+	if _, ok := gr.pending[offset]; !ok {
+		return false
+	}
+	delete(gr.pending, offset)
+	g.commit(name)
+	return true
+}
+
+// commit moves the committed offset of the group name to its oldest pending
+// message, or to the next message to deliver if none is pending.
+func (g *groups) commit(name string) {
+	gr := g.groups[name]
+	committed := gr.next
+	for offset := range gr.pending {
+		if offset < committed {
+			committed = offset
+		}
+	}
+	if committed != gr.committed {
+		gr.committed = committed
+		g.appendGroup(groupsCommit, committed, name)
+	}
+}
+
+// committed returns the oldest committed offset of all groups, false if
+// there is no group.
+func (g *groups) committed() (uint64, bool) {
+	var res uint64
+	found := false
+	for _, gr := range g.groups {
+		if !found || gr.committed < res {
+			res = gr.committed
+			found = true
+		}
+	}
+	return res, found
+}
+
+// saveBase logs the base if it moved since it was last written. The pending
+// messages dropped since then, e.g. by Trim, can not be acknowledged anymore
+// and are forgotten.
+func (g *groups) saveBase() {
+	if g.base == g.savedBase {
+		return
+	}
+	g.appendOffset(groupsBase, g.base)
+	g.savedBase = g.base
+	for name, gr := range g.groups {
+		for offset := range gr.pending {
+			if offset < g.base {
+				delete(gr.pending, offset)
+			}
+		}
+		g.commit(name)
+	}
+}
+
+func (g *groups) appendOffset(op byte, offset uint64) {
+	var buff [9]byte
+	buff[0] = op
+	binary.LittleEndian.PutUint64(buff[1:], offset)
+	g.buff = append(g.buff, buff[:]...)
+}
+
+func (g *groups) appendGroup(op byte, offset uint64, name string) {
+	var buff [11]byte
+	buff[0] = op
+	binary.LittleEndian.PutUint64(buff[1:], offset)
+	binary.LittleEndian.PutUint16(buff[9:], uint16(len(name)))
+	g.buff = append(append(g.buff, buff[:]...), name...)
+}
@@ -0,0 +1,261 @@
+package mqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultVisibilityTimeout is the lease of a reserved message when
+// CompositeQueueOption.VisibilityTimeout is not set.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+const (
+	inflightLease   byte = 1 // id, deadline, deliveries, a 4 bytes length and the message
+	inflightRelease byte = 2 // id, the message waits to be delivered again
+	inflightRenew   byte = 3 // id, new id and deadline, a released message was delivered again
+	inflightDone    byte = 4 // id, the message was acknowledged or consumed
+)
+
+// pending is a message delivered by Reserve which was not acknowledged yet.
+type pending struct {
+	id         uint64
+	deadline   time.Time // when the lease expires, zero once released
+	deliveries uint32    // how many times the message was delivered
+	data       []byte
+}
+
+// inflight is the set of reserved messages of a CompositeQueue, backed by a
+// log so it survives restarts. Released messages wait in ready and are
+// delivered again before the rest of the queue.
+type inflight struct {
+	sideLog
+	leased map[uint64]*pending
+	ready  []*pending // released messages, oldest release first
+	lastID uint64
+}
+
+// InflightPath returns the in-flight log of a queue whose back file is backFile.
+func InflightPath(backFile string) string {
+	return strings.TrimSuffix(backFile, ".mq") + ".inflight"
+}
+
+// openInflight loads the in-flight log at path, if any, and rewrites it with
+// only the messages still in flight.
+func openInflight(path string) (*inflight, error) {
+	f := &inflight{sideLog: sideLog{path: path}, leased: make(map[uint64]*pending)}
+	f.isEmpty = f.empty
+	f.appendAll = f.appendLeases
+	if err := f.load(f.replay); err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// replay applies the operations read from r. A torn operation at the end of
+// the log, left by a crash, is ignored.
+func (f *inflight) replay(r *bufio.Reader) {
+	var buff [24]byte
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch op {
+		case inflightLease:
+			if _, err = io.ReadFull(r, buff[:24]); err != nil {
+				return
+			}
+			p := &pending{
+				id:         binary.LittleEndian.Uint64(buff[0:]),
+				deadline:   time.Unix(0, int64(binary.LittleEndian.Uint64(buff[8:]))),
+				deliveries: binary.LittleEndian.Uint32(buff[16:]),
+			}
+			// a torn length may be huge, only allocate what is actually there
+			length := int64(binary.LittleEndian.Uint32(buff[20:]))
+			p.data, err = ioutil.ReadAll(io.LimitReader(r, length))
+			if err != nil || int64(len(p.data)) != length {
+				return
+			}
+			f.leased[p.id] = p
+			f.seen(p.id)
+		case inflightRelease, inflightDone:
+			if _, err = io.ReadFull(r, buff[:8]); err != nil {
+				return
+			}
+			id := binary.LittleEndian.Uint64(buff[0:])
+			if p, ok := f.leased[id]; ok {
+				delete(f.leased, id)
+				if op == inflightRelease {
+					p.deadline = time.Time{}
+					f.ready = append(f.ready, p)
+				}
+			} else if op == inflightDone {
+				f.removeReady(id)
+			}
+		case inflightRenew:
+			if _, err = io.ReadFull(r, buff[:24]); err != nil {
+				return
+			}
+			if p := f.removeReady(binary.LittleEndian.Uint64(buff[0:])); p != nil {
+				p.id = binary.LittleEndian.Uint64(buff[8:])
+				p.deadline = time.Unix(0, int64(binary.LittleEndian.Uint64(buff[16:])))
+				p.deliveries++
+				f.leased[p.id] = p
+				f.seen(p.id)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (f *inflight) seen(id uint64) {
+	if id > f.lastID {
+		f.lastID = id
+	}
+}
+
+func (f *inflight) removeReady(id uint64) *pending {
+	for i, p := range f.ready {
+		if p.id == id {
+			f.ready = append(f.ready[:i], f.ready[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
+// appendLeases buffers the operations which bring back the messages in flight.
+func (f *inflight) appendLeases() error {
+	for _, id := range f.leasedIDs() {
+		f.appendLease(f.leased[id])
+	}
+	for _, p := range f.ready {
+		f.appendLease(p)
+		f.appendID(inflightRelease, p.id)
+	}
+	return nil
+}
+
+// leasedIDs returns the ids of the leased messages in delivery order.
+func (f *inflight) leasedIDs() []uint64 {
+	ids := make([]uint64, 0, len(f.leased))
+	for id := range f.leased {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (f *inflight) empty() bool {
+	return len(f.leased) == 0 && len(f.ready) == 0
+}
+
+// lease adds a copy of data to the set until deadline.
+func (f *inflight) lease(data []byte, deadline time.Time) *pending {
+	f.lastID++
+	p := &pending{
+		id:         f.lastID,
+		deadline:   deadline,
+		deliveries: 1,
+		data:       append([]byte{}, data...),
+	}
+	f.leased[p.id] = p
+	f.appendLease(p)
+	return p
+}
+
+// renew delivers the oldest released message again until deadline.
+func (f *inflight) renew(deadline time.Time) *pending {
+	p := f.ready[0]
+	f.ready = f.ready[1:]
+	f.lastID++
+	var buff [25]byte
+	buff[0] = inflightRenew
+	binary.LittleEndian.PutUint64(buff[1:], p.id)
+	binary.LittleEndian.PutUint64(buff[9:], f.lastID)
+	binary.LittleEndian.PutUint64(buff[17:], uint64(deadline.UnixNano()))
+	f.buff = append(f.buff, buff[:]...)
+	p.id = f.lastID
+	p.deadline = deadline
+	p.deliveries++
+	f.leased[p.id] = p
+	return p
+}
+
+// release makes the leased message id wait for its next delivery.
+func (f *inflight) release(id uint64) bool {
+	p, ok := f.leased[id]
+	if !ok {
+		return false
+	}
+	delete(f.leased, id)
+	p.deadline = time.Time{}
+	f.ready = append(f.ready, p)
+	f.appendID(inflightRelease, id)
+	return true
+}
+
+// done drops the leased message id.
+func (f *inflight) done(id uint64) bool {
+	if _, ok := f.leased[id]; !ok {
+		return false
+	}
+	delete(f.leased, id)
+	f.appendID(inflightDone, id)
+	return true
+}
+
+// popReady drops the oldest released message, it was consumed.
+func (f *inflight) popReady() {
+	p := f.ready[0]
+	f.ready[0] = nil
+	f.ready = f.ready[1:]
+	f.appendID(inflightDone, p.id)
+}
+
+// expired returns the ids of the leases which expire before now, oldest first.
+func (f *inflight) expired(now time.Time) []uint64 {
+	var ids []uint64
+	for _, id := range f.leasedIDs() {
+		if f.leased[id].deadline.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// readyBytes returns the size of the released messages, record headers included.
+func (f *inflight) readyBytes() uint64 {
+	var n uint64
+	for _, p := range f.ready {
+		n += prefixSize + uint64(len(p.data))
+	}
+	return n
+}
+
+func (f *inflight) appendLease(p *pending) {
+	var buff [25]byte
+	buff[0] = inflightLease
+	binary.LittleEndian.PutUint64(buff[1:], p.id)
+	binary.LittleEndian.PutUint64(buff[9:], uint64(p.deadline.UnixNano()))
+	binary.LittleEndian.PutUint32(buff[17:], p.deliveries)
+	binary.LittleEndian.PutUint32(buff[21:], uint32(len(p.data)))
+	f.buff = append(f.buff, buff[:]...)
+	f.buff = append(f.buff, p.data...)
+}
+
+func (f *inflight) appendID(op byte, id uint64) {
+	var buff [9]byte
+	buff[0] = op
+	binary.LittleEndian.PutUint64(buff[1:], id)
+	f.buff = append(f.buff, buff[:]...)
+}
@@ -0,0 +1,118 @@
+package mqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// Record is a record of a queue as found by Walk.
+type Record struct {
+	Pos      uint64 // offset of the record in the queue
+	Deadline int64  // expiry time in unix nanoseconds, 0 if none
+	Data     []byte // the element, only valid until the queue is modified
+	Valid    bool   // false if the checksum does not match
+}
+
+// CheckHeader tells whether the header of m describes a queue of its size
+// whose positions can be walked, and what is wrong with it otherwise.
+func (m MQueue) CheckHeader() error {
+	if len(m) < headerSize {
+		return fmt.Errorf("size %d is smaller than the header", len(m))
+	}
+	if m.Capacity() != uint64(len(m)) {
+		return fmt.Errorf("capacity %d does not match size %d", m.Capacity(), len(m))
+	}
+	readPos := m.ReadPosition()
+	writePos := m.WritePosition()
+	if readPos < headerSize || readPos > writePos || writePos > m.Capacity() {
+		return fmt.Errorf("read position %d and write position %d are out of bounds", readPos, writePos)
+	}
+	return nil
+}
+
+// Walk calls fn with every record between the read and the write position,
+// whether its checksum matches or not, until fn returns false. It returns the
+// end of the last record passed to fn, which is before the write position if
+// the next record is torn. The header must pass CheckHeader.
+func (m MQueue) Walk(fn func(r Record) bool) uint64 {
+	writePos := m.WritePosition()
+	pos := m.ReadPosition()
+	for pos+prefixSize <= writePos {
+		end := pos + prefixSize + m.recordLength(pos)
+		if end > writePos {
+			break
+		}
+		r := Record{
+			Pos:      pos,
+			Deadline: m.recordDeadline(pos),
+			Data:     m[pos+prefixSize : end],
+			Valid:    m.recordChecksum(pos, end) == binary.LittleEndian.Uint32(m[pos+lengthSize:]),
+		}
+		pos = end
+		if !fn(r) {
+			break
+		}
+	}
+	return pos
+}
+
+// QueueFile is a queue file mapped by OpenQueueFile, for tools which look
+// into a queue while no server has it open.
+type QueueFile struct {
+	MQueue
+	file    *os.File
+	mapFile mmap.MMap
+}
+
+// OpenQueueFile maps the queue file at path, read only unless writable. It
+// fails with ErrLocked while a server has the file open.
+func OpenQueueFile(path string, writable bool) (*QueueFile, error) {
+	flag, prot := os.O_RDONLY, mmap.RDONLY
+	if writable {
+		flag, prot = os.O_RDWR, mmap.RDWR
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = LockFile(file, !writable); err != nil {
+		file.Close()
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		// an empty file can not be mapped
+		file.Close()
+		return nil, ErrBadFormat
+	}
+	mapFile, err := mmap.Map(file, prot, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &QueueFile{MQueue: MQueue(mapFile), file: file, mapFile: mapFile}, nil
+}
+
+// Sync writes the changes to the storage device.
+func (f *QueueFile) Sync() error {
+	if err := f.mapFile.Flush(); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *QueueFile) Close() error {
+	err := f.mapFile.Unmap()
+	if cErr := f.file.Close(); err == nil {
+		err = cErr
+	}
+	f.MQueue = nil
+	return err
+}
@@ -0,0 +1,166 @@
+package mqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	journalPut byte = 1 // followed by a 4 bytes length and the element
+	journalGet byte = 2 // the oldest record of the memory queue was consumed
+	// followed by the 8 bytes sequence and write count of the last segment,
+	// the memory queue is being transferred to the segments from there
+	journalTransfer byte = 3
+	// followed by the 8 bytes deadline of the element, then as journalPut
+	journalPutDeadline byte = 4
+)
+
+// journal is a write-ahead log of the memory queue of a CompositeQueue,
+// it lets records which only live in memory survive a process crash.
+// The journal is emptied every time the memory queue is drained or
+// transferred to the segments.
+type journal struct {
+	path string
+	file *os.File
+	buff []byte // operations not written yet
+}
+
+// JournalPath returns the journal file of a queue whose back file is backFile.
+func JournalPath(backFile string) string {
+	return strings.TrimSuffix(backFile, ".mq") + ".journal"
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{path: path, file: f}, nil
+}
+
+// replay calls put, get and transfer for every operation in the journal, in
+// order. A torn operation at the end of the file, left by a crash, is ignored.
+func (j *journal) replay(put func(data []byte, deadline int64) error, get func(), transfer func(seq, count uint64)) error {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(j.file)
+	var lenBuff [lengthSize]byte
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if op == journalGet {
+			get()
+			continue
+		}
+		if op == journalTransfer {
+			var buff [16]byte
+			if _, err = io.ReadFull(r, buff[:]); err != nil {
+				break
+			}
+			transfer(binary.LittleEndian.Uint64(buff[:]), binary.LittleEndian.Uint64(buff[8:]))
+			continue
+		}
+		var deadline int64
+		if op == journalPutDeadline {
+			var buff [deadlineSize]byte
+			if _, err = io.ReadFull(r, buff[:]); err != nil {
+				break
+			}
+			deadline = int64(binary.LittleEndian.Uint64(buff[:]))
+		} else if op != journalPut {
+			break
+		}
+		if _, err = io.ReadFull(r, lenBuff[:]); err != nil {
+			break
+		}
+		// a torn length may be huge, only allocate what is actually there
+		length := int64(binary.LittleEndian.Uint32(lenBuff[:]))
+		data, err := ioutil.ReadAll(io.LimitReader(r, length))
+		if err != nil || int64(len(data)) != length {
+			break
+		}
+		if err = put(data, deadline); err != nil {
+			return err
+		}
+	}
+	_, err := j.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// put buffers a put operation, it is written by the next flush.
+func (j *journal) put(data []byte, deadline int64) {
+	var lenBuff [lengthSize]byte
+	binary.LittleEndian.PutUint32(lenBuff[:], uint32(len(data)))
+	if deadline != 0 {
+		var buff [deadlineSize]byte
+		binary.LittleEndian.PutUint64(buff[:], uint64(deadline))
+		j.buff = append(j.buff, journalPutDeadline)
+		j.buff = append(j.buff, buff[:]...)
+	} else {
+		j.buff = append(j.buff, journalPut)
+	}
+	j.buff = append(j.buff, lenBuff[:]...)
+	j.buff = append(j.buff, data...)
+}
+
+// get buffers a get operation, it is written by the next flush.
+func (j *journal) get() {
+	j.buff = append(j.buff, journalGet)
+}
+
+// transfer writes a transfer operation right away, seq and count tell where
+// the records of the memory queue start in the segments. A crash before the
+// journal is reset then does not replay the records that made it there.
+func (j *journal) transfer(seq, count uint64) error {
+	var buff [17]byte
+	buff[0] = journalTransfer
+	binary.LittleEndian.PutUint64(buff[1:], seq)
+	binary.LittleEndian.PutUint64(buff[9:], count)
+	j.buff = append(j.buff, buff[:]...)
+	return j.flush()
+}
+
+// flush writes the buffered operations with a single write.
+func (j *journal) flush() error {
+	if len(j.buff) == 0 {
+		return nil
+	}
+	_, err := j.file.Write(j.buff)
+	j.buff = j.buff[:0]
+	return err
+}
+
+// reset drops every operation, it is called once the memory queue holds
+// nothing that is not on disk already.
+func (j *journal) reset() error {
+	j.buff = j.buff[:0]
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (j *journal) sync() error {
+	if err := j.flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// remove closes the journal and deletes its file.
+func (j *journal) remove() error {
+	j.close()
+	return os.Remove(j.path)
+}
@@ -3,28 +3,42 @@ package mqueue
 import (
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
 )
 
 type MQueue []byte
 
 const (
-	hCapacity   = iota
+	hMagic      = iota * 8 // 4 bytes magic, 2 bytes format version, 2 bytes flags
+	hCapacity   = iota * 8
 	hReadPos    = iota * 8
 	hWritePos   = iota * 8
 	hReadCount  = iota * 8
 	hWriteCount = iota * 8
 	headerSize  = iota * 8
+
+	hVersion = hMagic + 4
+	hFlags   = hMagic + 6
 )
 
 const (
-	prefixSize       uint64 = 2 // we encode an element length with 2 bytes
-	MaxElementLength uint16 = (1 << 16) - 2
+	lengthSize   uint64 = 4 // we encode an element length with 4 bytes
+	checksumSize uint64 = 4 // followed by the crc32 of the deadline and the element
+	deadlineSize uint64 = 8 // followed by the expiry time in unix nanoseconds, 0 if none
+
+	prefixSize       uint64 = lengthSize + checksumSize + deadlineSize // record header before the element
+	MaxElementLength uint32 = (1 << 32) - 1
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 func InitMQueue(m MQueue) error {
 	if len(m) < headerSize {
 		return errors.New("provide capacity too small")
 	}
+	copy(m[hMagic:], formatMagic)
+	binary.LittleEndian.PutUint16(m[hVersion:], FormatVersion)
+	binary.LittleEndian.PutUint16(m[hFlags:], 0)
 	m.setCapacity(uint64(len(m)))
 	m.reset()
 	return nil
@@ -37,6 +51,14 @@ func (m MQueue) reset() {
 	m.setWritePosition(headerSize)
 }
 
+func (m MQueue) Version() uint16 {
+	return binary.LittleEndian.Uint16(m[hVersion:])
+}
+
+func (m MQueue) Flags() uint16 {
+	return binary.LittleEndian.Uint16(m[hFlags:])
+}
+
 func (m MQueue) ReadPosition() uint64 {
 	return binary.LittleEndian.Uint64(m[hReadPos:])
 }
@@ -77,9 +99,42 @@ func (m MQueue) setWriteCount(v uint64) {
 	binary.LittleEndian.PutUint64(m[hWriteCount:], v)
 }
 
+// recordLength returns the element length of the record at pos.
+func (m MQueue) recordLength(pos uint64) uint64 {
+	return uint64(binary.LittleEndian.Uint32(m[pos:]))
+}
+
+// recordDeadline returns the expiry time of the record at pos.
+func (m MQueue) recordDeadline(pos uint64) int64 {
+	return int64(binary.LittleEndian.Uint64(m[pos+lengthSize+checksumSize:]))
+}
+
+// recordChecksum returns the crc32 of the record at pos whose element ends at end.
+func (m MQueue) recordChecksum(pos, end uint64) uint32 {
+	sum := crc32.Checksum(m[pos+lengthSize+checksumSize:pos+prefixSize], crcTable)
+	return crc32.Update(sum, crcTable, m[pos+prefixSize:end])
+}
+
+// writeRecord encodes data with deadline at pos and returns the end of the record.
+func (m MQueue) writeRecord(pos uint64, data []byte, deadline int64) uint64 {
+	end := pos + prefixSize + uint64(len(data))
+	binary.LittleEndian.PutUint32(m[pos:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(m[pos+lengthSize+checksumSize:], uint64(deadline))
+	copy(m[pos+prefixSize:], data)
+	binary.LittleEndian.PutUint32(m[pos+lengthSize:], m.recordChecksum(pos, end))
+	return end
+}
+
 func (m MQueue) Put(data []byte) error {
+	return m.PutDeadline(data, 0)
+}
+
+// PutDeadline appends data which expires at deadline, in unix nanoseconds,
+// 0 means it never expires. The queue only stores the deadline, it is up to
+// the reader to skip expired elements.
+func (m MQueue) PutDeadline(data []byte, deadline int64) error {
 	pLen := len(data)
-	if pLen > int(MaxElementLength) {
+	if uint64(pLen) > uint64(MaxElementLength) {
 		return ErrPacketTooLarge
 	}
 	cap := m.Capacity()
@@ -87,38 +142,179 @@ func (m MQueue) Put(data []byte) error {
 	if (writePos + uint64(len(data)) + prefixSize) > cap {
 		return ErrNoSpace
 	}
-	binary.LittleEndian.PutUint16(m[writePos:], uint16(pLen))
-	writePos += prefixSize
-	copy(m[writePos:], data)
-	writePos += uint64(pLen)
-	m.setWritePosition(writePos)
+	m.setWritePosition(m.writeRecord(writePos, data, deadline))
 	m.setWriteCount(m.WriteCount() + 1)
 	return nil
 }
 
+// PutBatch appends the elements of data in order until one does not fit,
+// the header is updated once. It returns how many elements were written.
+func (m MQueue) PutBatch(data [][]byte) (int, error) {
+	return m.PutBatchDeadline(data, 0)
+}
+
+// PutBatchDeadline is PutBatch for elements which expire at deadline.
+func (m MQueue) PutBatchDeadline(data [][]byte, deadline int64) (int, error) {
+	cap := m.Capacity()
+	writePos := m.WritePosition()
+	n := 0
+	var err error
+	for _, d := range data {
+		if uint64(len(d)) > uint64(MaxElementLength) {
+			err = ErrPacketTooLarge
+			break
+		}
+		if writePos+prefixSize+uint64(len(d)) > cap {
+			err = ErrNoSpace
+			break
+		}
+		writePos = m.writeRecord(writePos, d, deadline)
+		n++
+	}
+	if n > 0 {
+		m.setWritePosition(writePos)
+		m.setWriteCount(m.WriteCount() + uint64(n))
+	}
+	return n, err
+}
+
+// GetBatch consumes up to max elements, oldest first, and returns a copy of
+// each. The header is updated once.
+func (m MQueue) GetBatch(max int) ([][]byte, error) {
+	return m.GetBatchAt(max, 0)
+}
+
+// GetBatchAt is GetBatch stopping before the first element which expired at
+// now, in unix nanoseconds, 0 ignores the deadlines.
+func (m MQueue) GetBatchAt(max int, now int64) ([][]byte, error) {
+	available := m.Len()
+	if available == 0 {
+		return nil, ErrEmpty
+	}
+	if uint64(max) < available {
+		available = uint64(max)
+	}
+	// copy into one buffer, then slice it, to allocate once per batch
+	var buff []byte
+	ends := make([]int, 0, available)
+	writePos := m.WritePosition()
+	pos := m.ReadPosition()
+	for uint64(len(ends)) < available {
+		end := pos + prefixSize + m.recordLength(pos)
+		if end > writePos {
+			return nil, ErrCorrupted
+		}
+		if deadline := m.recordDeadline(pos); now != 0 && deadline != 0 && deadline <= now {
+			break
+		}
+		buff = append(buff, m[pos+prefixSize:end]...)
+		ends = append(ends, len(buff))
+		pos = end
+	}
+	res := make([][]byte, len(ends))
+	start := 0
+	for i, end := range ends {
+		res[i] = buff[start:end:end]
+		start = end
+	}
+	count := uint64(len(ends))
+	if m.ReadCount()+count == m.WriteCount() {
+		m.reset()
+	} else if count > 0 {
+		m.setReadPosition(pos)
+		m.setReadCount(m.ReadCount() + count)
+	}
+	return res, nil
+}
+
 func (m MQueue) Len() uint64 {
 	return m.WriteCount() - m.ReadCount()
 }
 
+// Get copies the oldest element into buff and consumes it. If buff is too
+// small, ErrBufferTooSmall is returned and the element stays in the queue.
 func (m MQueue) Get(buff []byte) (n int, err error) {
-	writeCount := m.WriteCount()
-	readCount := m.ReadCount()
-	if writeCount-readCount == 0 {
-		err = ErrEmpty
+	data, err := m.front()
+	if err != nil {
 		return
 	}
+	if len(data) > len(buff) {
+		err = ErrBufferTooSmall
+		return
+	}
+	n = copy(buff, data)
+	m.discard()
+	return
+}
+
+// Peek copies the oldest element into buff without consuming it.
+func (m MQueue) Peek(buff []byte) (n int, err error) {
+	data, err := m.front()
+	if err != nil {
+		return
+	}
+	if len(data) > len(buff) {
+		err = ErrBufferTooSmall
+		return
+	}
+	return copy(buff, data), nil
+}
+
+// Range calls fn with the unread elements from index start to stop, both
+// included and counted from the oldest, until fn returns false. The slices
+// passed to fn are only valid until the queue is modified.
+func (m MQueue) Range(start, stop uint64, fn func(data []byte) bool) error {
+	writePos := m.WritePosition()
+	pos := m.ReadPosition()
+	for i := uint64(0); i <= stop && pos < writePos; i++ {
+		length := m.recordLength(pos)
+		end := pos + prefixSize + length
+		if end > writePos {
+			return ErrCorrupted
+		}
+		if i >= start && !fn(m[pos+prefixSize:end]) {
+			return nil
+		}
+		pos = end
+	}
+	return nil
+}
+
+// front returns the oldest element without consuming it, the slice is only
+// valid until the queue is modified.
+func (m MQueue) front() ([]byte, error) {
+	if m.Len() == 0 {
+		return nil, ErrEmpty
+	}
 	readPtr := m.ReadPosition()
-	blockLength := binary.LittleEndian.Uint16(m[readPtr:])
+	blockLength := m.recordLength(readPtr)
 	readPtr += prefixSize
-	n = copy(buff, m[readPtr:readPtr+uint64(blockLength)])
-	readCount++
-	if readCount == writeCount {
+	if readPtr+blockLength > m.WritePosition() {
+		return nil, ErrCorrupted
+	}
+	return m[readPtr : readPtr+blockLength], nil
+}
+
+// frontDeadline returns the expiry time of the oldest element, the queue
+// must not be empty.
+func (m MQueue) frontDeadline() int64 {
+	return m.recordDeadline(m.ReadPosition())
+}
+
+// discard consumes the oldest element, the queue must not be empty.
+func (m MQueue) discard() {
+	readCount := m.ReadCount() + 1
+	if readCount == m.WriteCount() {
 		m.reset()
 	} else {
-		m.setReadPosition(readPtr + uint64(blockLength))
+		m.setReadPosition(m.ReadPosition() + m.frontSize())
 		m.setReadCount(readCount)
 	}
-	return
+}
+
+// frontSize returns the encoded size of the oldest record.
+func (m MQueue) frontSize() uint64 {
+	return prefixSize + m.recordLength(m.ReadPosition())
 }
 
 func (m MQueue) ReadableBytes() uint64 {
@@ -129,17 +325,34 @@ func (m MQueue) freeSpace() uint64 {
 	return m.Capacity() - m.WritePosition()
 }
 
-func (m MQueue) WriteTo(other MQueue) error {
-	transferBytes := m.ReadableBytes()
-	if other.freeSpace() < transferBytes {
-		return ErrNoSpace
-	}
-
+// MoveTo moves as many records as fit into the free space of other, oldest
+// first, and returns the number of records moved.
+func (m MQueue) MoveTo(other MQueue) uint64 {
 	readPos := m.ReadPosition()
-	copy(other[other.WritePosition():], m[readPos:readPos+transferBytes])
-	other.setWritePosition(other.WritePosition() + transferBytes)
-	other.setWriteCount(other.WriteCount() + m.Len())
+	writePos := m.WritePosition()
+	free := other.freeSpace()
+	end := readPos
+	var count uint64
+	for end < writePos {
+		next := end + prefixSize + m.recordLength(end)
+		if next-readPos > free {
+			break
+		}
+		end = next
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+	copy(other[other.WritePosition():], m[readPos:end])
+	other.setWritePosition(other.WritePosition() + end - readPos)
+	other.setWriteCount(other.WriteCount() + count)
 
-	m.reset()
-	return nil
+	if end == writePos {
+		m.reset()
+	} else {
+		m.setReadPosition(end)
+		m.setReadCount(m.ReadCount() + count)
+	}
+	return count
 }
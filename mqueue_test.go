@@ -44,3 +44,78 @@ func TestInitMQueue(t *testing.T) {
 		}
 	}
 }
+
+func TestMQueueRecover(t *testing.T) {
+	build := func() MQueue {
+		var m MQueue = make([]byte, 1024)
+		InitMQueue(m)
+		for i := 0; i < 5; i++ {
+			if err := m.Put([]byte{byte(i), byte(i), byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// flip a bit in the payload of the third record
+		m[headerSize+2*(prefixSize+3)+prefixSize] ^= 1
+		return m
+	}
+	drain := func(m MQueue) []byte {
+		var res []byte
+		buff := make([]byte, 16)
+		for {
+			n, err := m.Get(buff)
+			if err != nil {
+				return res
+			}
+			res = append(res, buff[:n][0])
+		}
+	}
+
+	m := build()
+	if _, err := m.Recover(RecoverRefuse); err != ErrCorrupted {
+		t.Fatalf("Expect ErrCorrupted, got %v", err)
+	}
+	if m.Len() != 5 {
+		t.Fatalf("Refuse must not modify the queue, len %d", m.Len())
+	}
+
+	m = build()
+	report, err := m.Recover(RecoverTruncate)
+	if err != nil || report.Records != 2 || report.BadRecords != 1 {
+		t.Fatalf("Unexpected truncate report %+v, %v", report, err)
+	}
+	if got := drain(m); string(got) != "\x00\x01" {
+		t.Fatalf("Unexpected records after truncate %v", got)
+	}
+
+	m = build()
+	report, err = m.Recover(RecoverSkip)
+	if err != nil || report.Records != 4 || report.BadRecords != 1 {
+		t.Fatalf("Unexpected skip report %+v, %v", report, err)
+	}
+	if got := drain(m); string(got) != "\x00\x01\x03\x04" {
+		t.Fatalf("Unexpected records after skip %v", got)
+	}
+}
+
+func TestMQueueBatch(t *testing.T) {
+	var m MQueue = make([]byte, 128)
+	InitMQueue(m)
+	data := [][]byte{[]byte("one"), []byte("two"), []byte("three"), make([]byte, 100)}
+	n, err := m.PutBatch(data)
+	if n != 3 || err != ErrNoSpace {
+		t.Fatalf("Unexpected batch put %d, %v", n, err)
+	}
+	res, err := m.GetBatch(2)
+	if err != nil || len(res) != 2 || string(res[0]) != "one" || string(res[1]) != "two" {
+		t.Fatalf("Unexpected batch get %q, %v", res, err)
+	}
+	if res, err = m.GetBatch(10); err != nil || len(res) != 1 || string(res[0]) != "three" {
+		t.Fatalf("Unexpected batch get %q, %v", res, err)
+	}
+	if m.ReadPosition() != headerSize || m.Len() != 0 {
+		t.Fatal("Drained queue is not reset")
+	}
+	if _, err = m.GetBatch(1); err != ErrEmpty {
+		t.Fatalf("Expect ErrEmpty, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package mqueue
+
+import "time"
+
+// OpKind is what an Op did to the stored messages of a queue.
+type OpKind int
+
+const (
+	OpPut     OpKind = iota // a message was stored at the tail
+	OpDiscard               // the oldest stored message was consumed
+)
+
+// Op is a change of the stored messages of a queue, as passed to
+// option.Observer. Applying the ops of a queue in order to a copy captured by
+// Capture keeps the copy equal to the queue, e.g. on a replica.
+//
+// The messages handed to a consumer waiting on Chan are never stored, and the
+// messages released after Reserve are not stored again: Capture leaves them
+// out and consuming them is no op. The in-flight, delayed and consumer group
+// state of the queue has no ops either.
+type Op struct {
+	Kind     OpKind
+	Data     []byte // message of OpPut, only valid during the call
+	Deadline int64  // expiry time of the message of OpPut in unix nanoseconds, 0 if none
+}
+
+func (m *CompositeQueue) observe(op Op) {
+	if m.option.Observer != nil {
+		m.option.Observer(op)
+	}
+}
+
+// Apply does op, observed on another queue, to this one. A message is stored
+// even if it exceeds the limits of the queue and is not handed to a consumer
+// waiting on Chan, the oldest message is discarded even if it expired.
+func (m *CompositeQueue) Apply(op Op) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return ErrDeleted
+	}
+	switch op.Kind {
+	case OpPut:
+		if err := m.store(op.Data, op.Deadline); err != nil {
+			return err
+		}
+	case OpDiscard:
+		if _, err := m.head(); err != nil {
+			return err
+		}
+		m.discardFront()
+	}
+	return m.commit()
+}
+
+// PopAt is Pop at the time now instead of the current time, the messages
+// which expire before now are skipped. Copies of a queue, e.g. on the nodes of
+// a cluster, pop the same messages with the same now whenever they pop them.
+func (m *CompositeQueue) PopAt(buff []byte, now time.Time) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleted {
+		return buff[:0], ErrEmpty
+	}
+	if m.groups != nil {
+		return buff[:0], ErrRetained
+	}
+	data, err := m.frontAt(now.UnixNano())
+	if err != nil {
+		return buff[:0], err
+	}
+	buff = append(buff[:0], data...)
+	m.discardFront()
+	m.commitOrLog()
+	return buff, nil
+}
+
+// MoveToAt is MoveTo at the time now instead of the current time, like
+// PopAt.
+func (m *CompositeQueue) MoveToAt(dst *CompositeQueue, now time.Time) ([]byte, error) {
+	unlock := lockPair(m, dst)
+	defer unlock()
+	if err := m.checkMove(dst); err != nil {
+		return nil, err
+	}
+	front, err := m.frontAt(now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte{}, front...)
+	return data, m.moveFront(dst, data, now)
+}
+
+// Snapshot is the stored messages of several queues at a single instant, as
+// captured by Capture.
+type Snapshot struct {
+	queues []*queueSnapshot
+}
+
+// Capture captures queues at a single instant like Backup does, and calls
+// locked, if not nil, while they are all locked, e.g. to note which ops came
+// before that instant. Close releases the snapshot once it was read.
+func Capture(queues []*CompositeQueue, locked func()) (*Snapshot, error) {
+	snaps, err := snapshotAll(queues, locked)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{queues: snaps}, nil
+}
+
+// Each calls fn with the stored messages of the snapshot, queue by queue and
+// oldest first, with the name of their queue, until fn returns an error. data
+// is only valid during the call.
+func (s *Snapshot) Each(fn func(queue string, data []byte, deadline int64) error) error {
+	for _, q := range s.queues {
+		err := q.eachStored(func(data []byte, deadline int64) error {
+			return fn(q.queue, data, deadline)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachMessage is Each with the released messages of every queue first, the
+// messages Export would see.
+func (s *Snapshot) EachMessage(fn func(queue string, data []byte, deadline int64) error) error {
+	for _, q := range s.queues {
+		err := q.each(func(data []byte, deadline int64) error {
+			return fn(q.queue, data, deadline)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Detach captures queues like Capture and marks them deleted at the same
+// instant, every later call fails as after Delete, which still has to remove
+// their files. It fails with ErrRetained if a queue is in log mode, and with
+// ErrPending if a queue has messages in flight or delayed, which a snapshot
+// does not hold; the queues are left as they were then.
+func Detach(queues []*CompositeQueue) (*Snapshot, error) {
+	var err error
+	snaps, sErr := snapshotAll(queues, func() {
+		for _, m := range queues {
+			if m.deleted {
+				continue
+			}
+			if m.groups != nil {
+				err = ErrRetained
+				return
+			}
+			if len(m.inflight.leased) > 0 || len(m.delayed.timers) > 0 {
+				err = ErrPending
+				return
+			}
+		}
+		for _, m := range queues {
+			m.deleted = true
+			m.signalSpace()
+			m.signalPut()
+		}
+	})
+	if sErr != nil {
+		return nil, sErr
+	}
+	s := &Snapshot{queues: snaps}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Snapshot) Close() {
+	for _, q := range s.queues {
+		q.close()
+	}
+	s.queues = nil
+}
@@ -0,0 +1,38 @@
+package mqueue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OverflowPolicy tells what Put does when a bounded queue is full.
+type OverflowPolicy int
+
+const (
+	OverflowReject     OverflowPolicy = iota // fail with ErrQueueFull
+	OverflowDropOldest                       // evict the oldest messages to make room
+	OverflowBlock                            // wait until consumers make room, up to BlockTimeout
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowBlock:
+		return "block"
+	default:
+		return "reject"
+	}
+}
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch strings.ToLower(s) {
+	case "reject":
+		return OverflowReject, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "block":
+		return OverflowBlock, nil
+	}
+	return OverflowReject, fmt.Errorf("Unknown overflow policy [%s]", s)
+}
@@ -0,0 +1,112 @@
+package mqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// RecoveryPolicy tells what to do with the corrupted records found when a
+// segment is opened.
+type RecoveryPolicy int
+
+const (
+	RecoverTruncate RecoveryPolicy = iota // drop the first bad record and everything after it
+	RecoverSkip                           // drop bad records only, as long as the records after them can be framed
+	RecoverRefuse                         // refuse to open the queue
+)
+
+func (p RecoveryPolicy) String() string {
+	switch p {
+	case RecoverSkip:
+		return "skip"
+	case RecoverRefuse:
+		return "refuse"
+	default:
+		return "truncate"
+	}
+}
+
+func ParseRecoveryPolicy(s string) (RecoveryPolicy, error) {
+	switch strings.ToLower(s) {
+	case "truncate":
+		return RecoverTruncate, nil
+	case "skip":
+		return RecoverSkip, nil
+	case "refuse":
+		return RecoverRefuse, nil
+	}
+	return RecoverTruncate, fmt.Errorf("Unknown recovery policy [%s]", s)
+}
+
+// RecoveryReport describes what Recover found between the read and the
+// write position of a queue.
+type RecoveryReport struct {
+	Records      uint64 // valid records kept
+	BadRecords   uint64 // records dropped because they are torn or fail the checksum
+	DroppedBytes uint64 // bytes dropped, bad records included
+	CountFixed   bool   // the header counters did not match the records found
+}
+
+// Corrupted tells whether Recover had anything to fix.
+func (r RecoveryReport) Corrupted() bool {
+	return r.DroppedBytes > 0 || r.CountFixed
+}
+
+// Recover validates the checksum of every unread record and repairs the
+// queue according to policy. With RecoverRefuse the queue is left untouched
+// and ErrCorrupted is returned if anything is wrong. A header which points
+// outside of the queue can not be repaired and always gives ErrCorrupted.
+func (m MQueue) Recover(policy RecoveryPolicy) (report RecoveryReport, err error) {
+	if m.CheckHeader() != nil {
+		return report, ErrCorrupted
+	}
+	readPos := m.ReadPosition()
+	writePos := m.WritePosition()
+
+	pos, dst := readPos, readPos
+	for pos < writePos {
+		if pos+prefixSize > writePos {
+			break
+		}
+		length := m.recordLength(pos)
+		end := pos + prefixSize + length
+		if end > writePos {
+			break
+		}
+		sum := binary.LittleEndian.Uint32(m[pos+lengthSize:])
+		if m.recordChecksum(pos, end) != sum {
+			if policy != RecoverSkip {
+				break
+			}
+			report.BadRecords++
+			pos = end
+			continue
+		}
+		if dst != pos {
+			copy(m[dst:], m[pos:end])
+		}
+		dst += end - pos
+		pos = end
+		report.Records++
+	}
+	if pos < writePos {
+		// the walk stopped at a bad record, everything from there is dropped
+		report.BadRecords++
+	}
+	report.DroppedBytes = writePos - dst
+	report.CountFixed = report.DroppedBytes == 0 && m.Len() != report.Records
+	if !report.Corrupted() {
+		return report, nil
+	}
+	if policy == RecoverRefuse {
+		return report, ErrCorrupted
+	}
+	if report.Records == 0 {
+		m.reset()
+		return report, nil
+	}
+	m.setWritePosition(dst)
+	m.setWriteCount(m.ReadCount() + report.Records)
+	return report, nil
+}
@@ -0,0 +1,167 @@
+package mqueue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+var segmentSuffix = regexp.MustCompile(`\.([0-9]+)\.mq$`)
+
+// segment is one fixed size memory map file of a CompositeQueue, new records
+// are appended to the last segment and a segment is removed once consumed.
+type segment struct {
+	seq     uint64    // position of this segment in the segment set
+	path    string    // file path of this segment
+	file    *os.File  // file handle to memory map
+	mapFile mmap.MMap // memory map of the whole file
+	queue   MQueue    // queue view over mapFile
+	dirty   bool      // modified since the last sync
+	capture uint64    // write position when a snapshot last captured it
+}
+
+// SegmentPath returns the file of the seq-th segment of a queue whose back
+// file is backFile, e.g. data/k1.mq gives data/k1.000001.mq.
+func SegmentPath(backFile string, seq uint64) string {
+	return fmt.Sprintf("%s.%06d.mq", strings.TrimSuffix(backFile, ".mq"), seq)
+}
+
+// SegmentBase returns the back file a segment file belongs to, it is the
+// reverse of SegmentPath. Files which are not segments are returned as is.
+func SegmentBase(file string) string {
+	if loc := segmentSuffix.FindStringIndex(file); loc != nil {
+		return file[:loc[0]] + ".mq"
+	}
+	return file
+}
+
+// listSegments returns the sequence numbers of all segment files of backFile
+// in ascending order. A back file written by an older release, which is not
+// segmented, is reported as sequence 0.
+func listSegments(backFile string) ([]uint64, error) {
+	files, err := filepath.Glob(strings.TrimSuffix(backFile, ".mq") + ".*.mq")
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]uint64, 0, len(files))
+	if _, err = os.Stat(backFile); err == nil {
+		seqs = append(seqs, 0)
+	}
+	for _, f := range files {
+		if SegmentBase(f) != backFile {
+			continue
+		}
+		m := segmentSuffix.FindStringSubmatch(f)
+		seq, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil || seq == 0 {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// openSegment maps the segment file at path, creating and initializing it
+// with size bytes if it does not exist yet. A new segment is initialized
+// aside and renamed to path, so a crash never leaves a segment without header.
+func openSegment(path string, seq uint64, size uint64) (s *segment, err error) {
+	s = &segment{seq: seq, path: path}
+	s.file, err = os.OpenFile(path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return createSegment(path, seq, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = LockFile(s.file, false); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	stat, err := s.file.Stat()
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	loadSize := stat.Size()
+	if loadSize == 0 {
+		if err = s.file.Truncate(int64(size)); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+	s.mapFile, err = mmap.Map(s.file, mmap.RDWR, 0)
+	if err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	s.queue = []byte(s.mapFile)
+	if loadSize == 0 {
+		if err = InitMQueue(s.queue); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// LockFile takes an advisory lock on the queue file f until it is closed,
+// exclusive unless shared, so that a server and the tools never use a file
+// at the same time. ErrLocked is returned at once if another process holds
+// a conflicting lock.
+func LockFile(f *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
+
+func createSegment(path string, seq uint64, size uint64) (*segment, error) {
+	tmpPath := path + ".new"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	s, err := openSegment(tmpPath, seq, size)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		s.close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	s.path = path
+	return s, nil
+}
+
+func (s *segment) close() error {
+	err := s.mapFile.Unmap()
+	if cErr := s.file.Close(); err == nil {
+		err = cErr
+	}
+	s.queue = nil
+	return err
+}
+
+// remove closes the segment and deletes its file.
+func (s *segment) remove() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	return os.Remove(s.path)
+}
@@ -0,0 +1,209 @@
+package mqueue
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// sideLogCompactSize is the size under which a side log is only compacted
+// when its queue is opened.
+const sideLogCompactSize = 1 << 20
+
+// sideLog is the append only file of a set of messages kept next to the
+// segments of a queue, like its in-flight or delayed messages. The file is
+// created by the first write, compacted on open and whenever it grew past
+// twice its size after the last compaction, and removed whenever the set is
+// empty.
+type sideLog struct {
+	path      string
+	file      *os.File     // nil until something is written
+	buff      []byte       // operations not written yet
+	isEmpty   func() bool  // tells whether the set is empty
+	appendAll func() error // buffers the operations which bring back the whole set
+	rewritten func()       // called once the log appendAll buffered replaced the file, may be nil
+	size      int64        // bytes in the file
+	compacted int64        // bytes in the file after the last compaction
+}
+
+// load calls replay with the content of the log, if there is one.
+func (l *sideLog) load(replay func(r *bufio.Reader)) error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	replay(bufio.NewReader(file))
+	return nil
+}
+
+// loadOpen is load keeping the log open, so that the set can read from it.
+func (l *sideLog) loadOpen(replay func(r *bufio.Reader)) error {
+	if _, err := os.Stat(l.path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	stat, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	l.size = stat.Size()
+	replay(bufio.NewReader(io.NewSectionReader(l.file, 0, l.size)))
+	return nil
+}
+
+// open opens the log for appending, creating it if needed.
+func (l *sideLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+// compact replaces the log with the operations which bring back the set, the
+// caller makes sure every operation buffered before is in the set already.
+// The log is kept as it is if appendAll fails.
+func (l *sideLog) compact() error {
+	l.buff = l.buff[:0]
+	if err := l.appendAll(); err != nil {
+		l.buff = l.buff[:0]
+		return err
+	}
+	return l.rewrite()
+}
+
+// rewrite replaces the log with the buffered operations, which describe the
+// whole set. The new log is written aside and renamed over the old one.
+func (l *sideLog) rewrite() error {
+	if l.isEmpty() {
+		l.buff = l.buff[:0]
+		return l.remove()
+	}
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	tmpPath := l.path + ".compact"
+	if err := ReplaceFile(tmpPath, l.path, l.buff); err != nil {
+		// the log is left as it was, it already has every operation
+		l.buff = l.buff[:0]
+		return err
+	}
+	l.size = int64(len(l.buff))
+	l.compacted = l.size
+	l.buff = l.buff[:0]
+	if l.rewritten != nil {
+		l.rewritten()
+	}
+	return nil
+}
+
+// ReplaceFile writes data to tmpPath and renames it to path, both synced so
+// that a crash leaves either the old or the new file.
+func ReplaceFile(tmpPath, path string, data []byte) error {
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// flush writes the buffered operations, the log is removed instead once the
+// set is empty.
+func (l *sideLog) flush() error {
+	if len(l.buff) == 0 {
+		return nil
+	}
+	if l.isEmpty() {
+		l.buff = l.buff[:0]
+		return l.remove()
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	n, err := l.file.Write(l.buff)
+	l.size += int64(n)
+	l.buff = l.buff[:0]
+	if err == nil && l.size > sideLogCompactSize && l.size > 2*l.compacted {
+		err = l.compact()
+	}
+	return err
+}
+
+func (l *sideLog) sync() error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+func (l *sideLog) close() error {
+	err := l.flush()
+	if l.file != nil {
+		if cErr := l.file.Close(); err == nil {
+			err = cErr
+		}
+		l.file = nil
+	}
+	return err
+}
+
+// remove closes the log and deletes its file.
+func (l *sideLog) remove() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	l.size = 0
+	l.compacted = 0
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// snapshot returns the log appendAll buffers, which describes the whole set,
+// and leaves the operations not written yet as they are.
+func (l *sideLog) snapshot() ([]byte, error) {
+	n := len(l.buff)
+	err := l.appendAll()
+	res := append([]byte{}, l.buff[n:]...)
+	l.buff = l.buff[:n]
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}